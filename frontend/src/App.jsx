@@ -11,6 +11,7 @@ import Profile from './pages/Profile'
 import ActivityLog from './pages/ActivityLog'
 import MyActivity from './pages/MyActivity'
 import PasswordRequests from './pages/PasswordRequests'
+import UploadApprovals from './pages/UploadApprovals'
 
 export default function App() {
   return (
@@ -35,6 +36,14 @@ export default function App() {
                 </ProtectedRoute>
               } 
             />
+            <Route 
+              path='/upload-approvals' 
+              element={
+                <ProtectedRoute requiredPermission="stock_approval">
+                  <UploadApprovals />
+                </ProtectedRoute>
+              } 
+            />
             <Route 
               path='/data-change' 
               element={
@@ -37,7 +37,9 @@ export default function ClientManagementModal({ isOpen, onClose, onSave }) {
 
   const handleSave = (index) => {
     const updated = [...clients]
+    // Keep profile fields such as column_mapping, date_parsing and validation_rules, they are edited through the API
     updated[index] = {
+      ...clients[index],
       name: editName,
       offer_id: editOfferId
     }
@@ -88,7 +90,8 @@ export default function ClientManagementModal({ isOpen, onClose, onSave }) {
         onSave(clients)
         onClose()
       } else {
-        alert('Failed to save clients')
+        const data = await res.json().catch(() => ({}))
+        alert(data.message || 'Failed to save clients')
       }
     } catch (error) {
       console.error('Error saving clients:', error)
@@ -163,7 +166,24 @@ export default function ClientManagementModal({ isOpen, onClose, onSave }) {
                   ) : (
                     <>
                       <td className="border border-gray-300 px-4 py-2">{client.name}</td>
-                      <td className="border border-gray-300 px-4 py-2 font-mono text-sm">{client.offer_id}</td>
+                      <td className="border border-gray-300 px-4 py-2 font-mono text-sm">
+                        {client.offer_id}
+                        {client.column_mapping && (
+                          <span className="ml-2 px-2 py-0.5 bg-purple-100 text-purple-700 rounded text-xs font-sans">
+                            Custom columns
+                          </span>
+                        )}
+                        {client.date_parsing && (
+                          <span className="ml-2 px-2 py-0.5 bg-amber-100 text-amber-700 rounded text-xs font-sans">
+                            Custom dates
+                          </span>
+                        )}
+                        {client.validation_rules && (
+                          <span className="ml-2 px-2 py-0.5 bg-teal-100 text-teal-700 rounded text-xs font-sans">
+                            Row rules
+                          </span>
+                        )}
+                      </td>
                       <td className="border border-gray-300 px-4 py-2 text-center space-x-2">
                         <button
                           onClick={() => handleEdit(index)}
@@ -77,6 +77,12 @@ export default function Navbar() {
         </Link>
       )}
       
+      {hasPermission('stock_approval') && (
+        <Link to="/upload-approvals" className="hover:text-blue-600 transition">
+          Upload Approvals
+        </Link>
+      )}
+      
       {hasPermission('user_management') && (
         <Link to="/user-management" className="hover:text-blue-600 transition">
           User Management
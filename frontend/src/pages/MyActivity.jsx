@@ -329,7 +329,19 @@ const MyActivity = () => {
                           {entry.environment}
                         </span>
                       </td>
-                      <td>{entry.clientName}</td>
+                      <td>
+                        {entry.clientName}
+                        {entry.offers && entry.offers.length > 0 && (
+                          <ul className="offer-breakdown">
+                            {entry.offers.map((offer) => (
+                              <li key={offer.offerID}>
+                                {offer.clientName || offer.offerID || 'No offer'}: {offer.successRows}/{offer.totalRows}
+                                {offer.failedRows > 0 && <span className="failed-count"> ({offer.failedRows} failed)</span>}
+                              </li>
+                            ))}
+                          </ul>
+                        )}
+                      </td>
                       <td>{entry.totalRows}</td>
                       <td className="success-count">{entry.successRows}</td>
                       <td className="failed-count">{entry.failedRows}</td>
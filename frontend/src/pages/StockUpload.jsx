@@ -9,7 +9,7 @@ import { useAuth } from '../contexts/AuthContext'
 
 export default function StockUpload() {
   const { isEnvSelected, getEnvLabel, environment } = useEnvironment()
-  const { user } = useAuth()
+  const { user, hasPermission } = useAuth()
   
   const [file, setFile] = useState(null)
   const [filePassword, setFilePassword] = useState('')
@@ -24,17 +24,22 @@ export default function StockUpload() {
   const [clientList, setClientList] = useState([])
   const [selectedClient, setSelectedClient] = useState('')
   const [rzpCommission, setRzpCommission] = useState('')
+  const [multiOffer, setMultiOffer] = useState(false)
+  const [scheduleAt, setScheduleAt] = useState('')
   const [commissionError, setCommissionError] = useState('')
   const [showClientModal, setShowClientModal] = useState(false)
+  const [expiryCheck, setExpiryCheck] = useState(null)
 
   // Upload progress states
   const [isUploading, setIsUploading] = useState(false)
   const [uploadProgress, setUploadProgress] = useState(0)
   const [uploadCompleted, setUploadCompleted] = useState(0)
   const [uploadTotal, setUploadTotal] = useState(0)
+  const [uploadRate, setUploadRate] = useState(null)
   const [executionLog, setExecutionLog] = useState([])
   const [showStopConfirm, setShowStopConfirm] = useState(false)
   const [runId, setRunId] = useState(null)
+  const [queuePosition, setQueuePosition] = useState(null)
   
   // Summary states
   const [showSummary, setShowSummary] = useState(false)
@@ -182,7 +187,8 @@ export default function StockUpload() {
             analyzeCSVData(filteredData, fileToRead.name, fileToRead.size, workbook.SheetNames[0])
             setIsPasswordProtected(false)
             setShowPasswordInput(false)
-            setFilePassword('')
+            // Keep the password that unlocked the workbook for the backend conversion
+            setFilePassword(password)
           } catch (error) {
             console.error('Excel read error:', error)
             console.log('Error details:', error.message)
@@ -283,7 +289,7 @@ export default function StockUpload() {
     
     // Check if it's a valid number
     const num = parseFloat(cleaned)
-    if (isNaN(num)) {
+    if (isNaN(num) || !/^-?\d*\.?\d*$/.test(cleaned)) {
       setCommissionError('Please enter a valid number (e.g., 5 or 5%)')
       return null
     }
@@ -293,6 +299,17 @@ export default function StockUpload() {
       return null
     }
 
+    // The backend stores hundredths of a percent, so more decimals would be lost
+    if ((cleaned.split('.')[1] || '').replace(/0+$/, '').length > 2) {
+      setCommissionError('Commission can have at most 2 decimal places')
+      return null
+    }
+
+    if (num > 100) {
+      setCommissionError('Commission cannot be more than 100%')
+      return null
+    }
+
     setCommissionError('')
     return num
   }
@@ -341,12 +358,8 @@ export default function StockUpload() {
   }, [isUploading, runId])
 
   // Upload handlers
-  const handleStartUpload = async () => {
-    if (!file || !selectedClient || !rzpCommission) {
-      alert('Please fill all required fields')
-      return
-    }
-
+  // Build the form carrying the selected file, as the backend will read it
+  const buildFileFormData = () => {
     // Convert parsed CSV data to CSV string (properly escape values)
     const escapeCsvValue = (value) => {
       const stringValue = String(value || '')
@@ -362,22 +375,117 @@ export default function StockUpload() {
     ).join('\n')
     
     const csvBlob = new Blob([csvString], { type: 'text/csv' })
-    const csvFile = new File([csvBlob], file.name.replace(/\.(xlsx|xls)$/i, '.csv'), { type: 'text/csv' })
+    const csvFile = new File([csvBlob], file.name, { type: 'text/csv' })
+
+    // Excel workbooks are sent as-is and converted by the backend so date
+    // cells and numbers are read from the workbook, not the browser preview
+    const isExcel = /\.(xlsx|xls)$/i.test(file.name)
 
     const formData = new FormData()
-    formData.append('file', csvFile)
+    formData.append('file', isExcel ? file : csvFile)
+    if (isExcel && filePassword) {
+      formData.append('filePassword', filePassword)
+    }
+    return formData
+  }
+
+  // Ask the backend how it reads the expiry dates of the file with the
+  // selected client's date profile, so the preview shows the real epochs
+  useEffect(() => {
+    if (!file || csvData.length === 0 || showPasswordInput || (!multiOffer && !selectedClient) || selectedClient === 'EDIT_CLIENTS') {
+      setExpiryCheck(null)
+      return
+    }
+
+    let cancelled = false
+    const checkExpiryDates = async () => {
+      const formData = buildFileFormData()
+      formData.append('env', environment)
+      formData.append('amountType', 'rupees')
+      const clientObj = clientList.find(c => c.offer_id === selectedClient)
+      if (clientObj) {
+        formData.append('client', JSON.stringify(clientObj))
+      }
+      if (multiOffer) {
+        formData.append('multiOffer', 'true')
+      }
+
+      try {
+        const token = localStorage.getItem('authToken')
+        const res = await fetch(`${API_BASE_URL}/stock/validate`, {
+          method: 'POST',
+          headers: {
+            'Authorization': `Bearer ${token}`
+          },
+          body: formData
+        })
+        const data = await res.json()
+        if (cancelled || !data.success) return
+
+        const byValue = {}
+        data.report.validities.forEach(v => {
+          byValue[v.validity] = v
+        })
+        setExpiryCheck(byValue)
+      } catch (error) {
+        console.error('Error checking expiry dates:', error)
+      }
+    }
+    checkExpiryDates()
+
+    return () => {
+      cancelled = true
+    }
+  }, [file, csvData, showPasswordInput, selectedClient, multiOffer, environment])
+
+  // Time zone the selected client's expiry dates are read in
+  const getClientTimezone = () => {
+    const clientObj = clientList.find(c => c.offer_id === selectedClient)
+    return clientObj?.date_parsing?.timezone || 'Asia/Kolkata'
+  }
+
+  // Multi-offer files name the offer of each row, so the client is optional
+  // and the commission only a default for rows without their own
+  const isConfigComplete = () => {
+    if (commissionError || selectedClient === 'EDIT_CLIENTS') {
+      return false
+    }
+    if (multiOffer) {
+      return !rzpCommission || getCommissionValue() !== ''
+    }
+    return !!selectedClient && !!rzpCommission && getCommissionValue() !== ''
+  }
+
+  const handleStartUpload = async () => {
+    if (!file || !isConfigComplete()) {
+      alert('Please fill all required fields')
+      return
+    }
+
+    const formData = buildFileFormData()
     formData.append('email', user?.email || user?.username || 'unknown')
     formData.append('env', environment)
     
     const clientObj = clientList.find(c => c.offer_id === selectedClient)
-    formData.append('client', JSON.stringify(clientObj))
-    formData.append('amountType', 'paise')
+    if (clientObj) {
+      formData.append('client', JSON.stringify(clientObj))
+    }
+    if (multiOffer) {
+      formData.append('multiOffer', 'true')
+    }
+    // Amounts in stock files are rupees, the backend converts them to paise
+    formData.append('amountType', 'rupees')
     formData.append('rzpCommission', rzpCommission)
+    // datetime-local is the browser's local time, send it with its offset
+    if (scheduleAt) {
+      formData.append('scheduledAt', new Date(scheduleAt).toISOString())
+    }
 
     try {
       setIsUploading(true)
       setUploadProgress(0)
       setUploadCompleted(0)
+      setUploadRate(null)
       // Set the total from fileAnalysis so it shows real count from start
       setUploadTotal(fileAnalysis?.totalRows || 0)
       setExecutionLog([])
@@ -401,9 +509,18 @@ export default function StockUpload() {
 
       const result = await response.json()
       
-      if (result.success) {
+      if (result.success && result.state === 'awaiting_approval') {
+        setIsUploading(false)
+        setScheduleAt('')
+        alert(`Upload submitted for approval: ${result.approval.validRows} of ${result.approval.totalRows} rows valid.\nA user with approval permission must approve it before it runs.\nRun ID: ${result.runId}`)
+      } else if (result.success && result.state === 'scheduled') {
+        setIsUploading(false)
+        setScheduleAt('')
+        alert(`Upload scheduled for ${new Date(result.scheduledAt).toLocaleString('en-IN')}.\nRun ID: ${result.runId}`)
+      } else if (result.success) {
         const uploadRunId = result.runId
         setRunId(uploadRunId)
+        setQueuePosition(result.state === 'queued' ? result.queuePosition : null)
         setResultCsvPath(result.runFolder)
         
         // Connect to WebSocket for real-time updates
@@ -445,6 +562,11 @@ export default function StockUpload() {
               setIsUploading(false)
               continue
             }
+            if (wsMessage.type === 'queue') {
+              const entry = (wsMessage.queue.queued || []).find(queued => queued.runId === uploadRunId)
+              setQueuePosition(entry ? entry.position : null)
+              continue
+            }
             
             // Extract the line content
             const message = wsMessage.line || ''
@@ -455,10 +577,12 @@ export default function StockUpload() {
               const completed = parseInt(parts[0])
               const total = parseInt(parts[1])
               const percentage = parseInt(parts[2])
+              const rate = parts.length > 3 ? parseFloat(parts[3]) : null
               
               setUploadCompleted(completed)
               setUploadTotal(total)
               setUploadProgress(percentage)
+              setUploadRate(rate)
             }
             // Handle row execution logs
             else if (message.startsWith('ROW_LOG:')) {
@@ -590,7 +714,7 @@ export default function StockUpload() {
     }
   }
 
-  const downloadResultCSVWithSummary = async (summary) => {
+  const downloadResultCSVWithSummary = async (summary, full = false) => {
     if (!summary || !summary.resultCsvPath || !summary.runId) {
       console.error('No result CSV path available', summary)
       return
@@ -598,7 +722,8 @@ export default function StockUpload() {
     
     try {
       const token = localStorage.getItem('authToken')
-      const downloadUrl = `http://localhost:5001/stock/download/${summary.runId}/${summary.resultCsvPath}`
+      // Codes and PINs are masked unless the unmasked file is asked for
+      const downloadUrl = `http://localhost:5001/stock/download/${summary.runId}/${summary.resultCsvPath}${full ? '?full=true' : ''}`
       
       console.log('Downloading CSV from:', downloadUrl)
       
@@ -653,14 +778,14 @@ export default function StockUpload() {
     }
   }
 
-  const downloadResultCSV = async () => {
-    // This function uses the state, called from the manual download button
+  const downloadResultCSV = async (full = false) => {
+    // This function uses the state, called from the manual download buttons
     if (!uploadSummary || !uploadSummary.resultCsvPath || !uploadSummary.runId) {
       console.error('No result CSV path available')
       return
     }
     
-    await downloadResultCSVWithSummary(uploadSummary)
+    await downloadResultCSVWithSummary(uploadSummary, full)
   }
 
   const closeSummaryModal = () => {
@@ -674,6 +799,7 @@ export default function StockUpload() {
       setFileAnalysis(null)
       setSelectedClient('')
       setRzpCommission('')
+      setMultiOffer(false)
       setCommissionError('')
       setShowPasswordInput(false)
       setFilePassword('')
@@ -861,6 +987,14 @@ export default function StockUpload() {
     return `${day} ${month} ${year}`
   }
 
+  // Read a rupee amount such as "₹1,000" or "499.50" for the summary. The
+  // backend parses amounts exactly when the file is uploaded.
+  const parseAmountDisplay = (value) => {
+    const cleaned = value.toString().trim().replace(/^(₹|inr|rs\.?)\s*/i, '').replace(/\s*(inr|\/-)$/i, '').replace(/,/g, '')
+    const amount = parseFloat(cleaned)
+    return isNaN(amount) ? null : amount
+  }
+
   // Analyze CSV data and create summary
   const analyzeCSVData = (data, fileName, fileSize, sheetName = null) => {
     if (data.length < 2) {
@@ -894,7 +1028,8 @@ export default function StockUpload() {
     rows.forEach(row => {
       if (!row[amountIndex]) return
       
-      const amount = parseInt(row[amountIndex])
+      const amount = parseAmountDisplay(row[amountIndex])
+      if (amount === null) return
       const validityRaw = row[validityIndex]
       const parsedDate = parseDate(validityRaw)
       
@@ -922,7 +1057,7 @@ export default function StockUpload() {
 
     // Create summary table
     const summary = Object.keys(denominationGroups)
-      .map(denom => parseInt(denom))
+      .map(denom => parseFloat(denom))
       .sort((a, b) => a - b)
       .map(denom => {
         const group = denominationGroups[denom]
@@ -1133,12 +1268,24 @@ export default function StockUpload() {
                       <td className="border border-gray-300 px-4 py-2 text-sm">
                         {item.validityDates.length > 0 ? (
                           <div className="space-y-2">
-                            {item.validityDates.map((dateInfo, idx) => (
-                              <div key={idx} className="flex flex-col">
-                                <span className="font-medium text-gray-800">{dateInfo.display}</span>
-                                <span className="text-xs text-gray-500">Epoch: {dateInfo.timestamp}</span>
-                              </div>
-                            ))}
+                            {item.validityDates.map((dateInfo, idx) => {
+                              // Once a client is selected, the backend's reading replaces the browser's
+                              const checked = expiryCheck?.[dateInfo.display]
+                              return (
+                                <div key={idx} className="flex flex-col">
+                                  <span className="font-medium text-gray-800">{dateInfo.display}</span>
+                                  {checked?.reason ? (
+                                    <span className="text-xs text-red-600">{checked.reason} - set the client's date formats</span>
+                                  ) : checked ? (
+                                    <span className="text-xs text-gray-500">
+                                      Epoch: {checked.expiryEpoch} ({new Date(checked.expiryEpoch * 1000).toLocaleString('en-IN', { timeZone: getClientTimezone() })} {getClientTimezone()})
+                                    </span>
+                                  ) : (
+                                    <span className="text-xs text-gray-500">Epoch: {dateInfo.timestamp}</span>
+                                  )}
+                                </div>
+                              )
+                            })}
                           </div>
                         ) : (
                           <span className="text-gray-400">No validity</span>
@@ -1166,8 +1313,17 @@ export default function StockUpload() {
             <div className="space-y-4">
               {/* Client Selection */}
               <div>
+                <label className="flex items-center gap-2 text-sm text-gray-700 mb-3">
+                  <input
+                    type="checkbox"
+                    checked={multiOffer}
+                    onChange={(e) => setMultiOffer(e.target.checked)}
+                    className="h-4 w-4"
+                  />
+                  Multi-offer file: each row has its own offer_id (and optionally rzp_commission) column
+                </label>
                 <label className="block text-sm font-medium text-gray-700 mb-2">
-                  Select Client <span className="text-red-500">*</span>
+                  Select Client {multiOffer ? <span className="text-gray-400">(optional, for its column mapping and date format)</span> : <span className="text-red-500">*</span>}
                 </label>
                 <select
                   value={selectedClient}
@@ -1194,7 +1350,7 @@ export default function StockUpload() {
               {/* RZP Commission */}
               <div>
                 <label className="block text-sm font-medium text-gray-700 mb-2">
-                  RZP Commission <span className="text-red-500">*</span>
+                  RZP Commission {multiOffer ? <span className="text-gray-400">(optional)</span> : <span className="text-red-500">*</span>}
                 </label>
                 <input
                   type="text"
@@ -1211,33 +1367,63 @@ export default function StockUpload() {
                   <p className="text-xs text-red-500 mt-1">{commissionError}</p>
                 ) : (
                   <p className="text-xs text-gray-400 mt-1">
-                    This value will be applied to all rows
+                    {multiOffer
+                      ? 'Used for rows without an rzp_commission value'
+                      : 'This value will be applied to all rows'}
                   </p>
                 )}
               </div>
 
+              {/* Schedule */}
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-2">
+                  Start At <span className="text-gray-400">(optional)</span>
+                </label>
+                <input
+                  type="datetime-local"
+                  value={scheduleAt}
+                  onChange={(e) => setScheduleAt(e.target.value)}
+                  className="w-full p-3 border-2 rounded-lg focus:border-blue-500 focus:outline-none transition"
+                />
+                <p className="text-xs text-gray-400 mt-1">
+                  Leave empty to start now, or pick a time to run the upload later (e.g. off-peak hours)
+                </p>
+              </div>
+
               {/* Summary Box */}
-              {selectedClient && rzpCommission && !commissionError && getCommissionValue() !== '' && (
+              {isConfigComplete() && (
                 <div className="bg-blue-50 border border-blue-200 rounded-lg p-4 mt-4">
                   <h3 className="font-semibold text-blue-900 mb-2">Upload Summary</h3>
                   <div className="text-sm text-blue-800 space-y-1">
-                    <p><strong>Client:</strong> {clientList.find(c => c.offer_id === selectedClient)?.name}</p>
-                    <p><strong>Offer ID:</strong> {selectedClient}</p>
-                    <p><strong>RZP Commission:</strong> {getCommissionValue()}%</p>
+                    {multiOffer ? (
+                      <>
+                        <p><strong>Offers:</strong> from the offer_id column, checked against {clientList.length} configured clients</p>
+                        <p><strong>RZP Commission:</strong> from the rzp_commission column{getCommissionValue() !== '' && `, default ${getCommissionValue()}%`}</p>
+                      </>
+                    ) : (
+                      <>
+                        <p><strong>Client:</strong> {clientList.find(c => c.offer_id === selectedClient)?.name}</p>
+                        <p><strong>Offer ID:</strong> {selectedClient}</p>
+                        <p><strong>RZP Commission:</strong> {getCommissionValue()}%</p>
+                      </>
+                    )}
                     <p><strong>Total Rows:</strong> {fileAnalysis?.totalRows}</p>
                     <p><strong>Environment:</strong> {getEnvLabel()}</p>
+                    {scheduleAt && (
+                      <p><strong>Starts At:</strong> {new Date(scheduleAt).toLocaleString('en-IN')}</p>
+                    )}
                   </div>
                 </div>
               )}
 
               {/* Start Upload Button */}
-              {selectedClient && rzpCommission && !commissionError && getCommissionValue() !== '' && !isUploading && (
+              {isConfigComplete() && !isUploading && (
                 <div className="mt-6">
                   <button
                     className="w-full py-3 bg-green-600 text-white rounded-lg hover:bg-green-700 transition font-semibold text-lg"
                     onClick={handleStartUpload}
                   >
-                    Start Upload
+                    {scheduleAt ? 'Schedule Upload' : 'Start Upload'}
                   </button>
                 </div>
               )}
@@ -1258,10 +1444,19 @@ export default function StockUpload() {
               </button>
             </div>
 
+            {queuePosition && (
+              <div className="mb-4 p-3 bg-yellow-50 border border-yellow-200 rounded-lg text-sm text-yellow-800">
+                Waiting in queue, position {queuePosition}. The upload starts when a slot frees up.
+              </div>
+            )}
+
             {/* Progress Bar */}
             <div className="mb-6">
               <div className="flex justify-between text-sm text-gray-600 mb-2">
-                <span>{uploadCompleted} / {uploadTotal} rows completed</span>
+                <span>
+                  {uploadCompleted} / {uploadTotal} rows completed
+                  {uploadRate !== null && !isNaN(uploadRate) && ` · ${uploadRate.toFixed(1)} req/s`}
+                </span>
                 <span>{uploadProgress}%</span>
               </div>
               <div className="w-full bg-gray-200 rounded-full h-6 overflow-hidden">
@@ -1461,6 +1656,48 @@ export default function StockUpload() {
                 </div>
               </div>
 
+              {(uploadSummary.skipped > 0 || uploadSummary.alreadyPresent > 0) && (
+                <p className="text-sm text-gray-600 mb-6">
+                  {uploadSummary.skipped > 0 && `${uploadSummary.skipped} duplicate rows skipped. `}
+                  {uploadSummary.alreadyPresent > 0 && `${uploadSummary.alreadyPresent} vouchers were already present upstream and not counted as failures.`}
+                </p>
+              )}
+
+              {/* Per-offer breakdown of multi-offer runs */}
+              {uploadSummary.offers && uploadSummary.offers.length > 0 && (
+                <div className="mb-6">
+                  <h3 className="text-lg font-semibold text-gray-800 mb-3">By Offer</h3>
+                  <div className="overflow-x-auto border border-gray-300 rounded-lg">
+                    <table className="min-w-full border-collapse">
+                      <thead className="bg-gray-100">
+                        <tr>
+                          <th className="border border-gray-300 px-4 py-2 text-left text-sm font-semibold">Client</th>
+                          <th className="border border-gray-300 px-4 py-2 text-left text-sm font-semibold">Offer ID</th>
+                          <th className="border border-gray-300 px-4 py-2 text-right text-sm font-semibold">Total</th>
+                          <th className="border border-gray-300 px-4 py-2 text-right text-sm font-semibold">Success</th>
+                          <th className="border border-gray-300 px-4 py-2 text-right text-sm font-semibold">Failed</th>
+                          <th className="border border-gray-300 px-4 py-2 text-right text-sm font-semibold">Skipped</th>
+                          <th className="border border-gray-300 px-4 py-2 text-right text-sm font-semibold">Already Present</th>
+                        </tr>
+                      </thead>
+                      <tbody>
+                        {uploadSummary.offers.map((offer, index) => (
+                          <tr key={offer.offerId || index} className={index % 2 === 0 ? 'bg-white' : 'bg-gray-50'}>
+                            <td className="border border-gray-300 px-4 py-2 text-sm">{offer.clientName || <span className="text-gray-400">Unknown</span>}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm font-mono">{offer.offerId || <span className="text-gray-400">(none)</span>}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm text-right">{offer.total}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm text-right text-green-700">{offer.success}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm text-right text-red-700">{offer.failed}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm text-right">{offer.skipped}</td>
+                            <td className="border border-gray-300 px-4 py-2 text-sm text-right">{offer.alreadyPresent}</td>
+                          </tr>
+                        ))}
+                      </tbody>
+                    </table>
+                  </div>
+                </div>
+              )}
+
               {/* Procurement Batch ID */}
               <div className="bg-gray-50 border border-gray-200 rounded-lg p-4 mb-6">
                 <p className="text-sm font-semibold text-gray-700 mb-1">Procurement Batch ID:</p>
@@ -1498,9 +1735,9 @@ export default function StockUpload() {
                         ))}
                       </tbody>
                     </table>
-                    {uploadSummary.failedResults.length > 10 && (
+                    {uploadSummary.failed > 10 && (
                       <div className="bg-gray-50 border-t border-gray-300 px-4 py-2 text-center text-sm text-gray-600">
-                        Showing 10 of {uploadSummary.failedResults.length} failed rows
+                        Showing 10 of {uploadSummary.failed} failed rows
                       </div>
                     )}
                   </div>
@@ -1511,11 +1748,19 @@ export default function StockUpload() {
             {/* Modal Footer */}
             <div className="p-6 border-t space-y-3">
               <button
-                onClick={downloadResultCSV}
+                onClick={() => downloadResultCSV()}
                 className="w-full px-6 py-3 bg-green-600 text-white rounded-lg hover:bg-green-700 transition font-semibold"
               >
                 Download Full Results CSV
               </button>
+              {hasPermission('stock_full_export') && (
+                <button
+                  onClick={() => downloadResultCSV(true)}
+                  className="w-full px-6 py-3 bg-yellow-600 text-white rounded-lg hover:bg-yellow-700 transition font-semibold"
+                >
+                  Download Unmasked Results CSV
+                </button>
+              )}
               <button
                 onClick={closeSummaryModal}
                 className="w-full px-6 py-3 bg-gray-600 text-white rounded-lg hover:bg-gray-700 transition font-semibold"
@@ -0,0 +1,210 @@
+import { API_BASE_URL } from "../config/api"
+import React, { useState, useEffect } from 'react';
+import './PasswordRequests.css';
+
+const UploadApprovals = () => {
+  const [approvals, setApprovals] = useState([]);
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState('');
+  const [showConfirmModal, setShowConfirmModal] = useState(false);
+  const [selectedRun, setSelectedRun] = useState(null);
+  const [confirmAction, setConfirmAction] = useState('');
+  const [comment, setComment] = useState('');
+
+  useEffect(() => {
+    fetchApprovals();
+  }, []);
+
+  const fetchApprovals = async () => {
+    try {
+      setLoading(true);
+      const token = localStorage.getItem('authToken');
+
+      const response = await fetch(`${API_BASE_URL}/stock/approvals`, {
+        headers: {
+          'Authorization': `Bearer ${token}`
+        }
+      });
+
+      if (!response.ok) {
+        throw new Error('Failed to fetch uploads awaiting approval');
+      }
+
+      const data = await response.json();
+      setApprovals(data.approvals || []);
+      setError('');
+    } catch (err) {
+      setError(err.message);
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const handleReview = (run, action) => {
+    setSelectedRun(run);
+    setConfirmAction(action);
+    setComment('');
+    setShowConfirmModal(true);
+  };
+
+  const confirmReview = async () => {
+    try {
+      const token = localStorage.getItem('authToken');
+
+      const response = await fetch(`${API_BASE_URL}/stock/approvals/${selectedRun.runId}`, {
+        method: 'POST',
+        headers: {
+          'Authorization': `Bearer ${token}`,
+          'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({
+          action: confirmAction,
+          comment
+        })
+      });
+
+      if (!response.ok) {
+        const data = await response.json();
+        throw new Error(data.message || 'Failed to review upload');
+      }
+
+      // Refresh approvals list
+      await fetchApprovals();
+      setShowConfirmModal(false);
+      setSelectedRun(null);
+    } catch (err) {
+      setError(err.message);
+      setShowConfirmModal(false);
+    }
+  };
+
+  const formatDate = (timestamp) => {
+    return new Date(timestamp).toLocaleString('en-US', {
+      year: 'numeric',
+      month: 'short',
+      day: 'numeric',
+      hour: '2-digit',
+      minute: '2-digit'
+    });
+  };
+
+  const formatValue = (paise) => {
+    return `₹${(paise / 100).toLocaleString('en-IN', { minimumFractionDigits: 2 })}`;
+  };
+
+  return (
+    <div className="password-requests-container">
+      <div className="password-requests-header">
+        <h1>Upload Approvals</h1>
+        <p>Review stock uploads waiting for a second approver</p>
+      </div>
+
+      {loading ? (
+        <div className="loading">Loading uploads...</div>
+      ) : error ? (
+        <div className="error-message">{error}</div>
+      ) : (
+        <div className="requests-section">
+          <h2>Awaiting Approval ({approvals.length})</h2>
+          {approvals.length === 0 ? (
+            <div className="no-data">No uploads awaiting approval</div>
+          ) : (
+            <div className="requests-grid">
+              {approvals.map((run) => (
+                <div key={run.runId} className="request-card pending-card">
+                  <div className="card-header">
+                    <div className="user-info">
+                      <div className="username">{run.fileName}</div>
+                      <div className="user-role">{run.env} · {run.multiOffer ? 'Multi-offer' : run.clientName}</div>
+                    </div>
+                    <span className="status-badge status-pending">PENDING</span>
+                  </div>
+                  <div className="card-body">
+                    <div className="info-row">
+                      <span className="label">Uploaded by:</span>
+                      <span className="value">{run.user}</span>
+                    </div>
+                    <div className="info-row">
+                      <span className="label">Submitted:</span>
+                      <span className="value">{formatDate(run.approval.requestedAt)}</span>
+                    </div>
+                    {run.scheduledAt && (
+                      <div className="info-row">
+                        <span className="label">Scheduled:</span>
+                        <span className="value">{formatDate(run.scheduledAt)}</span>
+                      </div>
+                    )}
+                    <div className="info-row">
+                      <span className="label">Valid rows:</span>
+                      <span className="value">{run.approval.validRows} / {run.approval.totalRows}</span>
+                    </div>
+                    <div className="info-row">
+                      <span className="label">Rejected / Duplicates:</span>
+                      <span className="value">{run.approval.rejectedRows} / {run.approval.duplicateRows}</span>
+                    </div>
+                    <div className="info-row">
+                      <span className="label">Total value:</span>
+                      <span className="value">{formatValue(run.approval.totalValuePaise)}</span>
+                    </div>
+                  </div>
+                  <div className="card-actions">
+                    <button
+                      className="btn-approve"
+                      onClick={() => handleReview(run, 'approve')}
+                    >
+                      Approve
+                    </button>
+                    <button
+                      className="btn-reject"
+                      onClick={() => handleReview(run, 'reject')}
+                    >
+                      Reject
+                    </button>
+                  </div>
+                </div>
+              ))}
+            </div>
+          )}
+        </div>
+      )}
+
+      {/* Confirmation Modal */}
+      {showConfirmModal && (
+        <div className="modal-overlay" onClick={() => setShowConfirmModal(false)}>
+          <div className="modal-content" onClick={(e) => e.stopPropagation()}>
+            <h3>Confirm {confirmAction === 'approve' ? 'Approval' : 'Rejection'}</h3>
+            <p>
+              Are you sure you want to {confirmAction} <strong>{selectedRun?.fileName}</strong> from{' '}
+              <strong>{selectedRun?.user}</strong> ({formatValue(selectedRun?.approval.totalValuePaise || 0)})?
+            </p>
+            {confirmAction === 'approve' && (
+              <p className="note">
+                Note: After approval, the upload is queued and sent to {selectedRun?.env}.
+              </p>
+            )}
+            <textarea
+              value={comment}
+              onChange={(e) => setComment(e.target.value)}
+              placeholder="Comment (optional)"
+              rows={3}
+              style={{ width: '100%', marginBottom: '1rem' }}
+            />
+            <div className="modal-actions">
+              <button className="btn-cancel" onClick={() => setShowConfirmModal(false)}>
+                Cancel
+              </button>
+              <button
+                className={confirmAction === 'approve' ? 'btn-approve' : 'btn-reject'}
+                onClick={confirmReview}
+              >
+                Confirm {confirmAction === 'approve' ? 'Approval' : 'Rejection'}
+              </button>
+            </div>
+          </div>
+        </div>
+      )}
+    </div>
+  );
+};
+
+export default UploadApprovals;
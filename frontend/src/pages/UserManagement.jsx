@@ -6,6 +6,8 @@ import { useAuth } from '../contexts/AuthContext'
 const AVAILABLE_PERMISSIONS = [
   { id: 'dashboard', label: 'Dashboard' },
   { id: 'stock_upload', label: 'Stock Upload' },
+  { id: 'stock_approval', label: 'Stock Upload Approval' },
+  { id: 'stock_full_export', label: 'Unmasked Results Download' },
   { id: 'data_change_operation', label: 'Data Change Operation' },
   { id: 'user_management', label: 'User Management' }
 ]
@@ -145,7 +147,7 @@ export default function UserManagement() {
     let defaultPermissions = []
     switch (role) {
       case 'super_admin':
-        defaultPermissions = ['dashboard', 'stock_upload', 'data_change_operation', 'user_management']
+        defaultPermissions = ['dashboard', 'stock_upload', 'stock_approval', 'data_change_operation', 'user_management']
         break
       case 'admin':
         defaultPermissions = ['dashboard', 'stock_upload', 'data_change_operation']
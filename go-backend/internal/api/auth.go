@@ -3,7 +3,6 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 	"time"
 
 	"gc-distribution-portal/internal/config"
@@ -119,9 +118,13 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT token
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "your-secret-key-change-in-production"
+	jwtSecret, err := h.config.JWTSecret()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to generate token",
+		})
+		return
 	}
 
 	claims := &middleware.UserClaims{
@@ -294,7 +297,7 @@ func (h *AuthHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	if req.Permissions == nil || len(req.Permissions) == 0 {
 		switch req.Role {
 		case "super_admin":
-			req.Permissions = []string{"dashboard", "stock_upload", "data_change_operation", "user_management"}
+			req.Permissions = []string{"dashboard", "stock_upload", "stock_approval", "data_change_operation", "user_management"}
 		case "admin":
 			req.Permissions = []string{"dashboard", "stock_upload", "data_change_operation"}
 		case "user":
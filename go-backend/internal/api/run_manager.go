@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Run states, persisted as a snapshot in each run folder's control.json
+const (
+	RunStateRunning          = "running"
+	RunStatePaused           = "paused"
+	RunStateStopped          = "stopped"
+	RunStateCompleted        = "completed"
+	RunStateFailed           = "failed"
+	RunStateInterrupted      = "interrupted"
+	RunStateAwaitingApproval = "awaiting_approval" // submitted to an environment that requires approval
+	RunStateRejected         = "rejected"          // turned down by an approver, never started
+	RunStateScheduled        = "scheduled"         // waiting for its scheduled start, see uploadScheduler
+	RunStateQueued           = "queued"            // waiting for a free slot, see uploadQueue
+	RunStateCancelled        = "cancelled"         // scheduled or queued run cancelled before it started
+)
+
+// isFinishedState reports whether a run is done for good: it can no longer
+// start, be resumed or be approved
+func isFinishedState(state string) bool {
+	switch state {
+	case RunStateCompleted, RunStateFailed, RunStateStopped, RunStateRejected, RunStateCancelled:
+		return true
+	}
+	return false
+}
+
+var (
+	// ErrRunNotFound is returned for runs without a run folder or control file
+	ErrRunNotFound = errors.New("run not found")
+	// ErrInvalidAction is returned for actions other than pause, resume and stop
+	ErrInvalidAction = errors.New("invalid action")
+	// ErrRunActive is returned when starting a run that is already active
+	ErrRunActive = errors.New("run is already active")
+	// errRunStopped is returned to workers of a run that was stopped
+	errRunStopped = errors.New("run stopped")
+)
+
+// TransitionError is returned when an action is not allowed in the current state
+type TransitionError struct {
+	State  string
+	Action string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot %s a run that is %s", e.Action, e.State)
+}
+
+// activeRun is a run with a live upload process
+type activeRun struct {
+	id     string
+	folder string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	state    string
+	resumed  chan struct{} // closed when a paused run resumes or stops
+	progress RunProgress
+}
+
+// Progress returns the live row counts of the run
+func (r *activeRun) Progress() RunProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// setProgress replaces the row counts, used once the rows to upload are known
+func (r *activeRun) setProgress(progress RunProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = progress
+}
+
+// recordResults adds finished rows to the row counts
+func (r *activeRun) recordResults(results []UploadResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, result := range results {
+		r.progress.add(result)
+	}
+}
+
+// State returns the current state of the run
+func (r *activeRun) State() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// waitWhilePaused blocks while the run is paused. It returns errRunStopped
+// once the run has been stopped.
+func (r *activeRun) waitWhilePaused() error {
+	for {
+		r.mu.Lock()
+		state, resumed := r.state, r.resumed
+		r.mu.Unlock()
+
+		switch state {
+		case RunStateStopped:
+			return errRunStopped
+		case RunStatePaused:
+			select {
+			case <-resumed:
+			case <-r.ctx.Done():
+				return errRunStopped
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// RunManager owns every active upload run. State changes go through it and
+// are written to control.json as a snapshot for restarts and run listings.
+type RunManager struct {
+	uploadsDir string
+
+	mu   sync.Mutex
+	runs map[string]*activeRun
+}
+
+// NewRunManager creates a run manager for the runs in uploadsDir
+func NewRunManager(uploadsDir string) *RunManager {
+	return &RunManager{
+		uploadsDir: uploadsDir,
+		runs:       make(map[string]*activeRun),
+	}
+}
+
+// Start registers a run as active and running
+func (m *RunManager) Start(runID, runFolder string) (*activeRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.runs[runID]; ok {
+		return nil, ErrRunActive
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &activeRun{
+		id:     runID,
+		folder: runFolder,
+		ctx:    ctx,
+		cancel: cancel,
+		state:  RunStateRunning,
+	}
+	if err := writeControlState(runFolder, RunStateRunning); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	m.runs[runID] = run
+	return run, nil
+}
+
+// Finish records the final state of an active run and releases it.
+// A stopped run stays stopped whatever final state is given.
+func (m *RunManager) Finish(run *activeRun, state string) {
+	m.mu.Lock()
+	delete(m.runs, run.id)
+	m.mu.Unlock()
+
+	run.mu.Lock()
+	if run.state == RunStateStopped {
+		state = RunStateStopped
+	}
+	run.state = state
+	run.mu.Unlock()
+
+	run.cancel()
+	writeControlState(run.folder, state)
+}
+
+// Get returns an active run, or nil when the run is not active
+func (m *RunManager) Get(runID string) *activeRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.runs[runID]
+}
+
+// State returns the live state of an active run, or the snapshot of an inactive one
+func (m *RunManager) State(runID string) string {
+	if run := m.Get(runID); run != nil {
+		return run.State()
+	}
+	return readControlState(filepath.Join(m.uploadsDir, filepath.Base(runID)))
+}
+
+// Control applies a pause, resume or stop action and returns the resulting state.
+// An interrupted run has no process left but can still be stopped to close it.
+func (m *RunManager) Control(runID, action string) (string, error) {
+	if action != "pause" && action != "resume" && action != "stop" {
+		return "", ErrInvalidAction
+	}
+
+	run := m.Get(runID)
+	if run == nil {
+		runFolder := filepath.Join(m.uploadsDir, filepath.Base(runID))
+		state := readControlState(runFolder)
+		if state == "" {
+			return "", ErrRunNotFound
+		}
+		if state == RunStateInterrupted && action == "stop" {
+			if err := writeControlState(runFolder, RunStateStopped); err != nil {
+				return state, err
+			}
+			return RunStateStopped, nil
+		}
+		return state, &TransitionError{State: state, Action: action}
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	switch {
+	case action == "pause" && run.state == RunStateRunning:
+		run.state = RunStatePaused
+		run.resumed = make(chan struct{})
+	case action == "resume" && run.state == RunStatePaused:
+		run.state = RunStateRunning
+		close(run.resumed)
+	case action == "stop" && (run.state == RunStateRunning || run.state == RunStatePaused):
+		if run.state == RunStatePaused {
+			close(run.resumed)
+		}
+		run.state = RunStateStopped
+		run.cancel() // abort in-flight requests
+	default:
+		return run.state, &TransitionError{State: run.state, Action: action}
+	}
+
+	if err := writeControlState(run.folder, run.state); err != nil {
+		return run.state, err
+	}
+	return run.state, nil
+}
+
+// readControlState returns the state stored in the control file of a run
+func readControlState(runFolder string) string {
+	data, err := os.ReadFile(filepath.Join(runFolder, "control.json"))
+	if err != nil {
+		return ""
+	}
+	var control ControlState
+	json.Unmarshal(data, &control)
+	return control.State
+}
+
+// writeControlState stores a new state in the control file of a run
+func writeControlState(runFolder, state string) error {
+	data, _ := json.MarshalIndent(ControlState{State: state}, "", "  ")
+	return os.WriteFile(filepath.Join(runFolder, "control.json"), data, 0644)
+}
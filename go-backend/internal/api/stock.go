@@ -1,10 +1,12 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,7 +18,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"gc-distribution-portal/internal/artifact"
 	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/objectstore"
 	"gc-distribution-portal/internal/utils"
 
 	"github.com/gorilla/mux"
@@ -24,23 +29,76 @@ import (
 
 // StockHandler handles stock upload endpoints
 type StockHandler struct {
-	config *config.Config
+	config    *config.Config
+	artifacts *artifact.Keyring // nil when artifacts are stored in plaintext
+	archive   objectstore.ObjectStore // nil when finished runs are not archived
+	redact    *redactor
+	runs      *RunManager
+	queue     *uploadQueue
+	schedules *uploadScheduler
+
+	approvalMutex  sync.Mutex // serialises reviews of runs awaiting approval
+	retentionMutex sync.Mutex // serialises passes of the retention job
+	procLogMutex   sync.Mutex // guards the global procurement log
+	archiveMutex   sync.Mutex // serialises archiving, pruning and restoring of run files
+	offerLocks     offerLocks // one run at a time per offer, see runUploadProcess
+	archiveQueue   chan string
 }
 
 // NewStockHandler creates a new stock handler
-func NewStockHandler(cfg *config.Config) *StockHandler {
-	return &StockHandler{config: cfg}
+func NewStockHandler(cfg *config.Config, artifacts *artifact.Keyring, archive objectstore.ObjectStore) *StockHandler {
+	h := &StockHandler{config: cfg, artifacts: artifacts, archive: archive, redact: newRedactor(cfg.Redaction), runs: NewRunManager(cfg.UploadsDir), queue: newUploadQueue(), schedules: newUploadScheduler(), archiveQueue: make(chan string, 64)}
+	h.removeIncomingFolders()
+	h.protectArtifacts()
+	h.backfillVoucherIndex()
+	h.markInterruptedRuns()
+	return h
 }
 
 // UploadMetadata represents upload metadata
 type UploadMetadata struct {
-	RunID              string      `json:"runId"`
-	FileName           string      `json:"fileName"`
-	User               string      `json:"user"`
-	Env                string      `json:"env"`
-	Client             interface{} `json:"client"`
-	AmountType         string      `json:"amountType"`
-	RzpCommissionInput string      `json:"rzpCommissionInput"`
+	RunID              string       `json:"runId"`
+	FileName           string       `json:"fileName"`
+	User               string       `json:"user"`
+	Env                string       `json:"env"`
+	Client             interface{}  `json:"client"`
+	AmountType         string       `json:"amountType"`
+	RzpCommissionInput string       `json:"rzpCommissionInput"`
+	DuplicatePolicy    string       `json:"duplicatePolicy"`
+	ParentRunID        string       `json:"parentRunId,omitempty"` // set on retry-failed child runs
+	ChildRunIDs        []string     `json:"childRunIds,omitempty"`
+	RowFilter          []int        `json:"rowFilter,omitempty"` // row numbers a child run reprocesses
+	CreatedAt          *time.Time   `json:"createdAt,omitempty"`
+	ScheduledAt        *time.Time   `json:"scheduledAt,omitempty"` // set on runs submitted to start later
+	Approval           *RunApproval `json:"approval,omitempty"`    // set on runs of environments that require approval
+	StartedAt          *time.Time   `json:"startedAt,omitempty"`
+	FinishedAt         *time.Time   `json:"finishedAt,omitempty"`
+	Summary            *RunProgress `json:"summary,omitempty"` // final row counts
+	Offers             []OfferBreakdown `json:"offers,omitempty"` // final row counts per offer
+	Retention          *RunRetention `json:"retention,omitempty"` // files removed by the retention job
+	Archive            *RunArchive   `json:"archive,omitempty"`   // set once the run files are archived
+
+	// ColumnMapping, DateParsing and ValidationRules are the client's profile
+	// when the run started, so a resumed or retried run reads the file the same way
+	ColumnMapping   *config.ColumnMapping   `json:"columnMapping,omitempty"`
+	DateParsing     *config.DateParsing     `json:"dateParsing,omitempty"`
+	ValidationRules *config.ValidationRules `json:"validationRules,omitempty"`
+
+	// MultiOffer runs take the offer of each row from its offer_id column,
+	// checked against OfferClients, the clients.json of when the run started
+	MultiOffer   bool            `json:"multiOffer,omitempty"`
+	OfferClients []config.Client `json:"offerClients,omitempty"`
+}
+
+// profile returns the client profile the run reads its file with
+func (m *UploadMetadata) profile() fileProfile {
+	return fileProfile{
+		mapping:    m.ColumnMapping,
+		dates:      m.DateParsing,
+		rules:      m.ValidationRules,
+		amountType: m.AmountType,
+		offers:     newOfferSettings(m.MultiOffer, m.Client, m.RzpCommissionInput, m.OfferClients),
+	}
 }
 
 // ControlState represents control file structure
@@ -48,115 +106,368 @@ type ControlState struct {
 	State string `json:"state"`
 }
 
+// maxUploadBytes caps the request body of an upload. The file is streamed to
+// disk, so this only guards the disk, not memory.
+const maxUploadBytes = 2 << 30
+
+// maxFormValueBytes caps each non-file field of an upload form
+const maxFormValueBytes = 1 << 20
+
 // StartUpload handles the file upload and starts processing
-func (h *StockHandler) StartUpload(hub *WebSocketHub) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Parse multipart form (max 32MB)
-		if err := r.ParseMultipartForm(32 << 20); err != nil {
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+func (h *StockHandler) StartUpload(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	// Stream the file into a scratch folder, the run ID depends on the file name
+	if err := os.MkdirAll(h.config.UploadsDir, 0755); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to create run folder",
+		})
+		return
+	}
+	incoming, err := os.MkdirTemp(h.config.UploadsDir, incomingFolderPrefix)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to create run folder",
+		})
+		return
+	}
+	defer os.RemoveAll(incoming) // gone already once renamed to the run folder
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	form, err := readUploadForm(h.artifacts, r, incoming)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Get form values. The uploader is the signed-in user, never a form
+	// value: approvals and run access are decided by it.
+	user := activityUser(userClaims)
+	env := form.Value("env")
+	clientStr := form.Value("client")
+	rzpCommission := form.Value("rzpCommission")
+	duplicatePolicy := normalizeDuplicatePolicy(form.Value("duplicatePolicy"))
+	multiOffer := parseMultiOffer(form.Value("multiOffer"))
+
+	// Reject unusable amount types, commissions and start times before a
+	// run is created. Multi-offer files may carry the commission of each row instead.
+	amountType, err := normalizeAmountType(form.Value("amountType"))
+	if err == nil && (!multiOffer || strings.TrimSpace(rzpCommission) != "") {
+		_, err = parseCommission(rzpCommission)
+	}
+	var scheduledAt *time.Time
+	if err == nil {
+		scheduledAt, err = parseScheduledAt(form.Value("scheduledAt"), time.Now())
+	}
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Create run ID and folder
+	timestamp := time.Now().Format("2006-01-02T15-04-05")
+	fileName := strings.TrimSuffix(form.fileName, filepath.Ext(form.fileName))
+	runID := fmt.Sprintf("%s_%s", fileName, timestamp)
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+
+	if err := os.Rename(incoming, runFolder); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to create run folder",
+		})
+		return
+	}
+
+	// Parse client JSON
+	var clientData interface{}
+	if clientStr != "" {
+		json.Unmarshal([]byte(clientStr), &clientData)
+	}
+
+	// The client's profile decides how its file is read
+	_, offerID := clientFields(clientData)
+	client, err := h.config.FindClient(offerID)
+	if err != nil {
+		os.RemoveAll(runFolder)
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to load clients: %v", err),
+		})
+		return
+	}
+	profile := clientProfile(client)
+	profile.amountType = amountType
+
+	// Multi-offer rows are checked against the offers configured now
+	var offerClients []config.Client
+	if multiOffer {
+		if offerClients, err = h.config.LoadClients(); err != nil {
+			os.RemoveAll(runFolder)
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"success": false,
-				"message": "Failed to parse form",
+				"message": fmt.Sprintf("Failed to load clients: %v", err),
 			})
 			return
 		}
+	}
+
+	// Save metadata
+	createdAt := time.Now()
+	meta := UploadMetadata{
+		RunID:              runID,
+		FileName:           form.fileName,
+		User:               user,
+		Env:                env,
+		Client:             clientData,
+		AmountType:         amountType,
+		RzpCommissionInput: rzpCommission,
+		DuplicatePolicy:    duplicatePolicy,
+		CreatedAt:          &createdAt,
+		ScheduledAt:        scheduledAt,
+		ColumnMapping:      profile.mapping,
+		DateParsing:        profile.dates,
+		ValidationRules:    profile.rules,
+		MultiOffer:         multiOffer,
+		OfferClients:       offerClients,
+	}
+	metaPath := filepath.Join(runFolder, "meta.json")
+	metaData, _ := json.MarshalIndent(meta, "", "  ")
+	os.WriteFile(metaPath, metaData, 0644)
+
+	// Generate procurement ID
+	procID := utils.GenerateRzpID()
+	os.WriteFile(filepath.Join(runFolder, "procurement_batch_id.txt"), []byte(procID), 0644)
 
-		// Get file
-		file, header, err := r.FormFile("file")
+	// Environments that require approval hold the run, with its validation
+	// report, until an approver reviews it
+	needsApproval, err := h.requiresApproval(env)
+	if err != nil {
+		os.RemoveAll(runFolder)
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to load environments: %v", err),
+		})
+		return
+	}
+	if needsApproval {
+		approval, err := h.submitForApproval(meta)
 		if err != nil {
+			os.RemoveAll(runFolder)
 			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"success": false,
-				"message": "File required",
+				"message": err.Error(),
 			})
 			return
 		}
-		defer file.Close()
+		h.appendProcurementLog(procID, form.fileName)
 
-		// Get form values
-		email := r.FormValue("email")
-		env := r.FormValue("env")
-		clientStr := r.FormValue("client")
-		amountType := r.FormValue("amountType")
-		rzpCommission := r.FormValue("rzpCommission")
+		details := fmt.Sprintf("Run: %s, File: %s, Valid rows: %d/%d, Value: ₹%.2f", runID, form.fileName,
+			approval.ValidRows, approval.TotalRows, float64(approval.TotalValuePaise)/100)
+		if scheduledAt != nil {
+			details += fmt.Sprintf(", Scheduled At: %s", scheduledAt.Format(time.RFC3339))
+		}
+		utils.LogActivity(h.config.ConfigDir, user, "Submit Upload for Approval", strings.ToUpper(env), details, "Pending")
 
-		// Create run ID and folder
-		timestamp := time.Now().Format("2006-01-02T15-04-05")
-		fileName := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
-		runID := fmt.Sprintf("%s_%s", fileName, timestamp)
-		runFolder := filepath.Join(h.config.UploadsDir, runID)
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success":     true,
+			"runId":       runID,
+			"runFolder":   runFolder,
+			"state":       RunStateAwaitingApproval,
+			"approval":    approval,
+			"scheduledAt": scheduledAt,
+		})
+		return
+	}
 
-		if err := os.MkdirAll(runFolder, 0755); err != nil {
+	// Scheduled runs wait for their start time, the scheduler starts them
+	if scheduledAt != nil {
+		if err := h.scheduleRun(runID, runFolder, *scheduledAt); err != nil {
+			os.RemoveAll(runFolder)
 			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"success": false,
-				"message": "Failed to create run folder",
+				"message": "Run could not be scheduled",
 			})
 			return
 		}
+		h.appendProcurementLog(procID, form.fileName)
 
-		// Save uploaded file
-		rawPath := filepath.Join(runFolder, "raw.csv")
-		dst, err := os.Create(rawPath)
+		utils.LogActivity(h.config.ConfigDir, user, "Schedule Upload", strings.ToUpper(env),
+			fmt.Sprintf("Run: %s, File: %s, Scheduled At: %s", runID, form.fileName, scheduledAt.Format(time.RFC3339)), "Success")
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success":     true,
+			"runId":       runID,
+			"runFolder":   runFolder,
+			"state":       RunStateScheduled,
+			"scheduledAt": scheduledAt,
+		})
+		return
+	}
+
+	// Queue the run, it starts in the background once a slot is free
+	state, position, err := h.enqueueRun(meta)
+	if err != nil {
+		os.RemoveAll(runFolder)
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Run could not be queued",
+		})
+		return
+	}
+	h.appendProcurementLog(procID, form.fileName)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"runId":         runID,
+		"runFolder":     runFolder,
+		"state":         state,
+		"queuePosition": position,
+	})
+}
+
+// incomingFolderPrefix names the scratch folders uploads are streamed into
+// before they get their run folder
+const incomingFolderPrefix = ".incoming-"
+
+// removeIncomingFolders deletes the scratch folders of uploads that were cut
+// off by a restart before they got their run folder
+func (h *StockHandler) removeIncomingFolders() {
+	folders, _ := filepath.Glob(filepath.Join(h.config.UploadsDir, incomingFolderPrefix+"*"))
+	for _, folder := range folders {
+		os.RemoveAll(folder)
+	}
+}
+
+// uploadForm holds the fields of a streamed upload form and the saved file
+type uploadForm struct {
+	fields   map[string]string
+	fileName string // name of the uploaded file as sent by the browser
+	csvPath  string // CSV to parse, converted from Excel when needed
+}
+
+// Value returns a form field, or "" when it was not sent
+func (f *uploadForm) Value(key string) string {
+	return f.fields[key]
+}
+
+// readUploadForm reads a multipart upload part by part. The file is copied
+// straight to folder, encrypted with keys, instead of being buffered, so its
+// size does not matter; the other fields are small and kept in memory. Excel
+// workbooks are converted once the whole form is read, as the password may
+// come after them.
+func readUploadForm(keys *artifact.Keyring, r *http.Request, folder string) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse form")
+	}
+
+	form := &uploadForm{fields: make(map[string]string)}
+	savePath := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"success": false,
-				"message": "Failed to save file",
-			})
-			return
+			return nil, uploadReadError(err, "Failed to parse form")
 		}
-		if _, err := io.Copy(dst, file); err != nil {
-			dst.Close()
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"success": false,
-				"message": "Failed to write file",
-			})
-			return
+
+		name := part.FormName()
+		switch {
+		case name == "file" && part.FileName() != "" && savePath == "":
+			form.fileName = part.FileName()
+			savePath, err = writeUploadedFile(keys, part, form.fileName, folder)
+		case name != "":
+			form.fields[name], err = readFormValue(part, name)
 		}
-		dst.Close()
+		part.Close()
 
-		// Parse client JSON
-		var clientData interface{}
-		if clientStr != "" {
-			json.Unmarshal([]byte(clientStr), &clientData)
-		}
-
-		// Save metadata
-		meta := UploadMetadata{
-			RunID:              runID,
-			FileName:           header.Filename,
-			User:               email,
-			Env:                env,
-			Client:             clientData,
-			AmountType:         amountType,
-			RzpCommissionInput: rzpCommission,
-		}
-		metaPath := filepath.Join(runFolder, "meta.json")
-		metaData, _ := json.MarshalIndent(meta, "", "  ")
-		os.WriteFile(metaPath, metaData, 0644)
-
-		// Generate procurement ID
-		procID := utils.GenerateRzpID()
-		os.WriteFile(filepath.Join(runFolder, "procurement_batch_id.txt"), []byte(procID), 0644)
-		
-		// Append to global procurement file
-		f, _ := os.OpenFile(h.config.ProcIDFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if f != nil {
-			f.WriteString(fmt.Sprintf("%s %s\n", procID, header.Filename))
-			f.Close()
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// Create control file
-		controlPath := filepath.Join(runFolder, "control.json")
-		controlData, _ := json.Marshal(ControlState{State: "running"})
-		os.WriteFile(controlPath, controlData, 0644)
+	if savePath == "" {
+		return nil, fmt.Errorf("File required")
+	}
 
-	// Start upload process in background
-	go h.runUploadProcess(runID, runFolder, rawPath, env, rzpCommission, clientData, hub)
+	form.csvPath, err = convertUploadedFile(keys, savePath, folder, form.Value("filePassword"))
+	if err != nil {
+		return nil, err
+	}
+	return form, nil
+}
 
-		respondJSON(w, http.StatusOK, map[string]interface{}{
-			"success":   true,
-			"runId":     runID,
-			"runFolder": runFolder,
-		})
+// writeUploadedFile copies the uploaded file into folder and returns its path.
+// Excel workbooks are saved as raw.xlsx/raw.xls, anything else as raw.csv.
+func writeUploadedFile(keys *artifact.Keyring, src io.Reader, fileName, folder string) (string, error) {
+	savePath := filepath.Join(folder, "raw.csv")
+	if isExcelFile(fileName) {
+		savePath = filepath.Join(folder, "raw"+strings.ToLower(filepath.Ext(fileName)))
+	}
+
+	dst, err := keys.Create(savePath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to save file")
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", uploadReadError(err, "Failed to write file")
 	}
+	if err := dst.Close(); err != nil {
+		return "", fmt.Errorf("Failed to write file")
+	}
+
+	return savePath, nil
+}
+
+// readFormValue reads a non-file field of an upload form
+func readFormValue(part io.Reader, name string) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+	if err != nil {
+		return "", uploadReadError(err, "Failed to parse form")
+	}
+	if len(value) > maxFormValueBytes {
+		return "", fmt.Errorf("Form field %s is too large", name)
+	}
+	return string(value), nil
+}
+
+// uploadReadError turns an error reading the request body into a message for
+// the user, telling apart uploads that are over the size limit
+func uploadReadError(err error, message string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("File is larger than %d MB", maxUploadBytes>>20)
+	}
+	return errors.New(message)
+}
+
+// convertUploadedFile returns the path of the CSV to parse. Excel workbooks are
+// converted to raw.csv server-side.
+func convertUploadedFile(keys *artifact.Keyring, savePath, folder, password string) (string, error) {
+	csvPath := filepath.Join(folder, "raw.csv")
+	if savePath != csvPath {
+		if err := convertExcelToCSV(keys, savePath, csvPath, password); err != nil {
+			return "", fmt.Errorf("Failed to read Excel file: %v", err)
+		}
+	}
+	return csvPath, nil
 }
 
 // VoucherRecord represents a single voucher from CSV
@@ -169,6 +480,10 @@ type VoucherRecord struct {
 	OriginalValidity string // original validity from CSV
 	RowNumber        int
 	OriginalRow      []string // entire original CSV row
+	OfferID          string
+	ClientName       string
+	Commission       int    // hundredths of a percent
+	CommissionInput  string // commission as given, for logs and results
 }
 
 // UploadResult represents the result of a voucher upload
@@ -187,19 +502,96 @@ type UploadResult struct {
 	APIResponse     string
 	RetryCount      int
 	OriginalValidity string
+	Skipped         bool // not sent upstream, e.g. duplicate voucher code
+	AlreadyPresent  bool // upstream already had the voucher, not a failure
+	Rejected        bool // failed parsing or the client's rules, not sent upstream
+	IdempotencyKey  string
 }
 
-// runUploadProcess executes the voucher upload logic in Go
-func (h *StockHandler) runUploadProcess(runID, runFolder, csvPath, env, rzpCommission string, clientData interface{}, hub *WebSocketHub) {
-	// Read metadata for logging
-	metaPath := filepath.Join(runFolder, "meta.json")
-	metaBytes, _ := os.ReadFile(metaPath)
-	var metadata UploadMetadata
-	json.Unmarshal(metaBytes, &metadata)
+// uploadRun carries the settings and shared state of a single upload run
+type uploadRun struct {
+	runID              string
+	runFolder          string
+	envConfig          config.Credentials
+	procurementBatchID string
+	offerID            string
+	commission         int
+	clientName         string
+	rzpCommission      string
+	logWriter          *logBroadcaster
+	redact             *redactor // masks codes and PINs in ROW_LOG lines and rejections
+	hub                *WebSocketHub
+	journal            *runJournal
+	active             *activeRun
+	limiter            *adaptiveLimiter // shared by all requests of the run, including retries and split batches
+}
+
+// newResult creates an upload result for a voucher with the run-level columns filled in
+func (run *uploadRun) newResult(v VoucherRecord) UploadResult {
+	return UploadResult{
+		RowNumber:        v.RowNumber,
+		VoucherCode:      v.VoucherCode,
+		OriginalRow:      v.OriginalRow,
+		ClientName:       v.ClientName,
+		OfferID:          v.OfferID,
+		RzpCommission:    v.CommissionInput,
+		EpochTime:        v.ExpiryDate,
+		ProcurementID:    run.procurementBatchID,
+		OriginalValidity: v.OriginalValidity,
+		IdempotencyKey:   utils.VoucherIdempotencyKey(run.procurementBatchID, v.OfferID, v.VoucherCode),
+	}
+}
+
+// newRejectedResult creates the result of a row that was not sent upstream
+// because it failed parsing or the client's rules. Codes quoted in the
+// rejection are masked, as the message is journaled and shown as is.
+func (run *uploadRun) newRejectedResult(row ValidationRow) UploadResult {
+	message := run.redact.Rejection(row)
+	return UploadResult{
+		RowNumber:        row.RowNumber,
+		VoucherCode:      row.VoucherCode,
+		OriginalRow:      row.record,
+		ClientName:       row.clientName,
+		OfferID:          row.OfferID,
+		RzpCommission:    row.commissionInput,
+		EpochTime:        row.ExpiryEpoch,
+		ProcurementID:    run.procurementBatchID,
+		ErrorMessage:     message,
+		APIResponse:      message,
+		OriginalValidity: row.Validity,
+		Rejected:         true,
+	}
+}
+
+// runUploadProcess executes the voucher upload logic in Go. Rows already
+// journaled as uploaded (from an interrupted earlier attempt) are skipped.
+func (h *StockHandler) runUploadProcess(active *activeRun, csvPath, env, rzpCommission string, clientData interface{}, hub *WebSocketHub) {
+	runID, runFolder := active.id, active.folder
+
+	// The run ends failed unless it gets to write its results
+	finalState := RunStateFailed
+	defer func() {
+		h.runs.Finish(active, finalState)
+		updateRunMeta(runFolder, func(meta *UploadMetadata) {
+			finishedAt := time.Now()
+			meta.FinishedAt = &finishedAt
+		})
+		h.queueArchive(runID)
+	}()
+
+	// Record the start (a resumed run keeps its first start) and read metadata for logging
+	updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.StartedAt == nil {
+			startedAt := time.Now()
+			meta.StartedAt = &startedAt
+		}
+		meta.FinishedAt = nil
+	})
+	metadata, _ := readRunMeta(runFolder)
 
-	// Create log file
+	// Create log file (appended to when a run is resumed)
 	logPath := filepath.Join(runFolder, "terminal_output.log")
-	logFile, err := os.Create(logPath)
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		hub.Broadcast(runID, fmt.Sprintf("ERROR: Failed to create log file: %v\n", err))
 		hub.BroadcastFinished(runID, 1)
@@ -208,27 +600,36 @@ func (h *StockHandler) runUploadProcess(runID, runFolder, csvPath, env, rzpCommi
 	defer logFile.Close()
 
 	logWriter := &logBroadcaster{file: logFile, hub: hub, runID: runID}
+
+	// abort ends the run before any results are written
+	abort := func(message string) {
+		logWriter.Write(message)
+		hub.BroadcastFinished(runID, 1)
+	}
 	
 	// Load environment configurations
 	envs, err := h.config.LoadEnvironments()
 	if err != nil {
-		logWriter.Write(fmt.Sprintf("ERROR: Failed to load environments: %v\n", err))
-		hub.BroadcastFinished(runID, 1)
+		abort(fmt.Sprintf("ERROR: Failed to load environments: %v\n", err))
 		return
 	}
 
 	envKey := strings.ToUpper(env)
 	envConfig, ok := envs[envKey]
 	if !ok {
-		logWriter.Write(fmt.Sprintf("ERROR: Environment '%s' not found in configuration\n", envKey))
-		hub.BroadcastFinished(runID, 1)
+		abort(fmt.Sprintf("ERROR: Environment '%s' not found in configuration\n", envKey))
 		return
 	}
 
-	// Parse commission
-	commissionFloat := 0.0
-	fmt.Sscanf(rzpCommission, "%f", &commissionFloat)
-	commission := int(commissionFloat * 100)
+	// Parse commission, in hundredths of a percent. Multi-offer runs may leave
+	// it to the rzp_commission column.
+	commission := 0
+	if !metadata.MultiOffer || strings.TrimSpace(rzpCommission) != "" {
+		if commission, err = parseCommission(rzpCommission); err != nil {
+			abort(fmt.Sprintf("ERROR: %v\n", err))
+			return
+		}
+	}
 
 	// Extract offer_id and client name from client data
 	var offerID string
@@ -246,68 +647,188 @@ func (h *StockHandler) runUploadProcess(runID, runFolder, csvPath, env, rzpCommi
 	logWriter.Write(fmt.Sprintf("Environment: %s\n", envKey))
 	logWriter.Write(fmt.Sprintf("API Base URL: %s\n", envConfig.BaseURL))
 	logWriter.Write(fmt.Sprintf("API Endpoint: /offers/voucher-benefits\n"))
-	logWriter.Write(fmt.Sprintf("Offer ID: %s\n", offerID))
-	logWriter.Write(fmt.Sprintf("RZP Commission: %d (DB value: %d)\n", int(commissionFloat), commission))
+	logWriter.Write(fmt.Sprintf("Workers: %d, Rate Limit: %g/s, Batch Size: %d, Max Retries: %d\n",
+		envConfig.MaxWorkers, envConfig.RateLimit, envConfig.BatchSize, envConfig.MaxRetries))
+	if metadata.MultiOffer {
+		logWriter.Write(fmt.Sprintf("Offer ID: from the offer_id column, %d configured offers\n", len(metadata.OfferClients)))
+		if strings.TrimSpace(rzpCommission) == "" {
+			logWriter.Write("RZP Commission: from the rzp_commission column\n")
+		} else {
+			logWriter.Write(fmt.Sprintf("RZP Commission: from the rzp_commission column, default %s%% (DB value: %d)\n", strings.TrimSuffix(strings.TrimSpace(rzpCommission), "%"), commission))
+		}
+	} else {
+		logWriter.Write(fmt.Sprintf("Offer ID: %s\n", offerID))
+		logWriter.Write(fmt.Sprintf("RZP Commission: %s%% (DB value: %d)\n", strings.TrimSuffix(strings.TrimSpace(rzpCommission), "%"), commission))
+	}
+	logWriter.Write(fmt.Sprintf("Amounts: %s\n", metadata.profile().amounts()))
+	if mapping := metadata.ColumnMapping; mapping != nil {
+		layout := "header row"
+		if !mapping.HasHeader() {
+			layout = "no header row, columns by position"
+		}
+		logWriter.Write(fmt.Sprintf("Column Mapping: client profile (%s, %d banner rows skipped)\n", layout, mapping.SkipRows))
+	}
+	if dates, err := newDateParser(metadata.DateParsing); err == nil {
+		logWriter.Write(fmt.Sprintf("Expiry Dates: %s\n", dates.describe()))
+	}
 	logWriter.Write("=============================================================\n\n")
 
-	// Parse CSV
-	vouchers, headers, err := h.parseCSV(csvPath, offerID, commission, logWriter)
+	// Read procurement batch ID
+	procIDBytes, _ := os.ReadFile(filepath.Join(runFolder, "procurement_batch_id.txt"))
+	procurementBatchID := strings.TrimSpace(string(procIDBytes))
+
+	// Rows journaled as uploaded by an earlier attempt of this run are not sent again
+	uploaded, err := h.journaledUploadedRows(runFolder)
 	if err != nil {
-		logWriter.Write(fmt.Sprintf("ERROR: Failed to parse CSV: %v\n", err))
-		hub.BroadcastFinished(runID, 1)
+		abort(fmt.Sprintf("ERROR: Failed to read run journal: %v\n", err))
 		return
 	}
 
-	logWriter.Write(fmt.Sprintf("Found %d vouchers to upload\n\n", len(vouchers)))
+	// Other runs of the same offers finish and index their codes first, so
+	// none of them is uploaded twice
+	releaseOffers, err := h.offerLocks.acquire(active.ctx, envKey, metadata.profile().offers.offerIDs(), func(offerID string) {
+		logWriter.Write(fmt.Sprintf("Waiting for another run of offer %s to finish\n", offerLabel(offerID)))
+	})
+	if err != nil {
+		abort("Run stopped while waiting for other runs of its offers\n")
+		return
+	}
+	defer releaseOffers()
 
-	// Read procurement batch ID
-	procIDBytes, _ := os.ReadFile(filepath.Join(runFolder, "procurement_batch_id.txt"))
-	procurementBatchID := strings.TrimSpace(string(procIDBytes))
+	// Flag codes repeated within the file or already uploaded in past runs
+	duplicates := h.newDuplicateDetector(envKey)
 
-	// Upload vouchers
-	results := h.uploadVouchers(vouchers, envConfig, procurementBatchID, offerID, commission, clientName, rzpCommission, runID, runFolder, logWriter, hub)
+	// First pass over the file: parse every row before anything is sent
+	plan, err := h.planUpload(csvPath, metadata.profile(), metadata.RowFilter, uploaded, duplicates, logWriter)
+	if err != nil {
+		abort(fmt.Sprintf("ERROR: Failed to parse CSV: %v\n", err))
+		return
+	}
+	totalVouchers := plan.total
 
-	// Save results and get file paths
-	resultCsvPath, failedCsvPath := h.saveResults(results, headers, runFolder, logWriter)
+	// A child run only reprocesses the rows that failed in its parent
+	if len(metadata.RowFilter) > 0 {
+		logWriter.Write(fmt.Sprintf("Retrying %d failed rows of run %s\n", totalVouchers, metadata.ParentRunID))
+	}
 
-	// Calculate summary
-	successCount := 0
-	failedCount := 0
-	for _, r := range results {
-		if r.Success {
-			successCount++
-		} else {
-			failedCount++
+	if len(plan.duplicates) > 0 {
+		if normalizeDuplicatePolicy(metadata.DuplicatePolicy) == DuplicatePolicyReject {
+			abort(fmt.Sprintf("ERROR: %d duplicate voucher codes found, upload rejected by duplicate policy\n", len(plan.duplicates)))
+			utils.LogActivity(h.config.ConfigDir, metadata.User, "Stock Upload", envKey,
+				fmt.Sprintf("File: %s, Client: %s, rejected: %d duplicate voucher codes", metadata.FileName, clientName, len(plan.duplicates)), "Failed")
+			return
 		}
+
+		logWriter.Write(fmt.Sprintf("Skipping %d duplicate voucher codes\n", len(plan.duplicates)))
 	}
 
+	if plan.rejected > 0 {
+		logWriter.Write(fmt.Sprintf("Rejecting %d rows that failed validation, they are not uploaded\n", plan.rejected))
+	}
+
+	if len(uploaded) > 0 {
+		logWriter.Write(fmt.Sprintf("Resuming run: %d rows already uploaded, %d remaining\n", plan.done, plan.pending))
+		if plan.pending > 0 {
+			logWriter.Write(fmt.Sprintf("Continuing from row %d\n", plan.firstPending))
+		}
+	}
+
+	logWriter.Write(fmt.Sprintf("Found %d vouchers to upload\n\n", plan.pending))
+
+	// Open the run journal, every finished row is written to it immediately
+	journal, err := h.openRunJournal(runFolder)
+	if err != nil {
+		abort(fmt.Sprintf("ERROR: Failed to open run journal: %v\n", err))
+		return
+	}
+	defer journal.Close()
+
+	run := &uploadRun{
+		runID:              runID,
+		runFolder:          runFolder,
+		envConfig:          envConfig,
+		procurementBatchID: procurementBatchID,
+		offerID:            offerID,
+		commission:         commission,
+		clientName:         clientName,
+		rzpCommission:      rzpCommission,
+		logWriter:          logWriter,
+		redact:             h.redact,
+		hub:                hub,
+		journal:            journal,
+		active:             active,
+	}
+
+	active.setProgress(RunProgress{
+		Total:     totalVouchers,
+		Completed: plan.done + len(plan.duplicates) + plan.rejected,
+		Success:   plan.done,
+		Skipped:   len(plan.duplicates),
+		Failed:    plan.rejected,
+	})
+
+	// Second pass: upload the remaining rows as they are read
+	if err := h.uploadVouchers(run, csvPath, plan); err != nil {
+		logWriter.Write(fmt.Sprintf("ERROR: Failed to read CSV, remaining rows were not uploaded: %v\n", err))
+	}
+
+	// Remember uploaded codes so later runs can detect them
+	if err := h.indexUploadedVouchers(runFolder, envKey, runID); err != nil {
+		logWriter.Write(fmt.Sprintf("Warning: Failed to update voucher index: %v\n", err))
+	}
+
+	// Save results and get file paths
+	results, err := h.saveResults(runFolder, plan.headers, findSecretColumns(plan.headers, plan.profile.mapping), logWriter)
+	if err != nil {
+		abort(fmt.Sprintf("ERROR: Failed to save results: %v\n", err))
+		return
+	}
+
+	// Calculate summary
+	successCount := results.counts.Success
+	failedCount := results.counts.Failed
+	skippedCount := results.counts.Skipped
+	alreadyPresentCount := results.counts.AlreadyPresent
+
 	logWriter.Write("\n=============================================================\n")
 	logWriter.Write(fmt.Sprintf("Upload Summary:\n"))
-	logWriter.Write(fmt.Sprintf("Total: %d, Success: %d, Failed: %d\n", len(vouchers), successCount, failedCount))
+	logWriter.Write(fmt.Sprintf("Total: %d, Success: %d, Failed: %d, Skipped: %d, Already Present: %d\n", totalVouchers, successCount, failedCount, skippedCount, alreadyPresentCount))
 	logWriter.Write(fmt.Sprintf("Procurement Batch ID: %s\n", procurementBatchID))
+	var offers []OfferBreakdown
+	if metadata.MultiOffer {
+		offers = results.offers.list()
+		for _, offer := range offers {
+			logWriter.Write(fmt.Sprintf("Offer %s (%s): Total: %d, Success: %d, Failed: %d, Skipped: %d, Already Present: %d\n",
+				offerLabel(offer.OfferID), offer.ClientName, offer.Total, offer.Success, offer.Failed, offer.Skipped, offer.AlreadyPresent))
+		}
+	}
 	logWriter.Write("=============================================================\n")
 
-	// Broadcast summary as structured JSON
+	// Finish keeps a stopped run stopped
+	finalState = RunStateCompleted
+	updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		summary := results.counts
+		summary.Total = totalVouchers
+		meta.Summary = &summary
+		meta.Offers = offers
+	})
+
+	// Broadcast summary as structured JSON, failed rows are previewed and the
+	// failed uploads CSV has all of them
 	summaryData := map[string]interface{}{
-		"total":              len(vouchers),
+		"total":              totalVouchers,
 		"success":            successCount,
 		"failed":             failedCount,
+		"skipped":            skippedCount,
+		"alreadyPresent":     alreadyPresentCount,
 		"procurementBatchID": procurementBatchID,
-		"failedResults":      []UploadResult{},
-		"resultCsvPath":      resultCsvPath,
-		"failedCsvPath":      failedCsvPath,
+		"failedResults":      results.failedPreview,
+		"resultCsvPath":      results.resultCsvPath,
+		"failedCsvPath":      results.failedCsvPath,
 		"runId":              runID,
 	}
-
-	// Include failed results for preview
-	if len(results) > 0 {
-		failedList := []UploadResult{}
-		for _, r := range results {
-			if !r.Success {
-				failedList = append(failedList, r)
-			}
-		}
-		summaryData["failedResults"] = failedList
+	if offers != nil {
+		summaryData["offers"] = offers
 	}
 
 	summaryJSON, _ := json.Marshal(summaryData)
@@ -319,72 +840,380 @@ func (h *StockHandler) runUploadProcess(runID, runFolder, csvPath, env, rzpCommi
 	}
 	hub.BroadcastFinished(runID, exitCode)
 
-	// Log upload activity and history
-	status := "Success"
-	if failedCount > 0 {
-		if successCount == 0 {
-			status = "Failed"
-		} else {
-			status = "Partial Success"
-		}
+	// Log upload activity and history
+	status := "Success"
+	if failedCount > 0 {
+		if successCount == 0 {
+			status = "Failed"
+		} else {
+			status = "Partial Success"
+		}
+	}
+
+	historyClient := clientName
+	if metadata.MultiOffer && historyClient == "" {
+		historyClient = "Multi-offer"
+	}
+	details := fmt.Sprintf("File: %s, Client: %s, Total: %d, Success: %d, Failed: %d, Skipped: %d, Already Present: %d", 
+		metadata.FileName, historyClient, totalVouchers, successCount, failedCount, skippedCount, alreadyPresentCount)
+	if metadata.MultiOffer {
+		details += fmt.Sprintf(", Offers: %d", len(offers))
+	}
+	
+	utils.LogActivity(h.config.ConfigDir, metadata.User, "Stock Upload", envKey, details, status)
+	
+	utils.LogUploadHistory(h.config.ConfigDir, utils.UploadHistory{
+		ID:                 runID,
+		Username:           metadata.User,
+		FileName:           metadata.FileName,
+		Environment:        envKey,
+		ClientName:         historyClient,
+		OfferID:            offerID,
+		Offers:             historyOffers(offers),
+		TotalRows:          totalVouchers,
+		SuccessRows:        successCount,
+		FailedRows:         failedCount,
+		SkippedRows:        skippedCount,
+		AlreadyPresentRows: alreadyPresentCount,
+		ParentRunID:        metadata.ParentRunID,
+		ProcurementBatchID: procurementBatchID,
+		Status:             status,
+		Timestamp:          time.Now(),
+	})
+}
+
+// logBroadcaster writes to both file and WebSocket
+type logBroadcaster struct {
+	file  *os.File
+	hub   *WebSocketHub
+	runID string
+	mu    sync.Mutex
+}
+
+func (lb *logBroadcaster) Write(message string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.file.WriteString(message)
+	lb.hub.Broadcast(lb.runID, message)
+}
+
+// fileProfile is how a client's stock files are read, the zero value reads
+// the built-in layout with amounts in rupees
+type fileProfile struct {
+	mapping    *config.ColumnMapping
+	dates      *config.DateParsing
+	rules      *config.ValidationRules
+	amountType string        // unit of the amounts, set per upload rather than per client
+	offers     offerSettings // offer and commission of the rows, set per upload
+	checkedAt  time.Time     // time remaining validity is measured from, zero for now
+}
+
+// amounts returns the unit amounts are read in
+func (p fileProfile) amounts() string {
+	if p.amountType == "" {
+		return amountTypeRupees
+	}
+	return p.amountType
+}
+
+// clientProfile returns the profile of a configured client, nil for none
+func clientProfile(client *config.Client) fileProfile {
+	if client == nil {
+		return fileProfile{}
+	}
+	return fileProfile{mapping: client.ColumnMapping, dates: client.DateParsing, rules: client.ValidationRules}
+}
+
+// voucherScanner reads a voucher CSV one row at a time, so files of any size
+// are parsed without loading them. It backs both the upload run and the
+// /stock/validate dry run, and never talks to the upstream API.
+type voucherScanner struct {
+	file      io.ReadCloser
+	reader    *csv.Reader
+	mapping   *config.ColumnMapping // client profile, nil for the built-in layout
+	headers   []string
+	columnMap map[string]int
+	dates     *dateParser
+	amounts   string // amountTypeRupees or amountTypePaise
+	offers    *offerResolver
+	rowNumber int      // row number of the last row read, counting banner and header rows
+	next      []string // first data row, read ahead to reject files without data
+}
+
+// openVoucherFile opens a CSV file and locates its columns, from the header
+// row or from the positions of the client's column mapping
+func (h *StockHandler) openVoucherFile(csvPath string, profile fileProfile) (*voucherScanner, error) {
+	dates, err := newDateParser(profile.dates)
+	if err != nil {
+		return nil, err
+	}
+	checkedAt := profile.checkedAt
+	if checkedAt.IsZero() {
+		checkedAt = time.Now()
+	}
+	offers, err := newOfferResolver(profile.offers, profile.rules, checkedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := h.artifacts.Open(csvPath)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := &voucherScanner{
+		file:    file,
+		mapping: profile.mapping,
+		dates:   dates,
+		amounts: profile.amounts(),
+		offers:  offers,
+	}
+	if err := scanner.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, ok := scanner.columnMap[config.FieldOfferID]; profile.offers.multi && !ok {
+		file.Close()
+		return nil, fmt.Errorf("required column 'offer_id' not found, multi-offer files give the offer of every row")
+	}
+	return scanner, nil
+}
+
+// readHeader skips banner lines, then reads the header row, if any, and the
+// first data row
+func (s *voucherScanner) readHeader() error {
+	// Banner lines are skipped as raw lines, they need not be valid CSV
+	buffered := bufio.NewReader(s.file)
+	if s.mapping != nil {
+		for i := 0; i < s.mapping.SkipRows; i++ {
+			if _, err := buffered.ReadString('\n'); err != nil {
+				return fmt.Errorf("CSV file is empty or has no data rows")
+			}
+			s.rowNumber++
+		}
+	}
+	s.reader = csv.NewReader(buffered)
+
+	if !s.mapping.HasHeader() {
+		return s.readPositions()
+	}
+
+	headers, err := s.reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("CSV file is empty or has no data rows")
+	}
+	if err != nil {
+		return err
+	}
+	s.rowNumber++
+
+	// Parse headers and map column names
+	s.headers = headers
+	var aliases map[string][]string
+	if s.mapping != nil {
+		aliases = s.mapping.Aliases
+	}
+	s.columnMap = detectColumns(headers, aliases)
+
+	// Verify required columns exist
+	if _, ok := s.columnMap["voucher_code"]; !ok {
+		return fmt.Errorf("required column 'voucher_code' (or 'code'/'cardnumber') not found")
+	}
+	if _, ok := s.columnMap["voucher_value"]; !ok {
+		return fmt.Errorf("required column 'voucher_value' (or 'amount'/'denomination') not found")
+	}
+	if _, ok := s.columnMap["expiry_date"]; !ok {
+		return fmt.Errorf("required column 'expiry_date' (or 'validity') not found")
+	}
+
+	s.next, err = s.reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("CSV file is empty or has no data rows")
+	}
+	return err
+}
+
+// readPositions maps the columns of a file without a header row from the
+// column mapping. Headers are made up for the result CSVs: the field name
+// for mapped columns, column_N for the others.
+func (s *voucherScanner) readPositions() error {
+	var err error
+	s.next, err = s.reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("CSV file is empty or has no data rows")
+	}
+	if err != nil {
+		return err
+	}
+
+	s.headers = make([]string, len(s.next))
+	for i := range s.headers {
+		s.headers[i] = fmt.Sprintf("column_%d", i+1)
+	}
+
+	s.columnMap = make(map[string]int)
+	for _, field := range config.MappedFields {
+		position, ok := s.mapping.Positions[field]
+		if !ok {
+			continue
+		}
+		if position > len(s.next) {
+			return fmt.Errorf("column mapping puts %s in column %d but rows have %d columns", field, position, len(s.next))
+		}
+		s.columnMap[field] = position - 1
+		s.headers[position-1] = field
+	}
+	return nil
+}
+
+// Next parses the next data row. The voucher is nil when the row is rejected,
+// for failing to parse or breaking the client's rules, the row then carries
+// the reason. Next returns io.EOF after the last row.
+func (s *voucherScanner) Next() (ValidationRow, *VoucherRecord, error) {
+	record := s.next
+	s.next = nil
+	if record == nil {
+		var err error
+		if record, err = s.reader.Read(); err != nil {
+			return ValidationRow{}, nil, err
+		}
+	}
+	s.rowNumber++
+	rowNum := s.rowNumber
+
+	voucherCode := strings.TrimSpace(record[s.columnMap["voucher_code"]])
+	amountStr := strings.TrimSpace(record[s.columnMap["voucher_value"]])
+	expiryStr := strings.TrimSpace(record[s.columnMap["expiry_date"]])
+
+	row := ValidationRow{
+		RowNumber:   rowNum,
+		VoucherCode: voucherCode,
+		Amount:      amountStr,
+		Validity:    expiryStr,
+		record:      record,
+	}
+
+	// The offer is the run's, or in multi-offer files the row's own
+	offer, rules, reason, value := s.offers.resolve(record, s.columnMap)
+	row.OfferID = offer.offerID
+	row.clientName = offer.clientName
+	row.commissionInput = offer.commissionInput
+	if reason != "" {
+		return row.rejected(reason, value), nil, nil
+	}
+
+	// Parse amount exactly, in paise
+	amount, err := parseAmount(amountStr, s.amounts)
+	if err != nil {
+		return row.rejected("Invalid amount: "+err.Error(), amountStr), nil, nil
+	}
+
+	// Parse expiry date, values the profile cannot read one way only are rejected
+	expiryDate, err := s.dates.Parse(expiryStr)
+	if errors.Is(err, errAmbiguousDate) {
+		return row.rejected(reasonAmbiguousDate, expiryStr), nil, nil
+	}
+	if err != nil {
+		return row.rejected(reasonInvalidDate, expiryStr), nil, nil
+	}
+
+	voucher := VoucherRecord{
+		VoucherCode:      voucherCode,
+		Amount:           amount,
+		OriginalAmount:   amountStr,
+		ExpiryDate:       expiryDate,
+		OriginalValidity: expiryStr,
+		RowNumber:        rowNum,
+		OriginalRow:      record,
+		OfferID:          offer.offerID,
+		ClientName:       offer.clientName,
+		Commission:       offer.commission,
+		CommissionInput:  offer.commissionInput,
+	}
+
+	// Add PIN if available
+	if pinCol, ok := s.columnMap["pin"]; ok && pinCol < len(record) {
+		voucher.Pin = strings.TrimSpace(record[pinCol])
 	}
 
-	details := fmt.Sprintf("File: %s, Client: %s, Total: %d, Success: %d, Failed: %d", 
-		metadata.FileName, clientName, len(vouchers), successCount, failedCount)
-	
-	utils.LogActivity(h.config.ConfigDir, metadata.User, "Stock Upload", envKey, details, status)
-	
-	utils.LogUploadHistory(h.config.ConfigDir, utils.UploadHistory{
-		ID:                 runID,
-		Username:           metadata.User,
-		FileName:           metadata.FileName,
-		Environment:        envKey,
-		ClientName:         clientName,
-		OfferID:            offerID,
-		TotalRows:          len(vouchers),
-		SuccessRows:        successCount,
-		FailedRows:         failedCount,
-		ProcurementBatchID: procurementBatchID,
-		Status:             status,
-		Timestamp:          time.Now(),
-	})
-}
+	row.AmountPaise = voucher.Amount
+	row.ExpiryEpoch = voucher.ExpiryDate
 
-// logBroadcaster writes to both file and WebSocket
-type logBroadcaster struct {
-	file  *os.File
-	hub   *WebSocketHub
-	runID string
-	mu    sync.Mutex
+	// Rows breaking the client's rules are never sent upstream
+	if reason, value := rules.check(voucher); reason != "" {
+		return row.rejected(reason, value), nil, nil
+	}
+
+	row.Valid = true
+	return row, &voucher, nil
 }
 
-func (lb *logBroadcaster) Write(message string) {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-	lb.file.WriteString(message)
-	lb.hub.Broadcast(lb.runID, message)
+// Close closes the underlying file
+func (s *voucherScanner) Close() error {
+	return s.file.Close()
 }
 
-// parseCSV reads and parses the CSV file
-func (h *StockHandler) parseCSV(csvPath, offerID string, commission int, logWriter *logBroadcaster) ([]VoucherRecord, []string, error) {
-	file, err := os.Open(csvPath)
+// parseVoucherFile parses a whole CSV file into a per-row validation report,
+// flagging duplicate codes as it goes. With a row filter only those rows are
+// reported, though every row counts when looking for duplicates within the
+// file. The rows are collected next to the CSV file until the report is
+// closed.
+func (h *StockHandler) parseVoucherFile(csvPath string, profile fileProfile, duplicates *duplicateDetector, rowFilter []int) (*ValidationReport, error) {
+	scanner, err := h.openVoucherFile(csvPath, profile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	defer scanner.Close()
+
+	var inFilter map[int]bool
+	if len(rowFilter) > 0 {
+		inFilter = make(map[int]bool, len(rowFilter))
+		for _, rowNumber := range rowFilter {
+			inFilter[rowNumber] = true
+		}
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	report, err := newValidationReport(scanner.headers, scanner.columnMap, filepath.Dir(csvPath))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	for {
+		row, voucher, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Close()
+			return nil, err
+		}
 
-	if len(records) < 2 {
-		return nil, nil, fmt.Errorf("CSV file is empty or has no data rows")
+		if voucher != nil {
+			reason, isDuplicate, err := duplicates.Check(*voucher)
+			if err != nil {
+				report.Close()
+				return nil, fmt.Errorf("failed to check for duplicate voucher codes: %v", err)
+			}
+			if isDuplicate {
+				row.Duplicate = reason
+			}
+		}
+		if inFilter != nil && !inFilter[row.RowNumber] {
+			continue
+		}
+		// Reports are returned to the browser and kept for approvers, codes are masked
+		row.VoucherCode = h.redact.Code(row.VoucherCode)
+		if err := report.add(row); err != nil {
+			report.Close()
+			return nil, err
+		}
 	}
 
-	// Parse headers and map column names
-	headers := records[0]
+	return report, nil
+}
+
+// detectColumns maps the known header aliases, and the extra aliases of a
+// client's column mapping, to column indexes
+func detectColumns(headers []string, aliases map[string][]string) map[string]int {
 	columnMap := make(map[string]int)
 	
 	for i, header := range headers {
@@ -406,249 +1235,185 @@ func (h *StockHandler) parseCSV(csvPath, offerID string, commission int, logWrit
 		if normalized == "validity" || normalized == "expirydate" || normalized == "expiry date" {
 			columnMap["expiry_date"] = i
 		}
-	}
-
-	// Verify required columns exist
-	if _, ok := columnMap["voucher_code"]; !ok {
-		return nil, nil, fmt.Errorf("required column 'voucher_code' (or 'code'/'cardnumber') not found")
-	}
-	if _, ok := columnMap["voucher_value"]; !ok {
-		return nil, nil, fmt.Errorf("required column 'voucher_value' (or 'amount'/'denomination') not found")
-	}
-	if _, ok := columnMap["expiry_date"]; !ok {
-		return nil, nil, fmt.Errorf("required column 'expiry_date' (or 'validity') not found")
-	}
-
-	// Parse data rows
-	vouchers := []VoucherRecord{}
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Excel row number (header is row 1)
-
-		voucherCode := strings.TrimSpace(record[columnMap["voucher_code"]])
-		amountStr := strings.TrimSpace(record[columnMap["voucher_value"]])
-		expiryStr := strings.TrimSpace(record[columnMap["expiry_date"]])
-
-		// Parse amount (convert to paise)
-		amount, err := strconv.Atoi(amountStr)
-		if err != nil {
-			logWriter.Write(fmt.Sprintf("Warning: Invalid amount in row %d: %s\n", rowNum, amountStr))
-			continue
-		}
-		amount = amount * 100 // Convert to paise
-
-		// Parse expiry date
-		expiryDate, err := h.parseDate(expiryStr)
-		if err != nil {
-			logWriter.Write(fmt.Sprintf("Warning: Invalid date in row %d: %s\n", rowNum, expiryStr))
-			continue
+		// Map offer and commission columns, read by multi-offer uploads
+		if normalized == "offer_id" || normalized == "offerid" || normalized == "offer id" {
+			columnMap["offer_id"] = i
 		}
-
-		voucher := VoucherRecord{
-			VoucherCode:      voucherCode,
-			Amount:           amount,
-			OriginalAmount:   amountStr,
-			ExpiryDate:       expiryDate,
-			OriginalValidity: expiryStr,
-			RowNumber:        rowNum,
-			OriginalRow:      record,
+		if normalized == "rzp_commission" || normalized == "rzp commission" || normalized == "commission" {
+			columnMap["rzp_commission"] = i
 		}
-
-		// Add PIN if available
-		if pinCol, ok := columnMap["pin"]; ok && pinCol < len(record) {
-			voucher.Pin = strings.TrimSpace(record[pinCol])
+		// Map client aliases
+		for field, names := range aliases {
+			for _, name := range names {
+				if normalized == strings.ToLower(strings.TrimSpace(name)) {
+					columnMap[field] = i
+				}
+			}
 		}
-
-		vouchers = append(vouchers, voucher)
 	}
 
-	return vouchers, headers, nil
+	return columnMap
 }
 
-// parseDate parses various date formats and returns Unix timestamp
-func (h *StockHandler) parseDate(dateStr string) (int64, error) {
-	dateStr = strings.TrimSpace(dateStr)
-	
-	// Try parsing as Unix timestamp first
-	if timestamp, err := strconv.ParseInt(dateStr, 10, 64); err == nil {
-		return timestamp, nil
-	}
-
-	// List of date formats to try
-	formats := []string{
-		"2006-01-02 15:04:05 UTC",
-		"2006-01-02 15:04:05",
-		"2006-01-02",
-		"02-01-2006", // DD-MM-YYYY
-		"2-Jan-2006, 15:04",
-		"2-January-2006, 15:04",
-		"1/2/06", // M/D/YY
-	}
-
-	for _, format := range formats {
-		if t, err := time.Parse(format, dateStr); err == nil {
-			return t.Unix(), nil
-		}
-	}
-
-	return 0, fmt.Errorf("unable to parse date: %s", dateStr)
-}
+// uploadVouchers uploads the rows that feedVouchers reads from the file with a
+// fixed pool of MaxWorkers workers, each taking one batch at a time, with rate
+// limiting and retries. Only the batches in flight are held in memory, so
+// memory and goroutines stay flat whatever the size of the file. Each
+// finished row is journaled.
+func (h *StockHandler) uploadVouchers(run *uploadRun, csvPath string, plan *uploadPlan) error {
+	// Concurrency, rate and batch size come from the environment configuration
+	workers := run.envConfig.MaxWorkers
+	totalVouchers := plan.done + plan.pending
+	var completed int32 = int32(plan.done)
+	run.limiter = newAdaptiveLimiter(run.envConfig.RateLimit)
 
-// uploadVouchers uploads vouchers with rate limiting and retries
-func (h *StockHandler) uploadVouchers(vouchers []VoucherRecord, envConfig config.Credentials, procurementBatchID, offerID string, commission int, clientName, rzpCommission, runID, runFolder string, logWriter *logBroadcaster, hub *WebSocketHub) []UploadResult {
-	const (
-		maxWorkers = 3
-		maxRetries = 3
-		rateLimit  = 3 // requests per second
-	)
+	batches := make(chan []VoucherRecord, workers)
 
-	results := make([]UploadResult, len(vouchers))
 	var wg sync.WaitGroup
-	var completed int32 = 0
-	semaphore := make(chan struct{}, maxWorkers)
-	rateLimiter := time.NewTicker(time.Second / time.Duration(rateLimit))
-	defer rateLimiter.Stop()
-
-	controlPath := filepath.Join(runFolder, "control.json")
-	totalVouchers := len(vouchers)
-
-	for i, voucher := range vouchers {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(index int, v VoucherRecord) {
+		go func() {
 			defer wg.Done()
 
-			// Check control file FIRST, before acquiring any resources
-			controlData, _ := os.ReadFile(controlPath)
-			var control ControlState
-			json.Unmarshal(controlData, &control)
-
-			// Handle pause - check immediately before starting anything
-			for control.State == "paused" {
-				time.Sleep(time.Second)
-				controlData, _ = os.ReadFile(controlPath)
-				json.Unmarshal(controlData, &control)
-			}
-
-			// Handle stop
-			if control.State == "stopped" {
-				results[index] = UploadResult{
-					RowNumber:        v.RowNumber,
-					VoucherCode:      v.VoucherCode,
-					OriginalRow:      v.OriginalRow,
-					ClientName:       clientName,
-					OfferID:          offerID,
-					RzpCommission:    rzpCommission,
-					EpochTime:        v.ExpiryDate,
-					ProcurementID:    procurementBatchID,
-					Success:          false,
-					ErrorMessage:     "Stopped by user",
-					OriginalValidity: v.OriginalValidity,
+			for batch := range batches {
+				// Block while paused. Once stopped, the remaining batches are drained
+				// and every row is marked as stopped.
+				if err := run.active.waitWhilePaused(); err != nil {
+					stopped := make([]UploadResult, len(batch))
+					for i, v := range batch {
+						stopped[i] = run.newResult(v)
+						stopped[i].ErrorMessage = stoppedMessage
+					}
+					run.journalResults(stopped)
+					run.active.recordResults(stopped)
+					continue
 				}
-				return
-			}
-
-			// Wait for rate limiter
-			<-rateLimiter.C
 
-			// Acquire semaphore
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+				// Upload with retries, failing batches are split until every row has its own outcome
+				batchResults := h.uploadBatch(run, batch)
 
-			// Check control file again before upload (in case state changed while waiting)
-			controlData, _ = os.ReadFile(controlPath)
-			json.Unmarshal(controlData, &control)
+				// Journal the outcome before reporting progress
+				run.journalResults(batchResults)
+				run.active.recordResults(batchResults)
 
-			// Handle pause again
-			for control.State == "paused" {
-				time.Sleep(time.Second)
-				controlData, _ = os.ReadFile(controlPath)
-				json.Unmarshal(controlData, &control)
-			}
+				// Update progress atomically
+				currentCompleted := atomic.AddInt32(&completed, int32(len(batch)))
+				percentage := int(float64(currentCompleted) / float64(totalVouchers) * 100)
 
-			// Handle stop again
-			if control.State == "stopped" {
-				results[index] = UploadResult{
-					RowNumber:        v.RowNumber,
-					VoucherCode:      v.VoucherCode,
-					OriginalRow:      v.OriginalRow,
-					ClientName:       clientName,
-					OfferID:          offerID,
-					RzpCommission:    rzpCommission,
-					EpochTime:        v.ExpiryDate,
-					ProcurementID:    procurementBatchID,
-					Success:          false,
-					ErrorMessage:     "Stopped by user",
-					OriginalValidity: v.OriginalValidity,
-				}
-				return
+				// Broadcast progress with the current request rate
+				progressMsg := fmt.Sprintf("PROGRESS:%d:%d:%d:%.2f\n", currentCompleted, totalVouchers, percentage, run.limiter.Rate())
+				run.hub.Broadcast(run.runID, progressMsg)
 			}
+		}()
+	}
 
-			// Upload with retries
-			result := h.uploadSingleVoucher(v, envConfig, procurementBatchID, offerID, commission, clientName, rzpCommission, maxRetries, logWriter)
-			results[index] = result
-
-			// Update progress atomically
-			currentCompleted := atomic.AddInt32(&completed, 1)
-			percentage := int(float64(currentCompleted) / float64(totalVouchers) * 100)
-			
-			// Broadcast progress
-			progressMsg := fmt.Sprintf("PROGRESS:%d:%d:%d\n", completed, totalVouchers, percentage)
-			hub.Broadcast(runID, progressMsg)
+	err := h.feedVouchers(run, csvPath, plan, batches)
+	wg.Wait()
+	return err
+}
 
-		}(i, voucher)
+// journalResults appends finished rows to the run journal
+func (run *uploadRun) journalResults(results []UploadResult) {
+	if err := run.journal.Append(results...); err != nil {
+		run.logWriter.Write(fmt.Sprintf("Warning: Failed to journal rows %d-%d: %v\n",
+			results[0].RowNumber, results[len(results)-1].RowNumber, err))
 	}
+}
 
-	wg.Wait()
-	return results
+// voucherBenefitsResponse is the outcome of a voucher-benefits request after retries
+type voucherBenefitsResponse struct {
+	StatusCode   int
+	Body         string
+	Attempts     int
+	ErrorMessage   string // set when the last attempt did not return 200
+	Cancelled      bool   // the run was stopped before a final outcome
+	AlreadyPresent bool   // upstream answered 409, or verification found the voucher
+	Ambiguous      bool   // an attempt failed in a way that may have stored the vouchers
 }
 
-// uploadSingleVoucher uploads a single voucher with retries
-func (h *StockHandler) uploadSingleVoucher(voucher VoucherRecord, envConfig config.Credentials, procurementBatchID, offerID string, commission int, clientName, rzpCommission string, maxRetries int, logWriter *logBroadcaster) UploadResult {
-	result := UploadResult{
-		RowNumber:        voucher.RowNumber,
-		VoucherCode:      voucher.VoucherCode,
-		OriginalRow:      voucher.OriginalRow,
-		ClientName:       clientName,
-		OfferID:          offerID,
-		RzpCommission:    rzpCommission,
-		EpochTime:        voucher.ExpiryDate,
-		ProcurementID:    procurementBatchID,
-		OriginalValidity: voucher.OriginalValidity,
+// stoppedMessage is the error message of rows not uploaded because the run was stopped
+const stoppedMessage = "Stopped by user"
+
+// sendVoucherBenefits posts vouchers to the voucher-benefits endpoint with retries.
+// Client errors other than 409 and 429 are only retried when retryClientErrors is set.
+// Every request carries an Idempotency-Key derived from its vouchers. When an
+// attempt for a single voucher may have reached upstream (network error or 5xx),
+// the voucher is looked up before it is sent again.
+func (h *StockHandler) sendVoucherBenefits(run *uploadRun, vouchers []VoucherRecord, retryClientErrors bool) voucherBenefitsResponse {
+	envConfig := run.envConfig
+	maxRetries := envConfig.MaxRetries
+	response := voucherBenefitsResponse{}
+
+	keys := make([]string, len(vouchers))
+	for i, voucher := range vouchers {
+		keys[i] = utils.VoucherIdempotencyKey(run.procurementBatchID, voucher.OfferID, voucher.VoucherCode)
 	}
+	idempotencyKey := requestIdempotencyKey(keys)
 
-	// Create payload
-	payload := map[string]interface{}{
-		"voucher_benefits": []map[string]interface{}{
-			{
-				"offer_id":              offerID,
-				"voucher_type":          "VOUCHER_TYPE_PERSONALISED",
-				"voucher_status":        "VOUCHER_BENEFIT_STATUS_UNCLAIMED",
-				"voucher_value":         voucher.Amount,
-				"expiry_date":           voucher.ExpiryDate,
-				"voucher_code":          voucher.VoucherCode,
-				"rzp_commission":        strconv.Itoa(commission),
-				"procurement_batch_id":  procurementBatchID,
-			},
-		},
+	// verify checks upstream for a single voucher after an ambiguous failure
+	ambiguous := false
+	verify := func() bool {
+		if !ambiguous || len(vouchers) != 1 || envConfig.VerifyPath == "" {
+			return false
+		}
+		present, err := h.verifyVoucherPresent(run, vouchers[0], keys[0])
+		if err != nil {
+			run.logWriter.Write(fmt.Sprintf("Warning: Could not verify row %d upstream: %v\n", vouchers[0].RowNumber, err))
+			return false
+		}
+		return present
 	}
 
-	if voucher.Pin != "" {
-		payload["voucher_benefits"].([]map[string]interface{})[0]["pin"] = voucher.Pin
+	// Create payload
+	benefits := make([]map[string]interface{}, 0, len(vouchers))
+	for _, voucher := range vouchers {
+		benefit := map[string]interface{}{
+			"offer_id":              voucher.OfferID,
+			"voucher_type":          "VOUCHER_TYPE_PERSONALISED",
+			"voucher_status":        "VOUCHER_BENEFIT_STATUS_UNCLAIMED",
+			"voucher_value":         voucher.Amount,
+			"expiry_date":           voucher.ExpiryDate,
+			"voucher_code":          voucher.VoucherCode,
+			"rzp_commission":        strconv.Itoa(voucher.Commission),
+			"procurement_batch_id":  run.procurementBatchID,
+		}
+		if voucher.Pin != "" {
+			benefit["pin"] = voucher.Pin
+		}
+		benefits = append(benefits, benefit)
+	}
+	payload := map[string]interface{}{
+		"voucher_benefits": benefits,
 	}
 
 	payloadBytes, _ := json.Marshal(payload)
 
 	// Create HTTP client
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := &http.Client{Timeout: envConfig.Timeout()}
 
 	// Retry logic
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		result.RetryCount = attempt
+		// Never resend a voucher that the previous attempt already stored
+		if attempt > 1 && verify() {
+			response.AlreadyPresent = true
+			response.ErrorMessage = ""
+			return response
+		}
+
+		response.Attempts = attempt
+
+		// Wait for the run's rate limiter
+		if err := run.limiter.Wait(run.active.ctx); err != nil {
+			response.ErrorMessage = stoppedMessage
+			response.Cancelled = true
+			return response
+		}
 
 		// Create request
 		url := envConfig.BaseURL + "/offers/voucher-benefits"
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
+		req, err := http.NewRequestWithContext(run.active.ctx, "POST", url, bytes.NewBuffer(payloadBytes))
 		if err != nil {
-			result.ErrorMessage = err.Error()
+			response.ErrorMessage = err.Error()
 			continue
 		}
 
@@ -658,131 +1423,264 @@ func (h *StockHandler) uploadSingleVoucher(voucher VoucherRecord, envConfig conf
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("X-User-Type", "advertiser")
 		req.Header.Set("X-User-Id", "rzp.merchant.MK6oPUp488NKF6")
+		req.Header.Set("Idempotency-Key", idempotencyKey)
 
 		// Make request
 		resp, err := client.Do(req)
 		if err != nil {
-			result.ErrorMessage = err.Error()
-			if attempt < maxRetries {
-				time.Sleep(time.Second * 2)
+			if run.active.ctx.Err() != nil {
+				// Stopped while in flight, upstream may or may not have stored the vouchers
+				response.ErrorMessage = stoppedMessage + " (request cancelled in flight)"
+				response.Cancelled = true
+				return response
+			}
+			response.ErrorMessage = err.Error()
+			ambiguous = true
+			response.Ambiguous = true
+			if attempt < maxRetries && sleepContext(run.active.ctx, envConfig.RetryBackoff()) {
 				continue
 			}
 			break
 		}
 
-		result.StatusCode = resp.StatusCode
+		response.StatusCode = resp.StatusCode
+		ambiguous = resp.StatusCode >= 500
+		response.Ambiguous = response.Ambiguous || ambiguous
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		result.APIResponse = string(bodyBytes)
-
-		// Format validity for display (readable format with epoch in brackets)
-		validityDisplay := fmt.Sprintf("%s (%d)", voucher.OriginalValidity, voucher.ExpiryDate)
+		response.Body = string(bodyBytes)
 
 		if resp.StatusCode == 200 {
-			result.Success = true
-			// Format: ClientName, VoucherCode, Commission, Validity (Epoch), Success
-			logMsg := fmt.Sprintf("ROW_LOG:%s,%s,%s,%s,Success\n", clientName, voucher.VoucherCode, rzpCommission, validityDisplay)
-			logWriter.Write(logMsg)
-			return result
+			response.ErrorMessage = ""
+			run.limiter.Succeeded()
+			return response
+		} else if resp.StatusCode == 409 {
+			// Conflict: upstream already has the voucher (or, for a batch, some of them)
+			response.ErrorMessage = string(bodyBytes)
+			response.AlreadyPresent = len(vouchers) == 1
+			return response
 		} else if resp.StatusCode == 429 {
-			// Rate limited, retry with longer delay
-			result.ErrorMessage = "Rate limited"
-			if attempt < maxRetries {
-				time.Sleep(time.Second * 5)
-				continue
+			// Rate limited, slow down the whole run and hold it for Retry-After
+			response.ErrorMessage = "Rate limited"
+			pause := parseRetryAfter(resp.Header.Get("Retry-After"))
+			if pause == 0 {
+				pause = envConfig.RateLimitBackoff()
 			}
+			run.limiter.Throttled(pause)
+			continue
 		} else {
-			result.ErrorMessage = string(bodyBytes)
-			if attempt < maxRetries {
-				time.Sleep(time.Second * 2)
+			response.ErrorMessage = string(bodyBytes)
+			if resp.StatusCode >= 500 {
+				run.limiter.Throttled(0)
+			} else if !retryClientErrors {
+				break
+			}
+			if attempt < maxRetries && sleepContext(run.active.ctx, envConfig.RetryBackoff()) {
 				continue
 			}
 		}
 	}
 
-	result.Success = false
-	// Format validity for display
+	// The last attempt may still have reached upstream
+	if verify() {
+		response.AlreadyPresent = true
+		response.ErrorMessage = ""
+	}
+
+	return response
+}
+
+// logRowResult writes the ROW_LOG line of a finished row
+func (run *uploadRun) logRowResult(voucher VoucherRecord, result UploadResult) {
+	// Format validity for display (readable format with epoch in brackets)
 	validityDisplay := fmt.Sprintf("%s (%d)", voucher.OriginalValidity, voucher.ExpiryDate)
+	// Logs are broadcast to every client, codes are masked and PINs never shown
+	code := run.redact.Code(voucher.VoucherCode)
+
+	if result.Success {
+		// Format: ClientName, VoucherCode, Commission, Validity (Epoch), Success
+		run.logWriter.Write(fmt.Sprintf("ROW_LOG:%s,%s,%s,%s,Success\n", voucher.ClientName, code, voucher.CommissionInput, validityDisplay))
+		return
+	}
+	if result.AlreadyPresent {
+		run.logWriter.Write(fmt.Sprintf("ROW_LOG:%s,%s,%s,%s,Already Present\n", voucher.ClientName, code, voucher.CommissionInput, validityDisplay))
+		return
+	}
 	// Format: ClientName, VoucherCode, Commission, Validity (Epoch), Failure
-	logMsg := fmt.Sprintf("ROW_LOG:%s,%s,%s,%s,Failure - %s\n", clientName, voucher.VoucherCode, rzpCommission, validityDisplay, result.ErrorMessage)
-	logWriter.Write(logMsg)
-	return result
+	message := run.redact.Response(result.ErrorMessage, voucher.VoucherCode, voucher.Pin)
+	run.logWriter.Write(fmt.Sprintf("ROW_LOG:%s,%s,%s,%s,Failure - %s\n", voucher.ClientName, code, voucher.CommissionInput, validityDisplay, message))
+}
+
+// maxFailedPreview caps the failed rows sent with the run summary, the failed
+// uploads CSV has all of them
+const maxFailedPreview = 100
+
+// runResults describes the result files of a run
+type runResults struct {
+	resultCsvPath string
+	failedCsvPath string
+	counts        RunProgress
+	offers        offerCounts // counts of each offer
+	failedPreview []UploadResult
 }
 
-// saveResults saves upload results to CSV files and returns the file paths
-func (h *StockHandler) saveResults(results []UploadResult, headers []string, runFolder string, logWriter *logBroadcaster) (string, string) {
+// saveResults writes the results CSV, and the failed uploads CSV when rows
+// failed, from the run journal. Rows are written one at a time in row order.
+// The failed rows previewed in the run summary have codes and PINs masked.
+func (h *StockHandler) saveResults(runFolder string, headers []string, columns secretColumns, logWriter *logBroadcaster) (*runResults, error) {
 	timestamp := time.Now().Format("20060102_150405")
-	
+	results := &runResults{offers: offerCounts{}, failedPreview: []UploadResult{}}
+
 	// Save all results
 	allResultsPath := filepath.Join(runFolder, fmt.Sprintf("upload_results_%s.csv", timestamp))
-	h.writeEnhancedResultsCSV(results, headers, allResultsPath)
-	logWriter.Write(fmt.Sprintf("\nResults saved to: %s\n", allResultsPath))
+	allResults, err := createResultsCSV(h.artifacts, allResultsPath, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save failed results, the file is created on the first failed row
+	failedResultsPath := filepath.Join(runFolder, fmt.Sprintf("failed_uploads_%s.csv", timestamp))
+	var failedResults *resultsCSV
+
+	err = h.forEachJournalResult(runFolder, func(r UploadResult) error {
+		results.counts.add(r)
+		results.offers.add(r)
+		if err := allResults.Write(r); err != nil {
+			return err
+		}
+		if r.Success || r.Skipped || r.AlreadyPresent {
+			return nil
+		}
 
-	// Save failed results
-	failedResults := []UploadResult{}
-	for _, r := range results {
-		if !r.Success {
-			failedResults = append(failedResults, r)
+		if len(results.failedPreview) < maxFailedPreview {
+			results.failedPreview = append(results.failedPreview, h.redact.Result(r, columns))
+		}
+		if failedResults == nil {
+			var err error
+			if failedResults, err = createResultsCSV(h.artifacts, failedResultsPath, headers); err != nil {
+				return err
+			}
 		}
+		return failedResults.Write(r)
+	})
+	if closeErr := allResults.Close(); err == nil {
+		err = closeErr
+	}
+	if failedResults != nil {
+		if closeErr := failedResults.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	failedResultsPath := ""
-	if len(failedResults) > 0 {
-		failedResultsPath = filepath.Join(runFolder, fmt.Sprintf("failed_uploads_%s.csv", timestamp))
-		h.writeEnhancedResultsCSV(failedResults, headers, failedResultsPath)
+	results.resultCsvPath = filepath.Base(allResultsPath)
+	logWriter.Write(fmt.Sprintf("\nResults saved to: %s\n", allResultsPath))
+	if failedResults != nil {
+		results.failedCsvPath = filepath.Base(failedResultsPath)
 		logWriter.Write(fmt.Sprintf("Failed uploads saved to: %s\n", failedResultsPath))
 	}
-	
-	return filepath.Base(allResultsPath), filepath.Base(failedResultsPath)
+
+	return results, nil
 }
 
-// writeEnhancedResultsCSV writes enhanced results to a CSV file with all columns
-func (h *StockHandler) writeEnhancedResultsCSV(results []UploadResult, originalHeaders []string, filePath string) error {
-	file, err := os.Create(filePath)
+// resultsCSV writes upload results as the original columns followed by the result columns
+type resultsCSV struct {
+	file   io.WriteCloser
+	writer *csv.Writer
+}
+
+// createResultsCSV creates a results CSV and writes its header
+func createResultsCSV(keys *artifact.Keyring, filePath string, originalHeaders []string) (*resultsCSV, error) {
+	file, err := keys.Create(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
-
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
 	// Build header: Original columns + new columns
 	enhancedHeaders := append([]string{}, originalHeaders...)
-	enhancedHeaders = append(enhancedHeaders, "client_name", "offer_id", "rzp_commission", "epoch_time", "procurement_batch_id", "success_failure", "api_response")
-	writer.Write(enhancedHeaders)
+	enhancedHeaders = append(enhancedHeaders, "client_name", "offer_id", "rzp_commission", "epoch_time", "procurement_batch_id", "success_failure", "api_response", "idempotency_key")
+	if err := writer.Write(enhancedHeaders); err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	// Write data rows
-	for _, r := range results {
-		// Start with original row data
-		row := append([]string{}, r.OriginalRow...)
-		
-		// Add new columns
-		successFailure := "Success"
-		if !r.Success {
-			successFailure = "Failure"
-		}
-		
-		row = append(row,
-			r.ClientName,
-			r.OfferID,
-			r.RzpCommission,
-			strconv.FormatInt(r.EpochTime, 10),
-			r.ProcurementID,
-			successFailure,
-			r.APIResponse,
-		)
-		
-		writer.Write(row)
+	return &resultsCSV{file: file, writer: writer}, nil
+}
+
+// Write adds the row of a result
+func (c *resultsCSV) Write(r UploadResult) error {
+	// Start with original row data
+	row := append([]string{}, r.OriginalRow...)
+
+	// Add new columns
+	successFailure := "Success"
+	if r.Skipped {
+		successFailure = "Skipped"
+	} else if r.Rejected {
+		successFailure = "Rejected"
+	} else if r.AlreadyPresent {
+		successFailure = "Already Present"
+	} else if !r.Success {
+		successFailure = "Failure"
 	}
 
-	return nil
+	row = append(row,
+		r.ClientName,
+		r.OfferID,
+		r.RzpCommission,
+		strconv.FormatInt(r.EpochTime, 10),
+		r.ProcurementID,
+		successFailure,
+		r.APIResponse,
+		r.IdempotencyKey,
+	)
+
+	return c.writer.Write(row)
+}
+
+// Close flushes and closes the file
+func (c *resultsCSV) Close() error {
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
 }
 
-// ControlRun handles pause/resume/stop actions
+// ControlRun handles pause/resume/stop actions. Admins can control any run,
+// other users their own.
 func (h *StockHandler) ControlRun(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
 	vars := mux.Vars(r)
-	runID := vars["runId"]
+	runID := filepath.Base(vars["runId"])
+
+	info, _, err := h.loadRunInfo(runID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+	if !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only admins and the uploader can control this run",
+		})
+		return
+	}
 
 	var req struct {
 		Action string `json:"action"`
@@ -795,66 +1693,61 @@ func (h *StockHandler) ControlRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	runFolder := filepath.Join(h.config.UploadsDir, runID)
-	controlPath := filepath.Join(runFolder, "control.json")
-
-	// Check if control file exists
-	if _, err := os.Stat(controlPath); os.IsNotExist(err) {
+	// The run manager validates the transition and returns the real state
+	state, err := h.runs.Control(runID, req.Action)
+	var transitionErr *TransitionError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRunNotFound):
 		respondJSON(w, http.StatusNotFound, map[string]interface{}{
 			"success": false,
 			"message": "Run not found",
 		})
 		return
-	}
-
-	// Read current control state
-	data, err := os.ReadFile(controlPath)
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+	case errors.As(err, &transitionErr):
+		message := fmt.Sprintf("Cannot %s run, it is %s", req.Action, state)
+		if state == RunStateInterrupted {
+			message = "Run was interrupted, resume it via /stock/runs/{runId}/resume"
+		}
+		if state == RunStateScheduled {
+			message = "Run has not started yet, cancel or reschedule it via /stock/schedules/{runId}"
+		}
+		if state == RunStateQueued {
+			message = "Run is waiting in the queue, cancel it via /stock/queue/{runId}/cancel"
+		}
+		if state == RunStateAwaitingApproval {
+			message = "Run is awaiting approval, review it via /stock/approvals/{runId}"
+		}
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
 			"success": false,
-			"message": "Cannot read control file",
+			"message": message,
+			"state":   state,
 		})
 		return
-	}
-
-	var control ControlState
-	json.Unmarshal(data, &control)
-
-	// Update state based on action
-	switch req.Action {
-	case "pause":
-		control.State = "paused"
-	case "resume":
-		control.State = "running"
-	case "stop":
-		control.State = "stopped"
-	default:
+	case errors.Is(err, ErrInvalidAction):
 		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 			"success": false,
 			"message": "Invalid action",
 		})
 		return
-	}
-
-	// Save updated control state
-	updatedData, _ := json.MarshalIndent(control, "", "  ")
-	if err := os.WriteFile(controlPath, updatedData, 0644); err != nil {
+	default:
 		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"success": false,
 			"message": "Cannot update control file",
+			"state":   state,
 		})
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
-		"state":   control.State,
+		"state":   state,
 	})
 }
 
 // SaveClients handles saving client configurations
 func (h *StockHandler) SaveClients(w http.ResponseWriter, r *http.Request) {
-	var clients []map[string]string
+	var clients []config.Client
 	if err := json.NewDecoder(r.Body).Decode(&clients); err != nil {
 		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 			"success": false,
@@ -863,6 +1756,17 @@ func (h *StockHandler) SaveClients(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reject profiles the upload could not use
+	for _, client := range clients {
+		if err := client.Validate(); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Client %s: %v", client.Name, err),
+			})
+			return
+		}
+	}
+
 	clientsPath := filepath.Join(h.config.ConfigDir, "clients.json")
 	data, err := json.MarshalIndent(clients, "", "  ")
 	if err != nil {
@@ -912,29 +1816,111 @@ func (h *StockHandler) GetClients(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-// DownloadFile handles file downloads
+// DownloadFile handles file downloads. Results CSVs are served with codes and
+// PINs masked; ?full=true serves any run file as it is, for users with the
+// stock_full_export permission, and is recorded in the activity log. Admins
+// can download the files of any run, other users those of their own runs.
 func (h *StockHandler) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
 	vars := mux.Vars(r)
-	runID := vars["runId"]
-	filename := vars["filename"]
+	runID := filepath.Base(vars["runId"])
+	filename := filepath.Base(vars["filename"])
+	full := r.URL.Query().Get("full") == "true"
+
+	info, _, err := h.loadRunInfo(runID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+	if !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only admins and the uploader can download files of this run",
+		})
+		return
+	}
+
+	if full && !middleware.HasPermission(userClaims, fullExportPermission) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Downloading unmasked results requires the stock_full_export permission",
+		})
+		return
+	}
+	if !full && !isResultsCSV(filename) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only results CSVs can be downloaded masked, use full=true",
+		})
+		return
+	}
 
 	// Construct file path
 	filePath := filepath.Join(h.config.UploadsDir, runID, filename)
+	if runID == ".." || filename == ".." {
+		filePath = ""
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	// Open the file, run artifacts are decrypted here only
+	file, err := h.artifacts.Open(filePath)
+	if os.IsNotExist(err) && filePath != "" {
+		// Files pruned after archiving come from the archive
+		if url, ok := h.archivedFileURL(runID, filename); ok && full {
+			meta, _ := readRunMeta(filepath.Join(h.config.UploadsDir, runID))
+			utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Full Results Download", meta.Env,
+				fmt.Sprintf("Run: %s, File: %s (presigned archive URL)", runID, filename), "Success")
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+		file, err = h.openArchivedFile(runID, filename)
+	}
+	if os.IsNotExist(err) {
 		respondJSON(w, http.StatusNotFound, map[string]interface{}{
 			"success": false,
 			"message": "File not found",
 		})
 		return
 	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Cannot read file",
+		})
+		return
+	}
+	defer file.Close()
+
+	// The client's column mapping tells where codes and PINs are
+	meta, _ := readRunMeta(filepath.Join(h.config.UploadsDir, runID))
 
 	// Set headers for download
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
 	w.Header().Set("Content-Type", "text/csv")
 
 	// Serve the file
-	http.ServeFile(w, r, filePath)
+	if !full {
+		h.redact.CopyResultsCSV(w, file, meta.profile().mapping)
+		return
+	}
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Full Results Download", meta.Env,
+		fmt.Sprintf("Run: %s, File: %s", runID, filename), "Success")
+	io.Copy(w, file)
+}
+
+// isResultsCSV reports whether a run file is a results or failed uploads CSV
+func isResultsCSV(filename string) bool {
+	return strings.HasSuffix(filename, ".csv") &&
+		(strings.HasPrefix(filename, "upload_results_") || strings.HasPrefix(filename, "failed_uploads_"))
 }
 
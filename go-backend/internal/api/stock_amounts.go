@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Units the amounts of a stock file can be given in
+const (
+	amountTypeRupees = "rupees"
+	amountTypePaise  = "paise"
+)
+
+// maxAmountPaise caps a single voucher value, far above any real denomination
+const maxAmountPaise = math.MaxInt32
+
+// currencyMarkers are stripped from amounts, longest first so "Rs." goes before "Rs"
+var currencyMarkers = []string{"₹", "inr", "rs.", "rs"}
+
+// groupedDigits matches an integer part with thousands separators, in either
+// the international (1,000,000) or the Indian (10,00,000) grouping
+var groupedDigits = regexp.MustCompile(`^(\d{1,3}(,\d{3})*|\d{1,2}(,\d{2})*,\d{3})$`)
+
+// normalizeAmountType checks the amountType of an upload. Files without one
+// hold rupees, as they did before the field was read.
+func normalizeAmountType(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", amountTypeRupees:
+		return amountTypeRupees, nil
+	case amountTypePaise:
+		return amountTypePaise, nil
+	}
+	return "", fmt.Errorf("amountType must be %q or %q", amountTypeRupees, amountTypePaise)
+}
+
+// parseAmount converts a voucher value to paise. Rupee amounts may have up to
+// two decimals, paise amounts none. Currency symbols and thousands separators
+// are accepted; values that would lose precision are rejected.
+func parseAmount(value, amountType string) (int, error) {
+	scale := 2
+	if amountType == amountTypePaise {
+		scale = 0
+	}
+
+	cleaned := strings.ToLower(strings.TrimSpace(value))
+	for _, marker := range currencyMarkers {
+		if strings.HasPrefix(cleaned, marker) {
+			cleaned = strings.TrimSpace(strings.TrimPrefix(cleaned, marker))
+			break
+		}
+	}
+	for _, marker := range []string{"inr", "/-"} {
+		cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, marker))
+	}
+
+	paise, err := parseDecimal(cleaned, scale)
+	if err != nil {
+		return 0, err
+	}
+	if paise <= 0 {
+		return 0, fmt.Errorf("must be more than zero")
+	}
+	if paise > maxAmountPaise {
+		return 0, fmt.Errorf("too large")
+	}
+	return int(paise), nil
+}
+
+// parseCommission converts a commission percentage such as "5", "2.5%" or
+// "12.25" to the hundredths of a percent the API expects
+func parseCommission(value string) (int, error) {
+	cleaned := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "%"))
+	if cleaned == "" {
+		return 0, fmt.Errorf("RZP commission is required")
+	}
+
+	commission, err := parseDecimal(cleaned, 2)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RZP commission %q: %v", value, err)
+	}
+	if commission < 0 {
+		return 0, fmt.Errorf("RZP commission cannot be negative")
+	}
+	if commission > 100*100 {
+		return 0, fmt.Errorf("RZP commission cannot be more than 100%%")
+	}
+	return int(commission), nil
+}
+
+// parseDecimal reads a decimal number exactly, with integer math, and returns
+// it multiplied by 10^scale. Digits past scale must be zeros, anything else
+// would be rounded away.
+func parseDecimal(value string, scale int) (int64, error) {
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	if value == "" {
+		return 0, fmt.Errorf("not a number")
+	}
+
+	whole, fraction, hasFraction := strings.Cut(value, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if strings.Contains(whole, ",") {
+		if !groupedDigits.MatchString(whole) {
+			return 0, fmt.Errorf("misplaced thousands separator")
+		}
+		whole = strings.ReplaceAll(whole, ",", "")
+	}
+	if !isDigits(whole) || (hasFraction && !isDigits(fraction)) {
+		return 0, fmt.Errorf("not a number")
+	}
+
+	if len(fraction) > scale {
+		if strings.Trim(fraction[scale:], "0") != "" {
+			if scale == 0 {
+				return 0, fmt.Errorf("must be a whole number")
+			}
+			return 0, fmt.Errorf("more than %d decimal places", scale)
+		}
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	number, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("out of range")
+	}
+	if negative {
+		number = -number
+	}
+	return number, nil
+}
+
+// isDigits reports whether value is a non-empty run of ASCII digits
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
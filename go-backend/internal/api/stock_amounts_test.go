@@ -0,0 +1,108 @@
+package api
+
+import "testing"
+
+func TestParseAmountRupees(t *testing.T) {
+	valid := map[string]int{
+		"100":       10000,
+		"99.9":      9990,
+		"0.01":      1,
+		"1.50":      150,
+		"1.500":     150,
+		" 250 ":     25000,
+		"₹1,000.50": 100050,
+		"Rs. 500":   50000,
+		"rs500":     50000,
+		"INR 2,000": 200000,
+		"2000 INR":  200000,
+		"250/-":     25000,
+		"1,234,567": 123456700,
+		"12,34,567": 123456700,
+	}
+	for value, want := range valid {
+		if got, err := parseAmount(value, amountTypeRupees); err != nil || got != want {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"1.005", // below a paisa
+		"0", "0.00", "-5",
+		"", "abc", "1e3",
+		"1,00", "1,2345", "1.000,50", // not a thousands grouping
+		"30000000", // above maxAmountPaise
+	}
+	for _, value := range invalid {
+		if got, err := parseAmount(value, amountTypeRupees); err == nil {
+			t.Errorf("parseAmount(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestParseAmountPaise(t *testing.T) {
+	for value, want := range map[string]int{"150": 150, "1,500": 1500, "150.0": 150} {
+		if got, err := parseAmount(value, amountTypePaise); err != nil || got != want {
+			t.Errorf("parseAmount(%q, paise) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	if got, err := parseAmount("1.5", amountTypePaise); err == nil {
+		t.Errorf("parseAmount(%q, paise) = %d, want an error for a fraction of a paisa", "1.5", got)
+	}
+}
+
+func TestNormalizeAmountType(t *testing.T) {
+	for value, want := range map[string]string{"": amountTypeRupees, "Rupees": amountTypeRupees, " paise ": amountTypePaise} {
+		if got, err := normalizeAmountType(value); err != nil || got != want {
+			t.Errorf("normalizeAmountType(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := normalizeAmountType("dollars"); err == nil {
+		t.Errorf("normalizeAmountType(%q) succeeded, want an error", "dollars")
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		value string
+		scale int
+		want  int64
+	}{
+		{"5", 2, 500},
+		{"12.25", 2, 1225},
+		{"12.2", 2, 1220},
+		{".5", 2, 50},
+		{"-1.5", 2, -150},
+		{"7.000", 0, 7},
+		{"1,000", 0, 1000},
+		{"0", 2, 0},
+	}
+	for _, tt := range tests {
+		if got, err := parseDecimal(tt.value, tt.scale); err != nil || got != tt.want {
+			t.Errorf("parseDecimal(%q, %d) = %d, %v, want %d", tt.value, tt.scale, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "-", ".", "1.2.3", "12.255", "1 000", "99999999999999999999"} {
+		if got, err := parseDecimal(value, 2); err == nil {
+			t.Errorf("parseDecimal(%q, 2) = %d, want an error", value, got)
+		}
+	}
+	if got, err := parseDecimal("7.5", 0); err == nil {
+		t.Errorf("parseDecimal(%q, 0) = %d, want an error", "7.5", got)
+	}
+}
+
+func TestParseCommission(t *testing.T) {
+	valid := map[string]int{"5": 500, "2.5%": 250, " 12.25 % ": 1225, "0": 0, "100": 10000}
+	for value, want := range valid {
+		if got, err := parseCommission(value); err != nil || got != want {
+			t.Errorf("parseCommission(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "%", "-1", "100.01", "2.555", "five"} {
+		if got, err := parseCommission(value); err == nil {
+			t.Errorf("parseCommission(%q) = %d, want an error", value, got)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// approvalPermission lets a user approve or reject uploads of environments
+// with require_approval set
+const approvalPermission = "stock_approval"
+
+// validationReportFile is the dry-run report approvers review, in the run folder
+const validationReportFile = "validation_report.json"
+
+// Approval statuses of a run
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// RunApproval records the maker-checker review of a run
+type RunApproval struct {
+	Status      string     `json:"status"` // pending, approved, rejected
+	RequestedAt time.Time  `json:"requestedAt"`
+	ReviewedAt  *time.Time `json:"reviewedAt,omitempty"`
+	ReviewedBy  string     `json:"reviewedBy,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+
+	// Report totals, so listings need not read the report
+	TotalRows       int   `json:"totalRows"`
+	ValidRows       int   `json:"validRows"`
+	RejectedRows    int   `json:"rejectedRows"`
+	DuplicateRows   int   `json:"duplicateRows"`
+	TotalValuePaise int64 `json:"totalValuePaise"`
+}
+
+// requiresApproval reports whether uploads to an environment wait for approval
+func (h *StockHandler) requiresApproval(env string) (bool, error) {
+	envs, err := h.config.LoadEnvironments()
+	if err != nil {
+		return false, err
+	}
+	return envs[strings.ToUpper(env)].RequireApproval, nil
+}
+
+// submitForApproval validates the file of a new run, saves the report in the
+// run folder and holds the run until it is reviewed
+func (h *StockHandler) submitForApproval(meta UploadMetadata) (*RunApproval, error) {
+	runFolder := filepath.Join(h.config.UploadsDir, meta.RunID)
+
+	report, err := h.parseVoucherFile(filepath.Join(runFolder, "raw.csv"), meta.profile(), h.newDuplicateDetector(strings.ToUpper(meta.Env)), meta.RowFilter)
+	if err != nil {
+		return nil, err
+	}
+	defer report.Close()
+
+	file, err := h.artifacts.Create(filepath.Join(runFolder, validationReportFile))
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(file)
+	err = report.WriteJSON(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	approval := &RunApproval{
+		Status:          ApprovalPending,
+		RequestedAt:     time.Now(),
+		TotalRows:       report.TotalRows,
+		ValidRows:       report.ValidRows,
+		RejectedRows:    report.RejectedRows,
+		DuplicateRows:   report.DuplicateRows,
+		TotalValuePaise: report.TotalValuePaise,
+	}
+	err = updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		meta.Approval = approval
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeControlState(runFolder, RunStateAwaitingApproval); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// reviewRun approves or rejects a run awaiting approval. Approved runs are
+// scheduled when their start time is still ahead, queued otherwise; the
+// returned state is the one the run moved to.
+func (h *StockHandler) reviewRun(runID, reviewer string, approve bool, comment string) (string, error) {
+	h.approvalMutex.Lock()
+	defer h.approvalMutex.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if state := readControlState(runFolder); state != RunStateAwaitingApproval {
+		return "", &TransitionError{State: state, Action: "review"}
+	}
+
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	status := ApprovalRejected
+	if approve {
+		status = ApprovalApproved
+	}
+	err = updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.Approval == nil {
+			meta.Approval = &RunApproval{RequestedAt: now}
+		}
+		meta.Approval.Status = status
+		meta.Approval.ReviewedAt = &now
+		meta.Approval.ReviewedBy = reviewer
+		meta.Approval.Comment = comment
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !approve {
+		return RunStateRejected, writeControlState(runFolder, RunStateRejected)
+	}
+	if meta.ScheduledAt != nil && meta.ScheduledAt.After(now) {
+		return RunStateScheduled, h.scheduleRun(runID, runFolder, *meta.ScheduledAt)
+	}
+	state, _, err := h.enqueueRun(meta)
+	return state, err
+}
+
+// isUploader reports whether the user submitted a run, the uploader being
+// recorded by email or username
+func isUploader(userClaims *middleware.UserClaims, uploader string) bool {
+	return uploader != "" && (strings.EqualFold(uploader, userClaims.Email) || strings.EqualFold(uploader, userClaims.Username))
+}
+
+// ListApprovals lists the runs awaiting approval, oldest first. Approvers see
+// every run, other users the runs they submitted.
+func (h *StockHandler) ListApprovals(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+	approver := middleware.HasPermission(userClaims, approvalPermission)
+
+	folders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to read runs",
+		})
+		return
+	}
+
+	approvals := []RunInfo{}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		if readControlState(filepath.Join(h.config.UploadsDir, folder.Name())) != RunStateAwaitingApproval {
+			continue
+		}
+		info, _, err := h.loadRunInfo(folder.Name())
+		if err != nil || !(approver || canViewRun(userClaims, info)) {
+			continue
+		}
+		approvals = append(approvals, info)
+	}
+	sort.Slice(approvals, func(i, j int) bool {
+		if approvals[i].Approval == nil || approvals[j].Approval == nil {
+			return approvals[i].RunID < approvals[j].RunID
+		}
+		return approvals[i].Approval.RequestedAt.Before(approvals[j].Approval.RequestedAt)
+	})
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"approvals": approvals,
+	})
+}
+
+// GetApproval returns a run awaiting approval with its validation report
+func (h *StockHandler) GetApproval(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	info, _, err := h.loadRunInfo(runID)
+	if err != nil || info.Approval == nil || !(middleware.HasPermission(userClaims, approvalPermission) || canViewRun(userClaims, info)) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+
+	// The report lists every row of the file, it is passed on as stored
+	report, err := h.artifacts.Open(filepath.Join(h.config.UploadsDir, runID, validationReportFile))
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Cannot read validation report",
+		})
+		return
+	}
+	defer report.Close()
+
+	respondWithReport(w, map[string]interface{}{
+		"success": true,
+		"run":     info,
+	}, func(w io.Writer) error {
+		_, err := io.Copy(w, report)
+		return err
+	})
+}
+
+// ReviewUpload approves or rejects a run awaiting approval. Reviewers need
+// the stock_approval permission and cannot review their own uploads.
+func (h *StockHandler) ReviewUpload(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+	if !middleware.HasPermission(userClaims, approvalPermission) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only approvers can review uploads",
+		})
+		return
+	}
+
+	var body struct {
+		Action  string `json:"action"` // approve or reject
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": "Invalid request body",
+		})
+		return
+	}
+	if body.Action != "approve" && body.Action != "reject" {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": "Action must be 'approve' or 'reject'",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	_, meta, err := h.loadRunInfo(runID)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+	if isUploader(userClaims, meta.User) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Uploads must be approved by a different user",
+		})
+		return
+	}
+
+	_, err = h.reviewRun(runID, activityUser(userClaims), body.Action == "approve", strings.TrimSpace(body.Comment))
+
+	var transitionErr *TransitionError
+	switch {
+	case err == nil:
+	case errors.As(err, &transitionErr):
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Run is not awaiting approval, it is %s", transitionErr.State),
+			"state":   transitionErr.State,
+		})
+		return
+	default:
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Cannot update run",
+		})
+		return
+	}
+
+	activityStatus := "Approved"
+	if body.Action == "reject" {
+		activityStatus = "Rejected"
+	}
+	info, _, _ := h.loadRunInfo(runID)
+	details := fmt.Sprintf("Run: %s, File: %s, Uploaded by: %s", runID, meta.FileName, meta.User)
+	if info.Approval != nil {
+		details += fmt.Sprintf(", Valid rows: %d/%d, Value: ₹%.2f",
+			info.Approval.ValidRows, info.Approval.TotalRows, float64(info.Approval.TotalValuePaise)/100)
+		if info.Approval.Comment != "" {
+			details += ", Comment: " + info.Approval.Comment
+		}
+	}
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Upload Approval Review", info.Env, details, activityStatus)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Upload " + strings.ToLower(activityStatus) + " successfully",
+		"run":     info,
+	})
+}
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gc-distribution-portal/internal/objectstore"
+	"gc-distribution-portal/internal/utils"
+)
+
+const (
+	// archiveSweepInterval is how often run folders are checked for finished
+	// runs that were not archived yet, such as runs that finished while the
+	// archive was unreachable
+	archiveSweepInterval = time.Hour
+
+	// archivePresignExpiry is how long a presigned download URL stays valid
+	archivePresignExpiry = 5 * time.Minute
+)
+
+// archiveKeepLocal are the run files kept in the run folder when archived
+// files are pruned: the run summary that run listings are built from
+var archiveKeepLocal = map[string]bool{
+	"meta.json":                true,
+	"control.json":             true,
+	"procurement_batch_id.txt": true,
+}
+
+// RunArchive records where the files of a run were archived
+type RunArchive struct {
+	Prefix     string        `json:"prefix"` // files are archived as <prefix>/<runId>/<name>
+	ArchivedAt *time.Time    `json:"archivedAt"`
+	Files      []RunArtifact `json:"files"`
+	Pruned     bool          `json:"pruned,omitempty"`     // the archived files were deleted from the run folder
+	RestoredAt *time.Time    `json:"restoredAt,omitempty"` // pruned files were copied back, for a retry
+}
+
+// key returns the archive key of a run file
+func (a *RunArchive) key(runID, name string) string {
+	return path.Join(a.Prefix, runID, name)
+}
+
+// has reports whether a file of the run was archived
+func (a *RunArchive) has(name string) bool {
+	if a == nil {
+		return false
+	}
+	for _, file := range a.Files {
+		if file.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// StartArchiver archives finished runs in the background: right after each
+// run ends, and on a sweep of all run folders at startup and every hour.
+// Without an archive configured it does nothing.
+func (h *StockHandler) StartArchiver() {
+	if h.archive == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(archiveSweepInterval)
+		defer ticker.Stop()
+		h.sweepArchive()
+		for {
+			select {
+			case runID := <-h.archiveQueue:
+				h.archiveRun(runID)
+			case <-ticker.C:
+				h.sweepArchive()
+			}
+		}
+	}()
+}
+
+// queueArchive asks the archiver to archive a run that just ended. When the
+// archiver is busy the run is left to the next sweep.
+func (h *StockHandler) queueArchive(runID string) {
+	if h.archive == nil {
+		return
+	}
+	select {
+	case h.archiveQueue <- runID:
+	default:
+	}
+}
+
+// sweepArchive archives every finished run that is not archived yet
+func (h *StockHandler) sweepArchive() {
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil {
+		log.Printf("Cannot list run folders to archive: %v", err)
+		return
+	}
+	for _, folder := range runFolders {
+		if folder.IsDir() {
+			h.archiveRun(folder.Name())
+		}
+	}
+}
+
+// archiveRun copies the files of a finished run to the archive and, when
+// configured, deletes them from the run folder. Runs already archived are
+// only pruned, unless their files were restored for a retry.
+func (h *StockHandler) archiveRun(runID string) {
+	h.archiveMutex.Lock()
+	defer h.archiveMutex.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if !isFinishedState(readControlState(runFolder)) || h.runs.Get(runID) != nil {
+		return
+	}
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return
+	}
+
+	archive := meta.Archive
+	if archive == nil {
+		archive, err = h.uploadRunFiles(runID, runFolder)
+		if err != nil {
+			log.Printf("Cannot archive run %s: %v", runID, err)
+			return
+		}
+		updateRunMeta(runFolder, func(meta *UploadMetadata) {
+			meta.Archive = archive
+		})
+		log.Printf("Archived %d files of run %s to %s", len(archive.Files), runID, path.Join(archive.Prefix, runID))
+	}
+
+	if !h.config.Archive.PruneLocal || archive.Pruned || archive.RestoredAt != nil {
+		return
+	}
+	for _, file := range archive.Files {
+		if !archiveKeepLocal[file.Name] {
+			if err := os.Remove(filepath.Join(runFolder, file.Name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Cannot prune archived file %s of run %s: %v", file.Name, runID, err)
+				return
+			}
+		}
+	}
+	updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.Archive != nil {
+			meta.Archive.Pruned = true
+		}
+	})
+	utils.LogActivity(h.config.ConfigDir, retentionSystemUser, "Run Archived", meta.Env,
+		fmt.Sprintf("Run: %s, Files: %d, Local copies pruned", runID, len(archive.Files)), "Success")
+}
+
+// uploadRunFiles puts every file of a run folder in the archive, as stored on
+// disk: encrypted artifacts stay encrypted
+func (h *StockHandler) uploadRunFiles(runID, runFolder string) (*RunArchive, error) {
+	entries, err := os.ReadDir(runFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	archivedAt := time.Now()
+	archive := &RunArchive{Prefix: h.config.Archive.Prefix, ArchivedAt: &archivedAt, Files: []RunArtifact{}}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if err := h.uploadRunFile(archive.key(runID, entry.Name()), filepath.Join(runFolder, entry.Name()), stat.Size()); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		archive.Files = append(archive.Files, RunArtifact{Name: entry.Name(), Size: stat.Size(), ModifiedAt: stat.ModTime()})
+	}
+	return archive, nil
+}
+
+// uploadRunFile puts one run file in the archive
+func (h *StockHandler) uploadRunFile(key, filePath string, size int64) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return h.archive.Put(key, file, size)
+}
+
+// openArchivedFile returns a reader of the plaintext of an archived run file,
+// an os.ErrNotExist error when the run has no such file in the archive
+func (h *StockHandler) openArchivedFile(runID, name string) (io.ReadCloser, error) {
+	meta, err := readRunMeta(filepath.Join(h.config.UploadsDir, runID))
+	if err != nil || h.archive == nil || !meta.Archive.has(name) {
+		return nil, os.ErrNotExist
+	}
+	body, err := h.archive.Get(meta.Archive.key(runID, name))
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.artifacts.NewReader(body)
+}
+
+// archivedFileURL returns a presigned URL of an archived run file, for
+// downloads that need no masking. Encrypted files are never presigned: they
+// have to be decrypted by the backend.
+func (h *StockHandler) archivedFileURL(runID, name string) (string, bool) {
+	if !h.config.Archive.PresignedDownloads || h.artifacts != nil || h.archive == nil {
+		return "", false
+	}
+	meta, err := readRunMeta(filepath.Join(h.config.UploadsDir, runID))
+	if err != nil || !meta.Archive.has(name) {
+		return "", false
+	}
+	url, err := h.archive.PresignedURL(meta.Archive.key(runID, name), archivePresignExpiry)
+	if err != nil {
+		if !errors.Is(err, objectstore.ErrPresignUnsupported) {
+			log.Printf("Cannot presign archived file %s of run %s: %v", name, runID, err)
+		}
+		return "", false
+	}
+	return url, true
+}
+
+// restoreArchivedRun copies the pruned files of a run back from the archive.
+// Restored runs are not pruned again.
+func (h *StockHandler) restoreArchivedRun(runID string) error {
+	h.archiveMutex.Lock()
+	defer h.archiveMutex.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return err
+	}
+	if meta.Archive == nil || !meta.Archive.Pruned {
+		return nil
+	}
+	if err := h.restoreArchivedFiles(runID, meta.Archive); err != nil {
+		return err
+	}
+
+	return updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		restoredAt := time.Now()
+		meta.Archive.Pruned = false
+		meta.Archive.RestoredAt = &restoredAt
+	})
+}
+
+// restoreArchivedFiles copies the archived files missing from a run folder
+// back from the archive
+func (h *StockHandler) restoreArchivedFiles(runID string, archive *RunArchive) error {
+	if h.archive == nil {
+		return fmt.Errorf("run files are archived but no archive is configured")
+	}
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	for _, file := range archive.Files {
+		filePath := filepath.Join(runFolder, file.Name)
+		if _, err := os.Stat(filePath); err == nil {
+			continue
+		}
+		if err := h.restoreArchivedFile(archive.key(runID, file.Name), filePath); err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// withArchivedFiles runs fn on the run folder with the pruned files of an
+// archived run restored, then brings the archive in line with the folder:
+// files fn changed are uploaded again and files it deleted are removed from
+// the archive. Pruned runs are pruned again afterwards.
+func (h *StockHandler) withArchivedFiles(runID string, fn func() error) error {
+	h.archiveMutex.Lock()
+	defer h.archiveMutex.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return err
+	}
+	archive := meta.Archive
+	if archive == nil {
+		return fn()
+	}
+	if archive.Pruned {
+		if err := h.restoreArchivedFiles(runID, archive); err != nil {
+			return err
+		}
+	}
+
+	fnErr := fn()
+
+	if h.archive == nil {
+		return fmt.Errorf("run files are archived but no archive is configured")
+	}
+	files := []RunArtifact{}
+	for _, file := range archive.Files {
+		filePath := filepath.Join(runFolder, file.Name)
+		stat, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			if err := h.archive.Delete(archive.key(runID, file.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !archiveKeepLocal[file.Name] {
+			if err := h.uploadRunFile(archive.key(runID, file.Name), filePath, stat.Size()); err != nil {
+				return err
+			}
+			file = RunArtifact{Name: file.Name, Size: stat.Size(), ModifiedAt: stat.ModTime()}
+			if archive.Pruned {
+				os.Remove(filePath)
+			}
+		}
+		files = append(files, file)
+	}
+
+	updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.Archive != nil {
+			meta.Archive.Files = files
+		}
+	})
+	return fnErr
+}
+
+// restoreArchivedFile downloads one archived file through a temporary file
+func (h *StockHandler) restoreArchivedFile(key, filePath string) error {
+	body, err := h.archive.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // gone already once renamed
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runArtifactPatterns are the files of a run folder that hold voucher codes
+// and PINs, and are encrypted when an artifact keyring is configured. The run
+// journal is a record file, see runJournalFile.
+var runArtifactPatterns = []string{
+	"raw.csv",
+	"raw.xlsx",
+	"raw.xlsm",
+	"raw.xls",
+	"upload_results_*.csv",
+	"failed_uploads_*.csv",
+	validationReportFile,
+}
+
+// protectArtifacts brings the artifacts of every run under the active key on
+// startup: files written before encryption was configured are encrypted, and
+// files wrapped with a retired key are rewrapped so the key can be dropped
+// from the keyring. Files that cannot be read are left as they are.
+func (h *StockHandler) protectArtifacts() {
+	if h.artifacts == nil {
+		return
+	}
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil {
+		return
+	}
+
+	protected, failed := 0, 0
+	protect := func(path string, protectFile func(string) (bool, error)) {
+		rewritten, err := protectFile(path)
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			log.Printf("Failed to encrypt %s: %v", path, err)
+			failed++
+		case rewritten:
+			protected++
+		}
+	}
+
+	for _, folder := range runFolders {
+		if !folder.IsDir() {
+			continue
+		}
+		runFolder := filepath.Join(h.config.UploadsDir, folder.Name())
+
+		for _, pattern := range runArtifactPatterns {
+			paths, _ := filepath.Glob(filepath.Join(runFolder, pattern))
+			for _, path := range paths {
+				protect(path, h.artifacts.ProtectFile)
+			}
+		}
+		protect(filepath.Join(runFolder, runJournalFile), h.artifacts.ProtectRecords)
+	}
+
+	if protected > 0 || failed > 0 {
+		log.Printf("Run artifacts under key %s: %d encrypted or rewrapped, %d failed", h.artifacts.ActiveKey(), protected, failed)
+	}
+}
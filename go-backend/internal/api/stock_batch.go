@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// uploadBatch sends a batch of vouchers in one voucher-benefits request.
+// When the request fails, or the response reports errors for some vouchers,
+// the affected vouchers are split in halves and sent again, down to single
+// vouchers, so every row gets its own outcome. Results keep the batch order.
+func (h *StockHandler) uploadBatch(run *uploadRun, batch []VoucherRecord) []UploadResult {
+	single := len(batch) == 1
+	response := h.sendVoucherBenefits(run, batch, single)
+
+	results := make([]UploadResult, len(batch))
+	retry := []int{} // positions in batch that still need an outcome
+
+	if response.Cancelled {
+		// The run was stopped, rows are reported as stopped and not split further
+		for i, v := range batch {
+			results[i] = run.newResult(v)
+			results[i].RetryCount = response.Attempts
+			results[i].ErrorMessage = response.ErrorMessage
+		}
+		return results
+	}
+
+	if response.AlreadyPresent {
+		// Only single vouchers are reported as already present, nothing to split
+		results[0] = run.newResult(batch[0])
+		results[0].AlreadyPresent = true
+		results[0].StatusCode = response.StatusCode
+		results[0].APIResponse = response.Body
+		results[0].RetryCount = response.Attempts
+		run.logRowResult(batch[0], results[0])
+		return results
+	}
+
+	if response.StatusCode == 200 {
+		itemErrors := parseBatchItemErrors(response.Body, batch)
+		for i, v := range batch {
+			results[i] = run.newResult(v)
+			results[i].StatusCode = response.StatusCode
+			results[i].APIResponse = response.Body
+			results[i].RetryCount = response.Attempts
+
+			if message, failed := itemErrors[i]; failed {
+				results[i].ErrorMessage = message
+				retry = append(retry, i)
+				continue
+			}
+			results[i].Success = true
+		}
+	} else {
+		for i, v := range batch {
+			results[i] = run.newResult(v)
+			results[i].StatusCode = response.StatusCode
+			results[i].APIResponse = response.Body
+			results[i].RetryCount = response.Attempts
+			results[i].ErrorMessage = response.ErrorMessage
+			retry = append(retry, i)
+		}
+	}
+
+	// Smaller batches are sent under keys of their own, vouchers the failed
+	// request may have stored are looked up first
+	if !single && response.Ambiguous && response.StatusCode != 200 {
+		retry = h.verifyBatch(run, batch, results, retry)
+	}
+
+	// A single voucher has nothing left to split, its outcome is final
+	if single || len(retry) == 0 {
+		for i, v := range batch {
+			run.logRowResult(v, results[i])
+		}
+		return results
+	}
+
+	resend := make(map[int]bool, len(retry))
+	for _, position := range retry {
+		resend[position] = true
+	}
+	for i, v := range batch {
+		if !resend[i] {
+			run.logRowResult(v, results[i])
+		}
+	}
+
+	// Upstream errors echo the vouchers of the batch, they are masked before
+	// being cut short so no code is left half visible
+	reason := run.redact.Batch(response.ErrorMessage, batch)
+	if response.StatusCode == 200 {
+		reason = "rejected by upstream"
+	}
+	run.logWriter.Write(fmt.Sprintf("Batch of %d rows: %d failed (%s), retrying in smaller batches\n",
+		len(batch), len(retry), truncateMessage(reason, 200)))
+
+	// Split the failed vouchers in halves and resend each half
+	middle := (len(retry) + 1) / 2
+	halves := [][]int{retry[:middle], retry[middle:]}
+	for _, half := range halves {
+		if len(half) == 0 {
+			continue
+		}
+		sub := make([]VoucherRecord, len(half))
+		for i, position := range half {
+			sub[i] = batch[position]
+		}
+
+		for i, result := range h.uploadBatch(run, sub) {
+			results[half[i]] = result
+		}
+	}
+
+	return results
+}
+
+// parseBatchItemErrors returns, by position in the batch, the vouchers that a
+// 200 response reports as failed. Items are matched on voucher_code, or on
+// position when the response has one item per voucher without codes. A
+// response without per-item details means the whole batch succeeded.
+func parseBatchItemErrors(body string, batch []VoucherRecord) map[int]string {
+	failed := make(map[int]string)
+
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return failed
+	}
+
+	var items []map[string]interface{}
+	for _, key := range []string{"voucher_benefits", "results", "errors"} {
+		if raw, ok := response[key]; ok && json.Unmarshal(raw, &items) == nil {
+			break
+		}
+		items = nil
+	}
+	if len(items) == 0 {
+		return failed
+	}
+
+	positions := make(map[string]int, len(batch))
+	for i, v := range batch {
+		positions[v.VoucherCode] = i
+	}
+
+	for index, item := range items {
+		message := batchItemError(item)
+		if message == "" {
+			continue
+		}
+
+		position := -1
+		if code, ok := item["voucher_code"].(string); ok {
+			if p, found := positions[code]; found {
+				position = p
+			}
+		} else if len(items) == len(batch) {
+			position = index
+		}
+		if position >= 0 {
+			failed[position] = message
+		}
+	}
+
+	return failed
+}
+
+// batchItemError extracts the error of a single response item, if any
+func batchItemError(item map[string]interface{}) string {
+	for _, key := range []string{"error", "error_message", "error_description", "error_code"} {
+		switch value := item[key].(type) {
+		case string:
+			if strings.TrimSpace(value) != "" {
+				return value
+			}
+		case map[string]interface{}:
+			data, _ := json.Marshal(value)
+			return string(data)
+		}
+	}
+	if success, ok := item["success"].(bool); ok && !success {
+		data, _ := json.Marshal(item)
+		return string(data)
+	}
+	return ""
+}
+
+// truncateMessage shortens long upstream messages for log lines
+func truncateMessage(message string, limit int) string {
+	if len(message) <= limit {
+		return message
+	}
+	return message[:limit] + "..."
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+)
+
+// Reasons for rejecting an expiry date
+const (
+	reasonInvalidDate   = "Invalid date"
+	reasonAmbiguousDate = "Ambiguous date"
+)
+
+// errAmbiguousDate is returned for values that match several layouts with
+// different results, such as 05-12-2025 read day-first and month-first
+var errAmbiguousDate = errors.New("ambiguous date")
+
+// excelDateLayouts are the layouts Excel date cells are converted to, see
+// formatExcelDate. They are read whatever layouts a client profile lists.
+var excelDateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02"}
+
+// dateLayout is a layout of a client's date profile, with what parsing it needs
+type dateLayout struct {
+	layout   string
+	location *time.Location
+	dateOnly bool
+}
+
+// dateParser turns expiry dates into Unix timestamps following a client's
+// date profile
+type dateParser struct {
+	layouts  []dateLayout
+	location *time.Location
+	endOfDay bool
+}
+
+// newDateParser prepares the layouts of a date profile, nil for the defaults
+func newDateParser(settings *config.DateParsing) (*dateParser, error) {
+	location, err := settings.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &dateParser{
+		location: location,
+		endOfDay: settings != nil && settings.EndOfDay,
+	}
+	layouts := settings.DateFormats()
+	for _, layout := range excelDateLayouts {
+		if !containsString(layouts, layout) {
+			layouts = append(layouts[:len(layouts):len(layouts)], layout)
+		}
+	}
+	for _, layout := range layouts {
+		dateOnly, err := config.DateOnlyLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		// A literal UTC suffix is not a zone, Parse would read the value in location
+		layoutLocation := location
+		if strings.HasSuffix(layout, " UTC") {
+			layoutLocation = time.UTC
+		}
+		parser.layouts = append(parser.layouts, dateLayout{
+			layout:   layout,
+			location: layoutLocation,
+			dateOnly: dateOnly,
+		})
+	}
+	return parser, nil
+}
+
+// Parse returns the Unix timestamp of an expiry date. Values already given as
+// a timestamp are kept. Every layout is tried, and a value that matches
+// layouts giving different times is rejected with errAmbiguousDate rather
+// than guessed.
+func (p *dateParser) Parse(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return timestamp, nil
+	}
+
+	var (
+		matched  bool
+		epoch    int64
+		firstFit string
+	)
+	for _, layout := range p.layouts {
+		t, err := time.ParseInLocation(layout.layout, value, layout.location)
+		if err != nil {
+			continue
+		}
+		if layout.dateOnly && p.endOfDay {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 0, t.Location())
+		}
+
+		if !matched {
+			matched, epoch, firstFit = true, t.Unix(), layout.layout
+			continue
+		}
+		if t.Unix() != epoch {
+			return 0, fmt.Errorf("%w: %s matches both %q and %q", errAmbiguousDate, value, firstFit, layout.layout)
+		}
+	}
+
+	if !matched {
+		return 0, fmt.Errorf("unable to parse date: %s", value)
+	}
+	return epoch, nil
+}
+
+// describe summarises the parser for the run log
+func (p *dateParser) describe() string {
+	description := fmt.Sprintf("timezone %s, %d formats", p.location, len(p.layouts))
+	if p.endOfDay {
+		description += ", date-only values expire at 23:59:59"
+	}
+	return description
+}
+
+// containsString reports whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+)
+
+func TestDateParserParse(t *testing.T) {
+	ist, err := time.LoadLocation(config.DefaultTimezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(location *time.Location, year int, month time.Month, day, hour, minute, second int) int64 {
+		return time.Date(year, month, day, hour, minute, second, 0, location).Unix()
+	}
+
+	tests := []struct {
+		name          string
+		settings      *config.DateParsing
+		value         string
+		want          int64
+		wantErr       bool
+		wantAmbiguous bool
+	}{
+		{name: "timestamp kept", value: "1735689600", want: 1735689600},
+		{name: "ISO date in default timezone", value: "2025-12-31", want: at(ist, 2025, 12, 31, 0, 0, 0)},
+		{name: "ISO date and time", value: " 2025-12-31 10:00:00 ", want: at(ist, 2025, 12, 31, 10, 0, 0)},
+		{name: "literal UTC suffix", value: "2025-12-31 10:00:00 UTC", want: at(time.UTC, 2025, 12, 31, 10, 0, 0)},
+		{name: "day first only", value: "25-12-2025", want: at(ist, 2025, 12, 25, 0, 0, 0)},
+		{name: "month first only", value: "12-25-2025", want: at(ist, 2025, 12, 25, 0, 0, 0)},
+		{name: "same date both ways", value: "05-05-2025", want: at(ist, 2025, 5, 5, 0, 0, 0)},
+		{name: "day and month differ", value: "05-12-2025", wantErr: true, wantAmbiguous: true},
+		{name: "short date day and month differ", value: "1/2/06", wantErr: true, wantAmbiguous: true},
+		{name: "short date month first only", value: "1/13/26", want: at(ist, 2026, 1, 13, 0, 0, 0)},
+		{name: "month name", value: "31-Dec-2025, 18:30", want: at(ist, 2025, 12, 31, 18, 30, 0)},
+		{name: "unknown layout", value: "31.12.2025", wantErr: true},
+		{name: "not a date", value: "soon", wantErr: true},
+		{name: "empty", value: "", wantErr: true},
+
+		{
+			name:     "end of day moves date-only values",
+			settings: &config.DateParsing{EndOfDay: true},
+			value:    "2025-12-31",
+			want:     at(ist, 2025, 12, 31, 23, 59, 59),
+		},
+		{
+			name:     "end of day keeps a time of day",
+			settings: &config.DateParsing{EndOfDay: true},
+			value:    "2025-12-31 10:00:00",
+			want:     at(ist, 2025, 12, 31, 10, 0, 0),
+		},
+		{
+			name:     "client format and timezone",
+			settings: &config.DateParsing{Formats: []string{"02/01/2006"}, Timezone: "UTC"},
+			value:    "05/12/2025",
+			want:     at(time.UTC, 2025, 12, 5, 0, 0, 0),
+		},
+		{
+			name:     "Excel dates read whatever the client formats",
+			settings: &config.DateParsing{Formats: []string{"02/01/2006"}, Timezone: "UTC"},
+			value:    "2025-12-05 08:00:00",
+			want:     at(time.UTC, 2025, 12, 5, 8, 0, 0),
+		},
+		{
+			name:     "client formats replace the defaults",
+			settings: &config.DateParsing{Formats: []string{"02/01/2006"}},
+			value:    "05-12-2025",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := newDateParser(tt.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parser.Parse(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %d, want an error", tt.value, got)
+				}
+				if ambiguous := errors.Is(err, errAmbiguousDate); ambiguous != tt.wantAmbiguous {
+					t.Fatalf("Parse(%q) error %v, ambiguous %t, want %t", tt.value, err, ambiguous, tt.wantAmbiguous)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("Parse(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDateParserRejectsBadProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *config.DateParsing
+	}{
+		{name: "unknown timezone", settings: &config.DateParsing{Timezone: "Mars/Olympus_Mons"}},
+		{name: "format without a date", settings: &config.DateParsing{Formats: []string{"15:04"}}},
+		{name: "format without a year", settings: &config.DateParsing{Formats: []string{"02-01"}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := newDateParser(tt.settings); err == nil {
+			t.Errorf("%s: newDateParser succeeded, want an error", tt.name)
+		}
+	}
+}
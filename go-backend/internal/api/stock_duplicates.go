@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/artifact"
+	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/utils"
+)
+
+// Duplicate policies decide what happens to vouchers whose code appears
+// earlier in the same file or was already uploaded in a past run
+const (
+	DuplicatePolicyReject = "reject" // abort the run before any upstream call
+	DuplicatePolicySkip   = "skip"   // upload the rest, report duplicates as skipped
+)
+
+// normalizeDuplicatePolicy returns a known policy, defaulting to reject
+func normalizeDuplicatePolicy(policy string) string {
+	if strings.ToLower(strings.TrimSpace(policy)) == DuplicatePolicySkip {
+		return DuplicatePolicySkip
+	}
+	return DuplicatePolicyReject
+}
+
+// duplicateDetector flags vouchers whose code appears earlier in the same file
+// or was already uploaded in a past run. Rows are checked one at a time, in
+// file order, so files are never held in memory to find duplicates.
+type duplicateDetector struct {
+	indexDir string
+	env      string
+	indexKey func() ([]byte, error)
+	key      []byte                                        // voucher index key, loaded with the first index
+	indexes  map[string]map[string]utils.VoucherIndexEntry // voucher index of each offer, loaded on first use
+	seen     map[string]int                                // first row number of every offer and code seen so far
+}
+
+// newDuplicateDetector creates a detector for an environment. History is only
+// checked when both env and the offer of a voucher are known.
+func (h *StockHandler) newDuplicateDetector(env string) *duplicateDetector {
+	return &duplicateDetector{
+		indexDir: h.config.VoucherIndexDir,
+		env:      env,
+		indexKey: h.config.VoucherIndexKey,
+		indexes:  make(map[string]map[string]utils.VoucherIndexEntry),
+		seen:     make(map[string]int),
+	}
+}
+
+// Check returns why a voucher is a duplicate. The first occurrence of a code
+// of an offer in the file is kept; later ones are flagged.
+func (d *duplicateDetector) Check(v VoucherRecord) (string, bool, error) {
+	key := v.OfferID + "\x00" + v.VoucherCode
+	if first, ok := d.seen[key]; ok {
+		return fmt.Sprintf("Duplicate of row %d in file", first), true, nil
+	}
+	d.seen[key] = v.RowNumber
+
+	if d.env == "" || v.OfferID == "" {
+		return "", false, nil
+	}
+	index, ok := d.indexes[v.OfferID]
+	if !ok {
+		var err error
+		if d.key == nil {
+			if d.key, err = d.indexKey(); err != nil {
+				return "", false, err
+			}
+		}
+		if index, err = utils.LoadVoucherIndex(d.indexDir, d.env, v.OfferID); err != nil {
+			return "", false, err
+		}
+		d.indexes[v.OfferID] = index
+	}
+	if entry, ok := index[utils.HashVoucherCode(d.key, d.env, v.OfferID, v.VoucherCode)]; ok {
+		return fmt.Sprintf("Already uploaded in run %s", entry.RunID), true, nil
+	}
+	return "", false, nil
+}
+
+// offerLocks let one run at a time upload to an offer of an environment. A
+// run holds its offers from the duplicate check until its codes are indexed,
+// so runs of the same offer cannot both miss each other's codes.
+type offerLocks struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{} // held while its channel has a value
+}
+
+// slot returns the lock of an offer of an environment
+func (l *offerLocks) slot(env, offerID string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.slots == nil {
+		l.slots = make(map[string]chan struct{})
+	}
+	key := env + "\x00" + offerID
+	slot, ok := l.slots[key]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		l.slots[key] = slot
+	}
+	return slot
+}
+
+// acquire takes the locks of the offers, in sorted order so runs sharing
+// several offers cannot deadlock. waiting is called for every offer another
+// run holds. When ctx ends first the locks taken are released and ctx's error
+// is returned.
+func (l *offerLocks) acquire(ctx context.Context, env string, offerIDs []string, waiting func(offerID string)) (func(), error) {
+	offerIDs = append([]string{}, offerIDs...)
+	sort.Strings(offerIDs)
+
+	var held []chan struct{}
+	release := func() {
+		for _, slot := range held {
+			<-slot
+		}
+	}
+	for i, offerID := range offerIDs {
+		if i > 0 && offerID == offerIDs[i-1] {
+			continue
+		}
+		slot := l.slot(env, offerID)
+		select {
+		case slot <- struct{}{}:
+		default:
+			waiting(offerID)
+			select {
+			case slot <- struct{}{}:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+		held = append(held, slot)
+	}
+	return release, nil
+}
+
+// indexBatchSize is how many index entries are appended at once
+const indexBatchSize = 1000
+
+// indexUploadedVouchers adds the journaled codes of a run that upstream has,
+// including those it already had, to the voucher index of their offer
+func (h *StockHandler) indexUploadedVouchers(runFolder, env, runID string) error {
+	key, err := h.config.VoucherIndexKey()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string][]utils.VoucherIndexEntry)
+	pending := 0
+	flush := func() error {
+		for offerID, offerEntries := range entries {
+			if err := utils.AppendVoucherIndex(h.config.VoucherIndexDir, env, offerID, offerEntries); err != nil {
+				return err
+			}
+			delete(entries, offerID)
+		}
+		pending = 0
+		return nil
+	}
+
+	now := time.Now()
+	err = h.forEachJournalResult(runFolder, func(r UploadResult) error {
+		if !r.Success && !r.AlreadyPresent {
+			return nil
+		}
+		entries[r.OfferID] = append(entries[r.OfferID], utils.VoucherIndexEntry{
+			Hash:      utils.HashVoucherCode(key, env, r.OfferID, r.VoucherCode),
+			RunID:     runID,
+			Timestamp: now,
+		})
+		if pending++; pending < indexBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// backfillVoucherIndex builds the voucher index from the result CSVs of past
+// runs. It runs once, when the index directory does not exist yet.
+func (h *StockHandler) backfillVoucherIndex() {
+	if _, err := os.Stat(h.config.VoucherIndexDir); !os.IsNotExist(err) {
+		return
+	}
+	key, err := h.config.VoucherIndexKey()
+	if err != nil {
+		log.Printf("Failed to load voucher index key: %v", err)
+		return
+	}
+	if err := os.MkdirAll(h.config.VoucherIndexDir, 0755); err != nil {
+		log.Printf("Failed to create voucher index: %v", err)
+		return
+	}
+
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil {
+		return
+	}
+
+	indexed := 0
+	for _, folder := range runFolders {
+		if !folder.IsDir() {
+			continue
+		}
+		runFolder := filepath.Join(h.config.UploadsDir, folder.Name())
+
+		var meta UploadMetadata
+		metaBytes, err := os.ReadFile(filepath.Join(runFolder, "meta.json"))
+		if err != nil || json.Unmarshal(metaBytes, &meta) != nil {
+			continue
+		}
+
+		resultFiles, _ := filepath.Glob(filepath.Join(runFolder, "upload_results_*.csv"))
+		for _, resultFile := range resultFiles {
+			entries := readIndexEntriesFromResults(h.artifacts, key, resultFile, meta.ColumnMapping, meta.Env, folder.Name())
+			for offerID, offerEntries := range entries {
+				if err := utils.AppendVoucherIndex(h.config.VoucherIndexDir, meta.Env, offerID, offerEntries); err == nil {
+					indexed += len(offerEntries)
+				}
+			}
+		}
+	}
+
+	if indexed > 0 {
+		log.Printf("Voucher index backfilled with %d codes from past runs", indexed)
+	}
+}
+
+// readIndexEntriesFromResults collects successful codes of a results CSV, grouped
+// by offer_id. The code column is found with the column mapping of the run.
+func readIndexEntriesFromResults(keys *artifact.Keyring, indexKey []byte, resultFile string, mapping *config.ColumnMapping, env, runID string) map[string][]utils.VoucherIndexEntry {
+	entries := make(map[string][]utils.VoucherIndexEntry)
+
+	file, err := keys.Open(resultFile)
+	if err != nil {
+		return entries
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil || len(records) < 2 {
+		return entries
+	}
+
+	headers := records[0]
+	codeCol := findSecretColumns(headers, mapping).code
+	if codeCol < 0 || codeCol >= len(headers) {
+		return entries
+	}
+	offerCol, statusCol := -1, -1
+	for i, header := range headers {
+		switch header {
+		case "offer_id":
+			offerCol = i
+		case "success_failure":
+			statusCol = i
+		}
+	}
+	if offerCol < 0 || statusCol < 0 {
+		return entries
+	}
+
+	info, _ := os.Stat(resultFile)
+	for _, record := range records[1:] {
+		if record[statusCol] != "Success" && record[statusCol] != "Already Present" {
+			continue
+		}
+		offerID := record[offerCol]
+		entries[offerID] = append(entries[offerID], utils.VoucherIndexEntry{
+			Hash:      utils.HashVoucherCode(indexKey, env, offerID, strings.TrimSpace(record[codeCol])),
+			RunID:     runID,
+			Timestamp: info.ModTime(),
+		})
+	}
+
+	return entries
+}
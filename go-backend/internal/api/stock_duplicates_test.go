@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/utils"
+)
+
+func TestOfferLocks(t *testing.T) {
+	var locks offerLocks
+	noWait := func(offerID string) { t.Errorf("waited for offer %s", offerID) }
+
+	release, err := locks.acquire(context.Background(), "PROD", []string{"offer-b", "offer-a", "offer-b"}, noWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other environments and offers are not held
+	other, err := locks.acquire(context.Background(), "UAT", []string{"offer-a"}, noWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+	other, err = locks.acquire(context.Background(), "PROD", []string{"offer-c"}, noWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	// A run sharing an offer waits until it is stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var waited []string
+	if _, err := locks.acquire(ctx, "PROD", []string{"offer-c", "offer-b"}, func(offerID string) { waited = append(waited, offerID) }); err == nil {
+		t.Fatal("acquire of a held offer succeeded")
+	}
+	if len(waited) != 1 || waited[0] != "offer-b" {
+		t.Errorf("waited for %v, want offer-b", waited)
+	}
+
+	// or until the offer is released; offer-c was given back when it stopped
+	acquired := make(chan func())
+	go func() {
+		next, err := locks.acquire(context.Background(), "PROD", []string{"offer-c", "offer-b"}, func(string) {})
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- next
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire did not wait for the held offer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case next := <-acquired:
+		next()
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not get the released offer")
+	}
+}
+
+func TestReadIndexEntriesFromResults(t *testing.T) {
+	key := []byte("index-key")
+	const extra = "client_name,offer_id,rzp_commission,epoch_time,procurement_batch_id,success_failure,api_response,idempotency_key"
+
+	tests := []struct {
+		name    string
+		csv     string
+		mapping *config.ColumnMapping
+	}{
+		{
+			name: "default headers",
+			csv: "Code,Amount," + extra + "\n" +
+				"GIFT1,500,Acme,offer-a,5,0,P1,Success,,k1\n" +
+				"GIFT2,500,Acme,offer-a,5,0,P1,Failed,,k2\n",
+		},
+		{
+			name: "client aliases",
+			csv: "Gift Card No,Amount," + extra + "\n" +
+				"GIFT1,500,Acme,offer-a,5,0,P1,Already Present,,k1\n" +
+				"GIFT2,500,Acme,offer-a,5,0,P1,Skipped,,k2\n",
+			mapping: &config.ColumnMapping{Aliases: map[string][]string{config.FieldVoucherCode: {"Gift Card No"}}},
+		},
+		{
+			name: "column positions",
+			csv: "500,GIFT0," + extra + "\n" +
+				"500,GIFT1,Acme,offer-a,5,0,P1,Success,,k1\n",
+			mapping: &config.ColumnMapping{Positions: map[string]int{config.FieldVoucherCode: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		resultFile := filepath.Join(t.TempDir(), "upload_results_1.csv")
+		if err := os.WriteFile(resultFile, []byte(tt.csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries := readIndexEntriesFromResults(nil, key, resultFile, tt.mapping, "PROD", "run-1")
+		want := utils.HashVoucherCode(key, "PROD", "offer-a", "GIFT1")
+		if len(entries) != 1 || len(entries["offer-a"]) != 1 || entries["offer-a"][0].Hash != want || entries["offer-a"][0].RunID != "run-1" {
+			t.Errorf("%s: entries = %+v, want GIFT1 of offer-a", tt.name, entries)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/artifact"
+
+	"github.com/shakinm/xlsReader/xls"
+	"github.com/xuri/excelize/v2"
+)
+
+// isExcelFile reports whether the uploaded file name has an Excel extension
+func isExcelFile(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".xlsx", ".xlsm", ".xls":
+		return true
+	}
+	return false
+}
+
+// convertExcelToCSV reads the first sheet of an Excel workbook and writes it
+// as CSV. Date cells are written as "YYYY-MM-DD[ HH:MM:SS]", layouts the date
+// parser always reads, and numeric cells are written without number formatting.
+// Both files are encrypted with keys, so the workbook is decrypted in memory.
+func convertExcelToCSV(keys *artifact.Keyring, excelPath, csvPath, password string) error {
+	workbook, err := readArtifact(keys, excelPath)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	if strings.ToLower(filepath.Ext(excelPath)) == ".xls" {
+		rows, err = readXLSRows(workbook)
+	} else {
+		rows, err = readXLSXRows(workbook, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Drop fully empty rows and pad the rest so every record has the same width
+	width := 0
+	nonEmpty := [][]string{}
+	for _, row := range rows {
+		empty := true
+		for _, cell := range row {
+			if strings.TrimSpace(cell) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			continue
+		}
+		if len(row) > width {
+			width = len(row)
+		}
+		nonEmpty = append(nonEmpty, row)
+	}
+
+	if len(nonEmpty) == 0 {
+		return fmt.Errorf("workbook has no data")
+	}
+
+	file, err := keys.Create(csvPath)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	for _, row := range nonEmpty {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		if err := writer.Write(row); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readArtifact reads a whole run artifact into memory
+func readArtifact(keys *artifact.Keyring, path string) ([]byte, error) {
+	file, err := keys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// readXLSXRows reads the first sheet of an .xlsx workbook
+func readXLSXRows(workbook []byte, password string) ([][]string, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(workbook), excelize.Options{Password: password})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workbook: %w", err)
+	}
+	defer f.Close()
+
+	sheets := f.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("workbook has no sheets")
+	}
+	sheet := sheets[0]
+
+	date1904 := false
+	if props, err := f.GetWorkbookProps(); err == nil && props.Date1904 != nil {
+		date1904 = *props.Date1904
+	}
+
+	rows, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sheet %s: %w", sheet, err)
+	}
+
+	// Cache date detection per style ID, most cells share a handful of styles
+	dateStyles := make(map[int]bool)
+	for r, row := range rows {
+		for c, value := range row {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+
+			// Text cells that look numeric (e.g. codes with leading zeros) stay untouched
+			cellName, _ := excelize.CoordinatesToCellName(c+1, r+1)
+			cellType, err := f.GetCellType(sheet, cellName)
+			if err != nil || (cellType != excelize.CellTypeUnset && cellType != excelize.CellTypeNumber) {
+				continue
+			}
+
+			styleID, err := f.GetCellStyle(sheet, cellName)
+			if err != nil {
+				continue
+			}
+
+			isDate, ok := dateStyles[styleID]
+			if !ok {
+				if style, err := f.GetStyle(styleID); err == nil {
+					customFmt := ""
+					if style.CustomNumFmt != nil {
+						customFmt = *style.CustomNumFmt
+					}
+					isDate = isDateNumFmt(style.NumFmt, customFmt)
+				}
+				dateStyles[styleID] = isDate
+			}
+
+			if isDate {
+				t, err := excelize.ExcelDateToTime(number, date1904)
+				if err == nil {
+					row[c] = formatExcelDate(t)
+					continue
+				}
+			}
+			row[c] = formatExcelNumber(number)
+		}
+	}
+
+	return rows, nil
+}
+
+// readXLSRows reads the first sheet of a legacy .xls workbook
+func readXLSRows(data []byte) ([][]string, error) {
+	workbook, err := xls.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workbook: %w", err)
+	}
+
+	sheet, err := workbook.GetSheet(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first sheet: %w", err)
+	}
+
+	rows := [][]string{}
+	for i := 0; i < sheet.GetNumberRows(); i++ {
+		row, err := sheet.GetRow(i)
+		if err != nil {
+			rows = append(rows, []string{})
+			continue
+		}
+
+		values := []string{}
+		for _, cell := range row.GetCols() {
+			switch cell.GetType() {
+			case "*record.Number", "*record.Rk":
+				number := cell.GetFloat64()
+				xf := workbook.GetXFbyIndex(cell.GetXFIndex())
+				formatIndex := xf.GetFormatIndex()
+				format := workbook.GetFormatByIndex(formatIndex)
+				if isDateNumFmt(formatIndex, format.String()) {
+					if t, err := excelize.ExcelDateToTime(number, false); err == nil {
+						values = append(values, formatExcelDate(t))
+						continue
+					}
+				}
+				values = append(values, formatExcelNumber(number))
+			default:
+				values = append(values, cell.GetString())
+			}
+		}
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+// excelFormatLiterals matches quoted text, bracketed sections and escaped
+// characters in a number format code, none of which affect date detection
+var excelFormatLiterals = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]|\\.`)
+
+// isDateNumFmt reports whether a number format (built-in ID or custom code)
+// renders the cell as a date or time
+func isDateNumFmt(numFmtID int, formatCode string) bool {
+	switch {
+	case numFmtID >= 14 && numFmtID <= 22,
+		numFmtID >= 27 && numFmtID <= 36,
+		numFmtID >= 45 && numFmtID <= 47,
+		numFmtID >= 50 && numFmtID <= 58:
+		return true
+	}
+
+	code := strings.ToLower(excelFormatLiterals.ReplaceAllString(formatCode, ""))
+	if code == "" || code == "general" {
+		return false
+	}
+	return strings.ContainsAny(code, "dmyhs")
+}
+
+// formatExcelDate writes a date cell in one of excelDateLayouts
+func formatExcelDate(t time.Time) string {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// formatExcelNumber writes a numeric cell without exponent notation and
+// without the binary floating point noise Excel stores (e.g. 0.30000000000000004)
+func formatExcelNumber(number float64) string {
+	if math.IsInf(number, 0) || math.IsNaN(number) {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(number, 'g', 15, 64), 64)
+	if err != nil {
+		rounded = number
+	}
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gc-distribution-portal/internal/utils"
+)
+
+// requestIdempotencyKey returns the Idempotency-Key header of a request. A
+// single voucher uses its own key; a batch uses a hash of its voucher keys,
+// so resending the same batch reuses the same key.
+func requestIdempotencyKey(keys []string) string {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	sum := sha256.Sum256([]byte(strings.Join(keys, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyBatch looks up the failed vouchers of a batch whose request may have
+// reached upstream, at the given positions, and marks those found as already
+// present. It returns the positions that are safe to send again. Without a
+// verify_path, or when a lookup fails, vouchers are not sent again: under the
+// key of a smaller batch upstream could store them twice.
+func (h *StockHandler) verifyBatch(run *uploadRun, batch []VoucherRecord, results []UploadResult, positions []int) []int {
+	if run.envConfig.VerifyPath == "" {
+		run.logWriter.Write(fmt.Sprintf("Batch of %d rows may have reached upstream and no verify_path is set, %d rows are not resent\n",
+			len(batch), len(positions)))
+		return nil
+	}
+
+	resend := []int{}
+	for _, position := range positions {
+		voucher := batch[position]
+		key := utils.VoucherIdempotencyKey(run.procurementBatchID, voucher.OfferID, voucher.VoucherCode)
+		present, err := h.verifyVoucherPresent(run, voucher, key)
+		if err != nil {
+			run.logWriter.Write(fmt.Sprintf("Warning: Could not verify row %d upstream, it is not resent: %v\n", voucher.RowNumber, err))
+			continue
+		}
+		if present {
+			results[position].AlreadyPresent = true
+			results[position].ErrorMessage = ""
+			continue
+		}
+		resend = append(resend, position)
+	}
+	return resend
+}
+
+// verifyVoucherPresent asks upstream whether a voucher was already stored,
+// using the environment's verify_path. 200 means present, 404 absent.
+func (h *StockHandler) verifyVoucherPresent(run *uploadRun, voucher VoucherRecord, idempotencyKey string) (bool, error) {
+	envConfig := run.envConfig
+
+	path := strings.NewReplacer(
+		"{offer_id}", url.PathEscape(voucher.OfferID),
+		"{voucher_code}", url.PathEscape(voucher.VoucherCode),
+		"{procurement_batch_id}", url.PathEscape(run.procurementBatchID),
+		"{idempotency_key}", url.PathEscape(idempotencyKey),
+	).Replace(envConfig.VerifyPath)
+
+	if err := run.limiter.Wait(run.active.ctx); err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(run.active.ctx, "GET", envConfig.BaseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth(envConfig.Username, envConfig.Password)
+	req.Header.Set("X-User-Type", "advertiser")
+	req.Header.Set("X-User-Id", "rzp.merchant.MK6oPUp488NKF6")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	client := &http.Client{Timeout: envConfig.Timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("verify returned status %d", resp.StatusCode)
+	}
+}
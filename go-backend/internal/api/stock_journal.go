@@ -0,0 +1,303 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/artifact"
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// runJournalFile is the per-run file that every finished row is appended to
+const runJournalFile = "results.journal"
+
+// runJournal appends upload results to the run folder as JSON lines, one per
+// finished row, so a run that dies mid-way can be resumed. With an artifact
+// keyring every line is sealed on its own.
+type runJournal struct {
+	mu   sync.Mutex
+	file *artifact.RecordWriter
+}
+
+// openRunJournal opens (or creates) the journal of a run folder for appending
+func (h *StockHandler) openRunJournal(runFolder string) (*runJournal, error) {
+	file, err := h.artifacts.OpenRecordWriter(filepath.Join(runFolder, runJournalFile))
+	if err != nil {
+		return nil, err
+	}
+	return &runJournal{file: file}, nil
+}
+
+// Append writes results and syncs them to disk before returning
+func (j *runJournal) Append(results ...UploadResult) error {
+	var buf bytes.Buffer
+	for _, result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		buf.Write(j.file.Seal(data))
+		buf.WriteByte('\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal file
+func (j *runJournal) Close() error {
+	return j.file.Close()
+}
+
+// journalEntry locates the line of a journaled result in the journal file
+type journalEntry struct {
+	offset int64
+	length int
+}
+
+// forEachJournalResult calls fn with the journaled results of a run in row
+// order. When a row was journaled more than once the last entry wins. Only
+// the position of each row's entry is kept in memory, entries are read back
+// one at a time, so this works for runs of any size.
+func (h *StockHandler) forEachJournalResult(runFolder string, fn func(UploadResult) error) error {
+	file, err := h.artifacts.OpenRecordReader(filepath.Join(runFolder, runJournalFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	entries := make(map[int]journalEntry)
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if rowNumber, ok := journalRowNumber(file, line); ok {
+				entries[rowNumber] = journalEntry{offset: offset, length: len(line)}
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	rows := make([]int, 0, len(entries))
+	for rowNumber := range entries {
+		rows = append(rows, rowNumber)
+	}
+	sort.Ints(rows)
+
+	var line []byte
+	for _, rowNumber := range rows {
+		entry := entries[rowNumber]
+		if cap(line) < entry.length {
+			line = make([]byte, entry.length)
+		}
+		line = line[:entry.length]
+		if _, err := file.ReadAt(line, entry.offset); err != nil {
+			return err
+		}
+
+		record, ok := file.Record(line)
+		if !ok {
+			continue
+		}
+		var result UploadResult
+		if err := json.Unmarshal(record, &result); err != nil {
+			continue // Joined to a line cut short by a crash
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// journalRowNumber returns the row number of a journal line. Results start
+// with the RowNumber field, so it is read without decoding the whole result.
+// A line cut short by a crash has no closing brace, or does not open, and is
+// skipped.
+func journalRowNumber(file *artifact.RecordReader, line []byte) (int, bool) {
+	const prefix = `{"RowNumber":`
+	line, ok := file.Record(line)
+	if !ok {
+		return 0, false
+	}
+	if !bytes.HasPrefix(line, []byte(prefix)) || !bytes.HasSuffix(line, []byte("}")) {
+		return 0, false
+	}
+
+	digits := line[len(prefix):]
+	end := bytes.IndexByte(digits, ',')
+	if end < 0 {
+		return 0, false
+	}
+	rowNumber, err := strconv.Atoi(string(digits[:end]))
+	return rowNumber, err == nil
+}
+
+// journaledUploadedRows returns the rows of a run that upstream already has,
+// either uploaded by the run or found already present
+func (h *StockHandler) journaledUploadedRows(runFolder string) (map[int]bool, error) {
+	rows := make(map[int]bool)
+	err := h.forEachJournalResult(runFolder, func(result UploadResult) error {
+		if result.Success || result.AlreadyPresent {
+			rows[result.RowNumber] = true
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// markInterruptedRuns settles runs that were still running or paused when the
+// server stopped. Runs that saved their results and summary only missed
+// recording their end and are completed; the others are flagged interrupted.
+func (h *StockHandler) markInterruptedRuns() {
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil {
+		return
+	}
+
+	for _, folder := range runFolders {
+		if !folder.IsDir() {
+			continue
+		}
+		runFolder := filepath.Join(h.config.UploadsDir, folder.Name())
+
+		state := readControlState(runFolder)
+		if state != RunStateRunning && state != RunStatePaused {
+			continue
+		}
+		resultFiles, _ := filepath.Glob(filepath.Join(runFolder, "upload_results_*.csv"))
+		if meta, err := readRunMeta(runFolder); err == nil && meta.Summary != nil && len(resultFiles) > 0 {
+			h.settleCompletedRun(folder.Name(), runFolder)
+			continue
+		}
+
+		// Results saved before the server stopped may be incomplete, a resumed
+		// run writes them again from the journal
+		failedFiles, _ := filepath.Glob(filepath.Join(runFolder, "failed_uploads_*.csv"))
+		for _, file := range append(resultFiles, failedFiles...) {
+			if err := os.Remove(file); err != nil {
+				log.Printf("Failed to remove partial results %s of run %s: %v", filepath.Base(file), folder.Name(), err)
+			}
+		}
+
+		if err := writeControlState(runFolder, RunStateInterrupted); err != nil {
+			log.Printf("Failed to mark run %s as interrupted: %v", folder.Name(), err)
+			continue
+		}
+		log.Printf("Run %s was interrupted (state was %s), it can be resumed", folder.Name(), state)
+	}
+}
+
+// settleCompletedRun records the end of a run the server stopped after it
+// saved its results
+func (h *StockHandler) settleCompletedRun(runID, runFolder string) {
+	err := updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.FinishedAt == nil {
+			finishedAt := time.Now()
+			meta.FinishedAt = &finishedAt
+		}
+	})
+	if err == nil {
+		err = writeControlState(runFolder, RunStateCompleted)
+	}
+	if err != nil {
+		log.Printf("Failed to mark run %s as completed: %v", runID, err)
+		return
+	}
+	log.Printf("Run %s had saved its results when the server stopped, marked as completed", runID)
+}
+
+// ResumeRun restarts an interrupted run. Rows already uploaded are skipped.
+// Admins can resume any run, other users their own.
+func (h *StockHandler) ResumeRun(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+
+	info, meta, err := h.loadRunInfo(runID)
+	if err != nil || !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+
+	if state := readControlState(runFolder); state != RunStateInterrupted {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Only interrupted runs can be resumed, run is %s", state),
+			"state":   state,
+		})
+		return
+	}
+
+	csvPath := filepath.Join(runFolder, "raw.csv")
+	if _, err := os.Stat(csvPath); err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Uploaded file of this run is missing",
+		})
+		return
+	}
+
+	// Resumed runs wait for a free slot like new ones
+	state, position, err := h.enqueueRun(meta)
+	if err != nil {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Cannot resume run: %v", err),
+		})
+		return
+	}
+
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Resume Upload", strings.ToUpper(meta.Env),
+		fmt.Sprintf("Run: %s, File: %s", runID, meta.FileName), "Success")
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"runId":         meta.RunID,
+		"runFolder":     runFolder,
+		"state":         state,
+		"queuePosition": position,
+	})
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gc-distribution-portal/internal/artifact"
+	"gc-distribution-portal/internal/config"
+)
+
+// newTestKeyring returns a keyring with one random key
+func newTestKeyring(t *testing.T) *artifact.Keyring {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := artifact.NewKeyring("test", map[string]string{"test": base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestJournalRowNumber(t *testing.T) {
+	path := filepath.Join(t.TempDir(), runJournalFile)
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := (*artifact.Keyring)(nil).OpenRecordReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	valid := map[string]int{
+		`{"RowNumber":12,"VoucherCode":"A"}` + "\n":   12,
+		`{"RowNumber":7,"VoucherCode":"A"}` + "\r\n":  7,
+		`{"RowNumber":3,"VoucherCode":"A","Pin":"1"}`: 3,
+	}
+	for line, want := range valid {
+		if got, ok := journalRowNumber(file, []byte(line)); !ok || got != want {
+			t.Errorf("journalRowNumber(%q) = %d, %t, want %d", line, got, ok, want)
+		}
+	}
+
+	skipped := []string{
+		`{"RowNumber":12,"VoucherCode":"A"` + "\n", // cut short by a crash
+		`"RowNumber":12,"VoucherCode":"A"}` + "\n",
+		`{"VoucherCode":"A","RowNumber":12}` + "\n",
+		`{"RowNumber":12}` + "\n",
+		`{"RowNumber":x,"VoucherCode":"A"}` + "\n",
+		"#GCENC1 eyJ2IjoxfQ==\n", // header of an encrypted journal
+		"\n",
+	}
+	for _, line := range skipped {
+		if got, ok := journalRowNumber(file, []byte(line)); ok {
+			t.Errorf("journalRowNumber(%q) = %d, want the line skipped", line, got)
+		}
+	}
+}
+
+func TestForEachJournalResult(t *testing.T) {
+	t.Run("plaintext", func(t *testing.T) {
+		testForEachJournalResult(t, &StockHandler{})
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		testForEachJournalResult(t, &StockHandler{artifacts: newTestKeyring(t)})
+	})
+}
+
+func testForEachJournalResult(t *testing.T, h *StockHandler) {
+	runFolder := t.TempDir()
+
+	journal, err := h.openRunJournal(runFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Append(
+		UploadResult{RowNumber: 3, VoucherCode: "C", Success: true},
+		UploadResult{RowNumber: 1, VoucherCode: "A", StatusCode: 500},
+		UploadResult{RowNumber: 2, VoucherCode: "B", AlreadyPresent: true},
+	)
+	if err == nil {
+		err = journal.Append(UploadResult{RowNumber: 1, VoucherCode: "A", Success: true, RetryCount: 1})
+	}
+	if err == nil {
+		// A crash mid-write, the next entry is appended to the torn line
+		_, err = journal.file.Write(journal.file.Seal([]byte(`{"RowNumber":9,"VoucherCode":"I"}`))[:20])
+	}
+	if err == nil {
+		err = journal.Append(UploadResult{RowNumber: 4, VoucherCode: "D", Success: true})
+	}
+	if err == nil {
+		err = journal.Append(UploadResult{RowNumber: 5, VoucherCode: "E", StatusCode: 400})
+	}
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []UploadResult
+	err = h.forEachJournalResult(runFolder, func(result UploadResult) error {
+		got = append(got, result)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UploadResult{
+		{RowNumber: 1, VoucherCode: "A", Success: true, RetryCount: 1},
+		{RowNumber: 2, VoucherCode: "B", AlreadyPresent: true},
+		{RowNumber: 3, VoucherCode: "C", Success: true},
+		{RowNumber: 5, VoucherCode: "E", StatusCode: 400},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forEachJournalResult read %+v, want %+v", got, want)
+	}
+
+	uploaded, err := h.journaledUploadedRows(runFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]bool{1: true, 2: true, 3: true}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("journaledUploadedRows = %v, want %v", uploaded, want)
+	}
+}
+
+func TestForEachJournalResultWithoutJournal(t *testing.T) {
+	h := &StockHandler{}
+	err := h.forEachJournalResult(t.TempDir(), func(result UploadResult) error {
+		t.Errorf("unexpected result %+v", result)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("forEachJournalResult of a run without a journal = %v, want nil", err)
+	}
+}
+
+func TestForEachJournalResultStopsOnError(t *testing.T) {
+	h := &StockHandler{}
+	runFolder := t.TempDir()
+	journal, err := h.openRunJournal(runFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Append(UploadResult{RowNumber: 1}, UploadResult{RowNumber: 2})
+	journal.Close()
+
+	calls := 0
+	err = h.forEachJournalResult(runFolder, func(UploadResult) error {
+		calls++
+		return os.ErrClosed
+	})
+	if err != os.ErrClosed || calls != 1 {
+		t.Errorf("forEachJournalResult = %v after %d calls, want %v after 1", err, calls, os.ErrClosed)
+	}
+}
+
+func TestMarkInterruptedRuns(t *testing.T) {
+	uploadsDir := t.TempDir()
+	runs := []struct {
+		id, state, meta string
+		files           []string
+	}{
+		{"saved", RunStateRunning, `{"runId":"saved","summary":{"total":2}}`, []string{"upload_results_1.csv"}},
+		{"saving", RunStatePaused, `{"runId":"saving"}`, []string{"upload_results_1.csv", "failed_uploads_1.csv"}},
+		{"uploading", RunStateRunning, `{"runId":"uploading"}`, nil},
+		{"done", RunStateCompleted, `{"runId":"done","summary":{"total":2}}`, []string{"upload_results_1.csv"}},
+	}
+	for _, run := range runs {
+		runFolder := filepath.Join(uploadsDir, run.id)
+		if err := os.MkdirAll(runFolder, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(runFolder, "meta.json"), []byte(run.meta), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range run.files {
+			if err := os.WriteFile(filepath.Join(runFolder, name), []byte("Code\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeControlState(runFolder, run.state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &StockHandler{config: &config.Config{UploadsDir: uploadsDir}}
+	h.markInterruptedRuns()
+
+	want := map[string]string{
+		"saved":     RunStateCompleted,
+		"saving":    RunStateInterrupted,
+		"uploading": RunStateInterrupted,
+		"done":      RunStateCompleted,
+	}
+	for id, state := range want {
+		if got := readControlState(filepath.Join(uploadsDir, id)); got != state {
+			t.Errorf("run %s is %s, want %s", id, got, state)
+		}
+	}
+
+	if meta, err := readRunMeta(filepath.Join(uploadsDir, "saved")); err != nil || meta.FinishedAt == nil {
+		t.Errorf("completed run has no end time: %+v, %v", meta, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(uploadsDir, "saving", "*.csv")); len(files) != 0 {
+		t.Errorf("interrupted run kept partial results %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, "done", "upload_results_1.csv")); err != nil {
+		t.Errorf("results of a finished run: %v", err)
+	}
+}
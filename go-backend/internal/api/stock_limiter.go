@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Adaptive limiter tuning: the rate halves on throttling and climbs back by a
+// small fraction of the configured rate per successful request
+const (
+	limiterDecreaseFactor   = 0.5
+	limiterIncreaseFraction = 0.02
+	limiterMinFraction      = 0.05
+	limiterDecreaseCooldown = time.Second
+	maxRetryAfter           = 5 * time.Minute
+)
+
+// adaptiveLimiter spaces out the requests of all workers of a run. It starts
+// at the configured rate, backs off multiplicatively on 429 and 5xx responses,
+// honours Retry-After, and ramps back up additively on success.
+type adaptiveLimiter struct {
+	mu           sync.Mutex
+	rate         float64 // current requests per second
+	maxRate      float64
+	minRate      float64
+	next         time.Time // earliest start of the next request
+	lastDecrease time.Time
+}
+
+// newAdaptiveLimiter creates a limiter running at maxRate requests per second
+func newAdaptiveLimiter(maxRate float64) *adaptiveLimiter {
+	return &adaptiveLimiter{
+		rate:    maxRate,
+		maxRate: maxRate,
+		minRate: maxRate * limiterMinFraction,
+	}
+}
+
+// Wait blocks until the caller may send its next request, or ctx is done
+func (l *adaptiveLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(float64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	if !sleepContext(ctx, time.Until(start)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// sleepContext sleeps for d and reports false if ctx was done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Throttled lowers the rate after a 429 or 5xx. A positive pause holds back
+// every worker until it has passed. Concurrent failures within the cooldown
+// only lower the rate once.
+func (l *adaptiveLimiter) Throttled(pause time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastDecrease) >= limiterDecreaseCooldown {
+		l.rate *= limiterDecreaseFactor
+		if l.rate < l.minRate {
+			l.rate = l.minRate
+		}
+		l.lastDecrease = now
+	}
+
+	if resume := now.Add(pause); resume.After(l.next) {
+		l.next = resume
+	}
+}
+
+// Succeeded raises the rate slowly back towards the configured maximum
+func (l *adaptiveLimiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate += l.maxRate * limiterIncreaseFraction
+	if l.rate > l.maxRate {
+		l.rate = l.maxRate
+	}
+}
+
+// Rate returns the current requests per second
+func (l *adaptiveLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+// It returns 0 when the header is missing or invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/utils"
+)
+
+// offerSettings decide which offer and commission each row is uploaded with
+type offerSettings struct {
+	multi      bool   // rows carry their own offer_id and, optionally, rzp_commission
+	offerID    string // offer of single-offer runs
+	clientName string
+	commission string                    // commission input of the run, the default for rows without one
+	clients    map[string]*config.Client // offers rows may name in multi-offer runs, by offer_id
+}
+
+// newOfferSettings builds the offer settings of an upload. Multi-offer runs
+// take the offers rows may name from clients.
+func newOfferSettings(multi bool, clientData interface{}, commission string, clients []config.Client) offerSettings {
+	clientName, offerID := clientFields(clientData)
+	settings := offerSettings{
+		multi:      multi,
+		offerID:    offerID,
+		clientName: clientName,
+		commission: commission,
+	}
+	if multi {
+		settings.clients = make(map[string]*config.Client, len(clients))
+		for i := range clients {
+			settings.clients[clients[i].OfferID] = &clients[i]
+		}
+	}
+	return settings
+}
+
+// offerIDs lists the offers the rows of a run can be uploaded to
+func (s offerSettings) offerIDs() []string {
+	if !s.multi {
+		return []string{s.offerID}
+	}
+	offerIDs := make([]string, 0, len(s.clients))
+	for offerID := range s.clients {
+		offerIDs = append(offerIDs, offerID)
+	}
+	return offerIDs
+}
+
+// parseMultiOffer reads the multiOffer form field
+func parseMultiOffer(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// rowOffer is the offer and commission a row is uploaded with
+type rowOffer struct {
+	offerID         string
+	clientName      string
+	commission      int    // hundredths of a percent
+	commissionInput string // as given, for logs and results
+}
+
+// offerResolver works out the offer of each row, and the validation rules
+// that apply to it
+type offerResolver struct {
+	settings  offerSettings
+	rules     *rowRules            // rules of single-offer runs
+	offerRule map[string]*rowRules // rules of each offer of multi-offer runs
+	checkedAt time.Time
+
+	runCommission      int  // the commission of the run, in hundredths of a percent
+	runCommissionValid bool // false when the run has no usable commission
+}
+
+// newOfferResolver prepares the offers of a file. rules are the selected
+// client's, used by single-offer runs; multi-offer runs use the rules of the
+// client each row names.
+func newOfferResolver(settings offerSettings, rules *config.ValidationRules, checkedAt time.Time) (*offerResolver, error) {
+	resolver := &offerResolver{
+		settings:  settings,
+		checkedAt: checkedAt,
+		offerRule: make(map[string]*rowRules),
+	}
+
+	var err error
+	if resolver.rules, err = newRowRules(rules, checkedAt); err != nil {
+		return nil, err
+	}
+	if settings.commission != "" {
+		resolver.runCommission, err = parseCommission(settings.commission)
+		resolver.runCommissionValid = err == nil
+	}
+	return resolver, nil
+}
+
+// resolve returns the offer of a row and the rules it must pass. A non-empty
+// reason rejects the row, value is the offending value.
+func (o *offerResolver) resolve(record []string, columnMap map[string]int) (rowOffer, *rowRules, string, string) {
+	if !o.settings.multi {
+		return rowOffer{
+			offerID:         o.settings.offerID,
+			clientName:      o.settings.clientName,
+			commission:      o.runCommission,
+			commissionInput: o.settings.commission,
+		}, o.rules, "", ""
+	}
+
+	offerID := columnValue(record, columnMap, config.FieldOfferID)
+	if offerID == "" {
+		return rowOffer{}, nil, "Missing offer_id", ""
+	}
+	client, ok := o.settings.clients[offerID]
+	if !ok {
+		return rowOffer{offerID: offerID}, nil, "Unknown offer_id, not in clients.json", offerID
+	}
+	offer := rowOffer{offerID: offerID, clientName: client.Name}
+
+	// Rows without a commission use the one given for the run
+	offer.commissionInput = columnValue(record, columnMap, config.FieldCommission)
+	if offer.commissionInput == "" {
+		if !o.runCommissionValid {
+			return offer, nil, "Missing rzp_commission", ""
+		}
+		offer.commissionInput, offer.commission = o.settings.commission, o.runCommission
+	} else {
+		commission, err := parseCommission(offer.commissionInput)
+		if err != nil {
+			return offer, nil, "Invalid rzp_commission", offer.commissionInput
+		}
+		offer.commission = commission
+	}
+
+	rules, ok := o.offerRule[offerID]
+	if !ok {
+		var err error
+		if rules, err = newRowRules(client.ValidationRules, o.checkedAt); err != nil {
+			return offer, nil, fmt.Sprintf("Invalid validation rules for offer %s", offerID), offerID
+		}
+		o.offerRule[offerID] = rules
+	}
+	return offer, rules, "", ""
+}
+
+// columnValue returns a trimmed cell of a mapped field, empty when the field
+// is not mapped or the row is short
+func columnValue(record []string, columnMap map[string]int, field string) string {
+	col, ok := columnMap[field]
+	if !ok || col >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[col])
+}
+
+// OfferBreakdown is the outcome of the rows of one offer in a run
+type OfferBreakdown struct {
+	OfferID    string `json:"offerId"`
+	ClientName string `json:"clientName"`
+	RunProgress
+}
+
+// offerCounts tallies results per offer
+type offerCounts map[string]*OfferBreakdown
+
+// add counts a result under its offer
+func (c offerCounts) add(result UploadResult) {
+	breakdown, ok := c[result.OfferID]
+	if !ok {
+		breakdown = &OfferBreakdown{OfferID: result.OfferID, ClientName: result.ClientName}
+		c[result.OfferID] = breakdown
+	}
+	breakdown.Total++
+	breakdown.add(result)
+}
+
+// list returns the breakdowns sorted by client name, then offer ID
+func (c offerCounts) list() []OfferBreakdown {
+	breakdowns := make([]OfferBreakdown, 0, len(c))
+	for _, breakdown := range c {
+		breakdowns = append(breakdowns, *breakdown)
+	}
+	sort.Slice(breakdowns, func(i, j int) bool {
+		if breakdowns[i].ClientName != breakdowns[j].ClientName {
+			return breakdowns[i].ClientName < breakdowns[j].ClientName
+		}
+		return breakdowns[i].OfferID < breakdowns[j].OfferID
+	})
+	return breakdowns
+}
+
+// historyOffers converts offer breakdowns to upload history entries
+func historyOffers(offers []OfferBreakdown) []utils.UploadHistoryOffer {
+	if len(offers) == 0 {
+		return nil
+	}
+	history := make([]utils.UploadHistoryOffer, 0, len(offers))
+	for _, offer := range offers {
+		history = append(history, utils.UploadHistoryOffer{
+			OfferID:            offer.OfferID,
+			ClientName:         offer.ClientName,
+			TotalRows:          offer.Total,
+			SuccessRows:        offer.Success,
+			FailedRows:         offer.Failed,
+			SkippedRows:        offer.Skipped,
+			AlreadyPresentRows: offer.AlreadyPresent,
+		})
+	}
+	return history
+}
+
+// offerLabel names an offer in the run log, rows without one are grouped together
+func offerLabel(offerID string) string {
+	if offerID == "" {
+		return "(none)"
+	}
+	return offerID
+}
@@ -0,0 +1,471 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// queueFile keeps the order of queued runs across restarts, in the uploads folder
+const queueFile = "queue.json"
+
+// QueueEntry is a run waiting for a free slot
+type QueueEntry struct {
+	RunID    string    `json:"runId"`
+	Env      string    `json:"env"`
+	User     string    `json:"user"`
+	FileName string    `json:"fileName"`
+	QueuedAt time.Time `json:"queuedAt"`
+	Position int       `json:"position,omitempty"` // 1-based, set when the queue is listed
+}
+
+// QueueState is the queue as shown by the API and over the WebSocket
+type QueueState struct {
+	MaxConcurrentRuns int            `json:"maxConcurrentRuns"`
+	EnvLimits         map[string]int `json:"envLimits"`
+	Running           map[string]int `json:"running"` // active runs per environment
+	Queued            []QueueEntry   `json:"queued"`
+}
+
+// uploadQueue starts upload runs in order while the total and per-environment
+// limits allow, so concurrent uploads do not multiply the load upstream. The
+// control state of a waiting run is "queued"; queue.json keeps their order.
+type uploadQueue struct {
+	mu      sync.Mutex
+	hub     *WebSocketHub
+	entries []QueueEntry
+	running map[string]string // environment of each run started by the queue
+}
+
+// newUploadQueue creates an empty queue, see StartQueue
+func newUploadQueue() *uploadQueue {
+	return &uploadQueue{running: make(map[string]string)}
+}
+
+// StartQueue loads the runs left queued by an earlier process and starts
+// what the limits allow. Runs only go through the queue once it has a hub.
+func (h *StockHandler) StartQueue(hub *WebSocketHub) {
+	envs := h.queueLimits()
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+	h.queue.hub = hub
+
+	data, err := os.ReadFile(filepath.Join(h.config.UploadsDir, queueFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &h.queue.entries); err != nil {
+			log.Printf("Failed to read the upload queue, rebuilding it from run folders: %v", err)
+		}
+	}
+
+	// Keep entries that are still queued, and add queued runs the file missed
+	listed := make(map[string]bool)
+	entries := []QueueEntry{}
+	for _, entry := range h.queue.entries {
+		if readControlState(filepath.Join(h.config.UploadsDir, entry.RunID)) == RunStateQueued && !listed[entry.RunID] {
+			listed[entry.RunID] = true
+			entries = append(entries, entry)
+		}
+	}
+	missed := []QueueEntry{}
+	runFolders, _ := os.ReadDir(h.config.UploadsDir)
+	for _, folder := range runFolders {
+		runFolder := filepath.Join(h.config.UploadsDir, folder.Name())
+		if !folder.IsDir() || listed[folder.Name()] || readControlState(runFolder) != RunStateQueued {
+			continue
+		}
+		meta, err := readRunMeta(runFolder)
+		if err != nil {
+			log.Printf("Queued run %s has no readable metadata, leaving it queued", folder.Name())
+			continue
+		}
+		missed = append(missed, newQueueEntry(meta, folderTime(runFolder)))
+	}
+	sort.SliceStable(missed, func(i, j int) bool { return missed[i].QueuedAt.Before(missed[j].QueuedAt) })
+	h.queue.entries = append(entries, missed...)
+
+	if len(h.queue.entries) > 0 {
+		log.Printf("Upload queue restored with %d waiting runs", len(h.queue.entries))
+	}
+	h.dispatchQueue(envs)
+}
+
+// newQueueEntry describes a run about to be queued
+func newQueueEntry(meta UploadMetadata, queuedAt time.Time) QueueEntry {
+	return QueueEntry{
+		RunID:    meta.RunID,
+		Env:      strings.ToUpper(meta.Env),
+		User:     meta.User,
+		FileName: meta.FileName,
+		QueuedAt: queuedAt,
+	}
+}
+
+// folderTime returns when a run folder was last changed, the zero time when unknown
+func folderTime(runFolder string) time.Time {
+	if stat, err := os.Stat(runFolder); err == nil {
+		return stat.ModTime()
+	}
+	return time.Time{}
+}
+
+// enqueueRun queues a run whose file and meta.json are in place, and starts
+// it at once if a slot is free. It returns the run's state and, while it
+// waits, its 1-based queue position.
+func (h *StockHandler) enqueueRun(meta UploadMetadata) (string, int, error) {
+	envs := h.queueLimits()
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, meta.RunID)
+	if err := writeControlState(runFolder, RunStateQueued); err != nil {
+		return "", 0, err
+	}
+	h.queue.entries = append(h.queue.entries, newQueueEntry(meta, time.Now()))
+	h.dispatchQueue(envs)
+
+	if position := h.queuePositionLocked(meta.RunID); position > 0 {
+		return RunStateQueued, position, nil
+	}
+	return h.runs.State(meta.RunID), 0, nil
+}
+
+// queueLimits loads the environments the per-environment run limits come
+// from. Loading may reach the secret store, so it is done before taking the
+// queue lock.
+func (h *StockHandler) queueLimits() config.Environments {
+	envs, err := h.config.LoadEnvironments()
+	if err != nil {
+		log.Printf("Cannot load environments for the upload queue, using default limits: %v", err)
+	}
+	return envs
+}
+
+// dispatchQueue starts queued runs, in order, while the limits allow. Runs of
+// an environment at its limit wait without holding up other environments.
+// The caller holds the queue lock and loaded envs with queueLimits.
+func (h *StockHandler) dispatchQueue(envs config.Environments) {
+	if h.queue.hub == nil {
+		return
+	}
+
+	maxTotal := h.config.MaxConcurrentRuns
+	if maxTotal < 1 {
+		maxTotal = config.DefaultMaxConcurrentRunsTotal
+	}
+
+	running := make(map[string]int)
+	for _, env := range h.queue.running {
+		running[env]++
+	}
+
+	waiting := h.queue.entries[:0]
+	for _, entry := range h.queue.entries {
+		if len(h.queue.running) >= maxTotal || running[entry.Env] >= envRunLimit(envs, entry.Env) {
+			waiting = append(waiting, entry)
+			continue
+		}
+		if h.startQueuedRun(entry) {
+			h.queue.running[entry.RunID] = entry.Env
+			running[entry.Env]++
+		}
+	}
+	h.queue.entries = waiting
+
+	h.saveQueue()
+	h.queue.hub.BroadcastQueue(h.queueStateLocked(envs))
+}
+
+// envRunLimit returns how many runs of an environment may be active at once
+func envRunLimit(envs config.Environments, env string) int {
+	if creds, ok := envs[env]; ok && creds.MaxConcurrentRuns > 0 {
+		return creds.MaxConcurrentRuns
+	}
+	return config.DefaultMaxConcurrentRuns
+}
+
+// startQueuedRun starts the upload of a queued run. Runs that cannot start
+// are marked failed and leave the queue. The caller holds the queue lock.
+func (h *StockHandler) startQueuedRun(entry QueueEntry) bool {
+	runFolder := filepath.Join(h.config.UploadsDir, entry.RunID)
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		h.failQueuedRun(entry, err)
+		writeControlState(runFolder, RunStateFailed)
+		return false
+	}
+
+	csvPath := filepath.Join(runFolder, "raw.csv")
+	active, err := h.runs.Start(entry.RunID, runFolder)
+	if errors.Is(err, ErrRunActive) {
+		// Already started another way, such as a resume, it no longer waits
+		log.Printf("Queued run %s is already active, taking it out of the queue", entry.RunID)
+		return false
+	}
+	if err != nil {
+		h.failQueuedRun(entry, err)
+		writeControlState(runFolder, RunStateFailed)
+		return false
+	}
+	if _, err := os.Stat(csvPath); err != nil {
+		h.failQueuedRun(entry, errors.New("uploaded file is missing"))
+		h.runs.Finish(active, RunStateFailed)
+		return false
+	}
+
+	hub := h.queue.hub
+	go func() {
+		h.runUploadProcess(active, csvPath, meta.Env, meta.RzpCommissionInput, meta.Client, hub)
+		h.releaseQueueSlot(entry.RunID)
+	}()
+	return true
+}
+
+// failQueuedRun records that a queued run could not start, the caller marks
+// it failed
+func (h *StockHandler) failQueuedRun(entry QueueEntry, err error) {
+	log.Printf("Cannot start queued run %s: %v", entry.RunID, err)
+	utils.LogActivity(h.config.ConfigDir, entry.User, "Queued Upload Started", entry.Env,
+		fmt.Sprintf("Run: %s, File: %s, Error: %v", entry.RunID, entry.FileName, err), "Failed")
+}
+
+// releaseQueueSlot frees the slot of a finished run and starts the next ones
+func (h *StockHandler) releaseQueueSlot(runID string) {
+	envs := h.queueLimits()
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+	delete(h.queue.running, runID)
+	h.dispatchQueue(envs)
+}
+
+// saveQueue writes the order of queued runs. The caller holds the queue lock.
+func (h *StockHandler) saveQueue() {
+	data, _ := json.MarshalIndent(h.queue.entries, "", "  ")
+	if err := os.WriteFile(filepath.Join(h.config.UploadsDir, queueFile), data, 0644); err != nil {
+		log.Printf("Failed to save the upload queue: %v", err)
+	}
+}
+
+// queueStateLocked describes the queue. The caller holds the queue lock.
+func (h *StockHandler) queueStateLocked(envs config.Environments) QueueState {
+	maxTotal := h.config.MaxConcurrentRuns
+	if maxTotal < 1 {
+		maxTotal = config.DefaultMaxConcurrentRunsTotal
+	}
+
+	state := QueueState{
+		MaxConcurrentRuns: maxTotal,
+		EnvLimits:         make(map[string]int),
+		Running:           make(map[string]int),
+		Queued:            make([]QueueEntry, len(h.queue.entries)),
+	}
+	for env := range envs {
+		state.EnvLimits[env] = envRunLimit(envs, env)
+	}
+	for _, env := range h.queue.running {
+		state.Running[env]++
+	}
+	for i, entry := range h.queue.entries {
+		entry.Position = i + 1
+		state.Queued[i] = entry
+	}
+	return state
+}
+
+// queuePosition returns the 1-based position of a queued run, 0 when it is not queued
+func (h *StockHandler) queuePosition(runID string) int {
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+	return h.queuePositionLocked(runID)
+}
+
+// queuePositionLocked is queuePosition for callers holding the queue lock
+func (h *StockHandler) queuePositionLocked(runID string) int {
+	for i, entry := range h.queue.entries {
+		if entry.RunID == runID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// errNotQueued is returned when changing a run that is not waiting in the queue
+var errNotQueued = errors.New("run is not queued")
+
+// cancelQueued takes a run out of the queue before it starts
+func (h *StockHandler) cancelQueued(runID string) error {
+	envs := h.queueLimits()
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+
+	position := h.queuePositionLocked(runID)
+	if position == 0 {
+		return errNotQueued
+	}
+	h.queue.entries = append(h.queue.entries[:position-1], h.queue.entries[position:]...)
+	if err := writeControlState(filepath.Join(h.config.UploadsDir, runID), RunStateCancelled); err != nil {
+		return err
+	}
+	h.dispatchQueue(envs)
+	return nil
+}
+
+// moveQueued moves a queued run to a 1-based position, clamped to the queue
+func (h *StockHandler) moveQueued(runID string, position int) (int, error) {
+	envs := h.queueLimits()
+	h.queue.mu.Lock()
+	defer h.queue.mu.Unlock()
+
+	current := h.queuePositionLocked(runID)
+	if current == 0 {
+		return 0, errNotQueued
+	}
+	entry := h.queue.entries[current-1]
+	entries := append(h.queue.entries[:current-1:current-1], h.queue.entries[current:]...)
+
+	if position < 1 {
+		position = 1
+	}
+	if position > len(entries)+1 {
+		position = len(entries) + 1
+	}
+	entries = append(entries[:position-1], append([]QueueEntry{entry}, entries[position-1:]...)...)
+	h.queue.entries = entries
+
+	h.dispatchQueue(envs)
+	return h.queuePositionLocked(runID), nil
+}
+
+// isAdmin reports whether a user may manage the runs of others
+func isAdmin(userClaims *middleware.UserClaims) bool {
+	return userClaims.Role == "super_admin" || userClaims.Role == "admin"
+}
+
+// GetQueue returns the limits, the active runs per environment and the queued runs
+func (h *StockHandler) GetQueue(w http.ResponseWriter, r *http.Request) {
+	envs := h.queueLimits()
+
+	h.queue.mu.Lock()
+	state := h.queueStateLocked(envs)
+	h.queue.mu.Unlock()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"queue":   state,
+	})
+}
+
+// ReprioritiseQueued moves a queued run to the position in the request body.
+// Admins only.
+func (h *StockHandler) ReprioritiseQueued(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok || !isAdmin(userClaims) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only admins can reprioritise queued runs",
+		})
+		return
+	}
+
+	var req struct {
+		Position int `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Position < 1 {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": "Invalid request body, expected a position of 1 or more",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	from := h.queuePosition(runID)
+	position, err := h.moveQueued(runID, req.Position)
+	if err != nil {
+		respondQueueError(w, h.runs.State(runID), err)
+		return
+	}
+
+	meta, _ := readRunMeta(filepath.Join(h.config.UploadsDir, runID))
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Reprioritise Queued Upload", strings.ToUpper(meta.Env),
+		fmt.Sprintf("Run: %s, File: %s, Position: %d (was %d)", runID, meta.FileName, position, from), "Success")
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"runId":    runID,
+		"position": position,
+	})
+}
+
+// CancelQueued cancels a queued run before it starts. Admins can cancel any
+// run, other users their own.
+func (h *StockHandler) CancelQueued(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	info, meta, err := h.loadRunInfo(runID)
+	if err != nil || !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+
+	if err := h.cancelQueued(runID); err != nil {
+		respondQueueError(w, info.State, err)
+		return
+	}
+
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), "Cancel Queued Upload", info.Env,
+		fmt.Sprintf("Run: %s, File: %s, User: %s", runID, meta.FileName, meta.User), "Success")
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"state":   RunStateCancelled,
+	})
+}
+
+// respondQueueError reports a failed change to a queued run
+func respondQueueError(w http.ResponseWriter, state string, err error) {
+	if errors.Is(err, errNotQueued) {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Only queued runs can be changed, run is %s", state),
+			"state":   state,
+		})
+		return
+	}
+	respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+		"success": false,
+		"message": "Cannot update run",
+	})
+}
+
+// activityUser names a user in the activity log
+func activityUser(userClaims *middleware.UserClaims) string {
+	if userClaims.Email != "" {
+		return userClaims.Email
+	}
+	return userClaims.Username
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"gc-distribution-portal/internal/config"
+)
+
+// fullExportPermission lets a user download run results with codes and PINs
+// in full, with ?full=true
+const fullExportPermission = "stock_full_export"
+
+// Keys of upstream JSON bodies that hold voucher codes and PINs
+var (
+	codeKeys = map[string]bool{"voucher_code": true, "code": true, "cardnumber": true, "card_number": true}
+	pinKeys  = map[string]bool{"pin": true, "secret": true, "cardpin": true, "card_pin": true, "voucher_pin": true}
+)
+
+// redactor masks voucher codes and PINs in run logs, live broadcasts, run
+// summaries and result downloads. Run artifacts on disk keep them in full.
+type redactor struct {
+	settings config.Redaction
+}
+
+// newRedactor creates a redactor with the configured masking
+func newRedactor(settings config.Redaction) *redactor {
+	return &redactor{settings: settings}
+}
+
+// Code masks a voucher code, leaving its last characters readable
+func (r *redactor) Code(code string) string {
+	return maskValue(code, r.settings.CodeVisibleChars)
+}
+
+// Pin masks a PIN, fully unless configured otherwise
+func (r *redactor) Pin(pin string) string {
+	return maskValue(pin, r.settings.PinVisibleChars)
+}
+
+// maskValue replaces all but the last visible characters of a value with
+// asterisks. Values no longer than visible are masked fully.
+func maskValue(value string, visible int) string {
+	runes := []rune(value)
+	if len(runes) <= visible {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-visible) + string(runes[len(runes)-visible:])
+}
+
+// Response masks an upstream response or error message. Batch responses echo
+// every voucher of the batch, so JSON bodies are masked field by field; the
+// code and PIN of the row are masked wherever they remain.
+func (r *redactor) Response(text, code, pin string) string {
+	text = rewriteJSONSecrets(text, r.Code, r.Pin)
+	if code != "" {
+		text = strings.ReplaceAll(text, code, r.Code(code))
+	}
+	if pin != "" {
+		text = strings.ReplaceAll(text, pin, r.Pin(pin))
+	}
+	return text
+}
+
+// Batch masks an upstream response or error message of a whole batch, with
+// the code and PIN of every voucher in the batch masked wherever they remain
+func (r *redactor) Batch(text string, batch []VoucherRecord) string {
+	text = rewriteJSONSecrets(text, r.Code, r.Pin)
+	for _, voucher := range batch {
+		if voucher.VoucherCode != "" {
+			text = strings.ReplaceAll(text, voucher.VoucherCode, r.Code(voucher.VoucherCode))
+		}
+		if voucher.Pin != "" {
+			text = strings.ReplaceAll(text, voucher.Pin, r.Pin(voucher.Pin))
+		}
+	}
+	return text
+}
+
+// rewriteJSONSecrets rewrites the code and PIN fields of a JSON body, text
+// that is not JSON is returned as it is
+func rewriteJSONSecrets(text string, code, pin func(string) string) string {
+	if text == "" {
+		return text
+	}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil || decoder.More() {
+		return text
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(rewriteSecretFields(body, code, pin)); err != nil {
+		return text
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// rewriteSecretFields rewrites the code and PIN fields of a decoded JSON value
+func rewriteSecretFields(value interface{}, code, pin func(string) string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			text, isText := field.(string)
+			switch {
+			case isText && codeKeys[strings.ToLower(key)]:
+				v[key] = code(text)
+			case isText && pinKeys[strings.ToLower(key)]:
+				v[key] = pin(text)
+			default:
+				v[key] = rewriteSecretFields(field, code, pin)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = rewriteSecretFields(item, code, pin)
+		}
+	}
+	return value
+}
+
+// secretColumns are the columns of a stock file that hold the voucher code
+// and PIN, -1 when a file has none
+type secretColumns struct {
+	code int
+	pin  int
+}
+
+// findSecretColumns locates the code and PIN columns from the header row of a
+// stock or results file, or from the positions of the client's column mapping
+func findSecretColumns(headers []string, mapping *config.ColumnMapping) secretColumns {
+	columns := secretColumns{code: -1, pin: -1}
+	if !mapping.HasHeader() {
+		if position, ok := mapping.Positions[config.FieldVoucherCode]; ok {
+			columns.code = position - 1
+		}
+		if position, ok := mapping.Positions[config.FieldPin]; ok {
+			columns.pin = position - 1
+		}
+		return columns
+	}
+
+	var aliases map[string][]string
+	if mapping != nil {
+		aliases = mapping.Aliases
+	}
+	columnMap := detectColumns(headers, aliases)
+	if column, ok := columnMap[config.FieldVoucherCode]; ok {
+		columns.code = column
+	}
+	if column, ok := columnMap[config.FieldPin]; ok {
+		columns.pin = column
+	}
+	return columns
+}
+
+// cell returns a column of a record, "" when the record is too short
+func (c secretColumns) cell(record []string, column int) string {
+	if column < 0 || column >= len(record) {
+		return ""
+	}
+	return record[column]
+}
+
+// Row returns a copy of a record with its code and PIN masked
+func (r *redactor) Row(record []string, columns secretColumns) []string {
+	masked := append([]string{}, record...)
+	if code := columns.cell(record, columns.code); code != "" {
+		masked[columns.code] = r.Code(code)
+	}
+	if pin := columns.cell(record, columns.pin); pin != "" {
+		masked[columns.pin] = r.Pin(pin)
+	}
+	return masked
+}
+
+// Result returns a copy of an upload result with codes and PINs masked, for
+// run summaries
+func (r *redactor) Result(result UploadResult, columns secretColumns) UploadResult {
+	pin := columns.cell(result.OriginalRow, columns.pin)
+	result.APIResponse = r.Response(result.APIResponse, result.VoucherCode, pin)
+	result.ErrorMessage = r.Response(result.ErrorMessage, result.VoucherCode, pin)
+	result.OriginalRow = r.Row(result.OriginalRow, columns)
+	result.VoucherCode = r.Code(result.VoucherCode)
+	return result
+}
+
+// Rejection describes why a row was rejected, like ValidationRow.rejection,
+// with the voucher code masked when it is the offending value
+func (r *redactor) Rejection(row ValidationRow) string {
+	if row.rejectedValue != "" && row.rejectedValue == row.VoucherCode {
+		row.rejectedValue = r.Code(row.rejectedValue)
+	}
+	return row.rejection()
+}
+
+// CopyResultsCSV copies a results CSV with the code and PIN columns masked,
+// along with the codes and PINs echoed in the api_response column
+func (r *redactor) CopyResultsCSV(dst io.Writer, src io.Reader, mapping *config.ColumnMapping) error {
+	reader := csv.NewReader(src)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(dst)
+
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+
+	columns := findSecretColumns(headers, mapping)
+	responseColumn := -1
+	for i, header := range headers {
+		if header == "api_response" {
+			responseColumn = i
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		masked := r.Row(record, columns)
+		if response := columns.cell(record, responseColumn); response != "" {
+			masked[responseColumn] = r.Response(response, columns.cell(record, columns.code), columns.cell(record, columns.pin))
+		}
+		if err := writer.Write(masked); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
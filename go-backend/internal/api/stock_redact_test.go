@@ -0,0 +1,266 @@
+package api
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gc-distribution-portal/internal/config"
+)
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		visible int
+		want    string
+	}{
+		{"ABCD1234EFGH", 4, "********EFGH"},
+		{"ABCD1234EFGH", 0, "************"},
+		{"1234", 4, "****"},
+		{"123", 4, "***"},
+		{"", 4, ""},
+		{"कोड12345", 2, "******45"},
+	}
+	for _, tt := range tests {
+		if got := maskValue(tt.value, tt.visible); got != tt.want {
+			t.Errorf("maskValue(%q, %d) = %q, want %q", tt.value, tt.visible, got, tt.want)
+		}
+	}
+}
+
+func TestRedactorSettings(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+	if got := r.Code("GIFT00001234"); got != "********1234" {
+		t.Errorf("Code = %q, want the last 4 characters readable", got)
+	}
+	if got := r.Pin("987654"); got != "******" {
+		t.Errorf("Pin = %q, want it masked fully", got)
+	}
+
+	r = newRedactor(config.Redaction{PinVisibleChars: 2})
+	if got := r.Code("GIFT00001234"); got != "************" {
+		t.Errorf("Code = %q, want it masked fully", got)
+	}
+	if got := r.Pin("987654"); got != "****54" {
+		t.Errorf("Pin = %q, want the last 2 characters readable", got)
+	}
+}
+
+func TestRedactorResponse(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+
+	tests := []struct {
+		name      string
+		text      string
+		code, pin string
+		want      string
+	}{
+		{
+			name: "JSON fields of the row",
+			text: `{"voucher_code":"GIFT00001111","pin":"123456","status":"ok"}`,
+			code: "GIFT00001111", pin: "123456",
+			want: `{"pin":"******","status":"ok","voucher_code":"********1111"}`,
+		},
+		{
+			name: "JSON fields of other vouchers in the batch",
+			text: `{"data":[{"Code":"GIFT00002222","Secret":"654321"},{"card_number":"GIFT00003333","card_pin":"111111"}],"total":2}`,
+			want: `{"data":[{"Code":"********2222","Secret":"******"},{"card_number":"********3333","card_pin":"******"}],"total":2}`,
+		},
+		{
+			name: "numbers and markup kept as sent",
+			text: `{"amount":10000.50,"message":"<b>stored</b>","voucher_pin":"33"}`,
+			want: `{"amount":10000.50,"message":"<b>stored</b>","voucher_pin":"**"}`,
+		},
+		{
+			name: "non-string code field",
+			text: `{"code":409,"message":"GIFT00001111 exists"}`,
+			code: "GIFT00001111",
+			want: `{"code":409,"message":"********1111 exists"}`,
+		},
+		{
+			name: "plain text",
+			text: "voucher GIFT00001111 with pin 123456 already redeemed",
+			code: "GIFT00001111", pin: "123456",
+			want: "voucher ********1111 with pin ****** already redeemed",
+		},
+		{
+			name: "several JSON values are plain text",
+			text: `{"code":"GIFT00001111"} {"code":"GIFT00002222"}`,
+			code: "GIFT00001111",
+			want: `{"code":"********1111"} {"code":"GIFT00002222"}`,
+		},
+		{name: "empty", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := r.Response(tt.text, tt.code, tt.pin); got != tt.want {
+			t.Errorf("%s: Response = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactorRow(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+
+	tests := []struct {
+		name    string
+		headers []string
+		mapping *config.ColumnMapping
+		record  []string
+		want    []string
+	}{
+		{
+			name:    "header row",
+			headers: []string{"Value", "Code", "Secret", "Expiry"},
+			record:  []string{"500", "GIFT00001111", "123456", "2026-12-31"},
+			want:    []string{"500", "********1111", "******", "2026-12-31"},
+		},
+		{
+			name:    "client aliases",
+			headers: []string{"Gift Card No", "Value"},
+			mapping: &config.ColumnMapping{Aliases: map[string][]string{config.FieldVoucherCode: {"Gift Card No"}}},
+			record:  []string{"GIFT00001111", "500"},
+			want:    []string{"********1111", "500"},
+		},
+		{
+			name:    "column positions",
+			mapping: &config.ColumnMapping{Positions: map[string]int{config.FieldVoucherCode: 2, config.FieldPin: 3}},
+			record:  []string{"500", "GIFT00001111", "123456"},
+			want:    []string{"500", "********1111", "******"},
+		},
+		{
+			name:    "record shorter than the header",
+			headers: []string{"Value", "Code", "Secret"},
+			record:  []string{"500", "GIFT00001111"},
+			want:    []string{"500", "********1111"},
+		},
+		{
+			name:    "no code or PIN column",
+			headers: []string{"Value", "Expiry"},
+			record:  []string{"500", "2026-12-31"},
+			want:    []string{"500", "2026-12-31"},
+		},
+	}
+
+	for _, tt := range tests {
+		record := append([]string{}, tt.record...)
+		if got := r.Row(record, findSecretColumns(tt.headers, tt.mapping)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Row = %q, want %q", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(record, tt.record) {
+			t.Errorf("%s: Row changed the record to %q", tt.name, record)
+		}
+	}
+}
+
+func TestRedactorResult(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+	result := UploadResult{
+		RowNumber:    2,
+		VoucherCode:  "GIFT00001111",
+		OriginalRow:  []string{"GIFT00001111", "123456"},
+		ErrorMessage: "pin 123456 invalid",
+		APIResponse:  `{"code":"GIFT00001111","pin":"123456"}`,
+	}
+
+	got := r.Result(result, findSecretColumns([]string{"Code", "Secret"}, nil))
+
+	want := UploadResult{
+		RowNumber:    2,
+		VoucherCode:  "********1111",
+		OriginalRow:  []string{"********1111", "******"},
+		ErrorMessage: "pin ****** invalid",
+		APIResponse:  `{"code":"********1111","pin":"******"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Result = %+v, want %+v", got, want)
+	}
+	if result.OriginalRow[0] != "GIFT00001111" {
+		t.Errorf("Result changed the original row of the result to %q", result.OriginalRow)
+	}
+}
+
+func TestRedactorCopyResultsCSV(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+
+	src := "Code,Secret,Value,status,api_response\n" +
+		"GIFT00001111,123456,500,Success,\"{\"\"code\"\":\"\"GIFT00001111\"\"}\"\n" +
+		"GIFT00002222,654321,500,Failed,pin 654321 invalid\n" +
+		"GIFT00003333\n"
+	want := "Code,Secret,Value,status,api_response\n" +
+		"********1111,******,500,Success,\"{\"\"code\"\":\"\"********1111\"\"}\"\n" +
+		"********2222,******,500,Failed,pin ****** invalid\n" +
+		"********3333\n"
+
+	var dst bytes.Buffer
+	if err := r.CopyResultsCSV(&dst, strings.NewReader(src), nil); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != want {
+		t.Errorf("CopyResultsCSV wrote\n%s\nwant\n%s", dst.String(), want)
+	}
+
+	// Files without a header row are masked by the column positions of the client
+	positions := &config.ColumnMapping{Positions: map[string]int{config.FieldVoucherCode: 2}}
+	dst.Reset()
+	if err := r.CopyResultsCSV(&dst, strings.NewReader("500,GIFT00001111,status,api_response\n500,GIFT00002222,Success,\n"), positions); err != nil {
+		t.Fatal(err)
+	}
+	if want := "500,GIFT00001111,status,api_response\n500,********2222,Success,\n"; dst.String() != want {
+		t.Errorf("CopyResultsCSV with positions wrote\n%s\nwant\n%s", dst.String(), want)
+	}
+
+	dst.Reset()
+	if err := r.CopyResultsCSV(&dst, strings.NewReader(""), nil); err != nil || dst.Len() != 0 {
+		t.Errorf("CopyResultsCSV of an empty file = %q, %v", dst.String(), err)
+	}
+}
+
+func TestRedactorBatch(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+	batch := []VoucherRecord{
+		{VoucherCode: "GIFT00001111", Pin: "123456"},
+		{VoucherCode: "GIFT00002222", Pin: "654321"},
+		{VoucherCode: "GIFT00003333"},
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{
+			text: `{"errors":[{"code":"GIFT00001111"},{"message":"GIFT00002222 expired","pin":"654321"}]}`,
+			want: `{"errors":[{"code":"********1111"},{"message":"********2222 expired","pin":"******"}]}`,
+		},
+		{
+			text: "duplicates: GIFT00002222, GIFT00003333 (pin 123456)",
+			want: "duplicates: ********2222, ********3333 (pin ******)",
+		},
+		{text: "502 Bad Gateway", want: "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		if got := r.Batch(tt.text, batch); got != tt.want {
+			t.Errorf("Batch(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRedactorRejection(t *testing.T) {
+	r := newRedactor(config.Redaction{CodeVisibleChars: 4})
+	row := ValidationRow{VoucherCode: "GIFT00001111", Amount: "1111"}
+
+	tests := []struct {
+		reason, value string
+		want          string
+	}{
+		{"PIN missing", "GIFT00001111", "PIN missing: ********1111"},
+		{"Invalid amount: not a number", "1111", "Invalid amount: not a number: 1111"},
+		{"Missing offer_id", "", "Missing offer_id"},
+	}
+	for _, tt := range tests {
+		if got := r.Rejection(row.rejected(tt.reason, tt.value)); got != tt.want {
+			t.Errorf("Rejection(%q, %q) = %q, want %q", tt.reason, tt.value, got, tt.want)
+		}
+	}
+}
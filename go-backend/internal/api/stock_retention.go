@@ -0,0 +1,655 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+)
+
+// Retention actions, applied to the runs whose policy has them due
+const (
+	RetentionPurgePins     = "purge_pins"
+	RetentionDeleteRaw     = "delete_raw"
+	RetentionDeleteResults = "delete_results"
+)
+
+// retentionSystemUser is the activity log user of the background retention job
+const retentionSystemUser = "system"
+
+// Run files removed by each delete action. Everything else in a run folder,
+// meta.json, control.json and procurement_batch_id.txt, is the run summary
+// and is kept.
+var (
+	retentionRawPatterns     = []string{"raw.csv", "raw.xlsx", "raw.xlsm", "raw.xls", runJournalFile, validationReportFile}
+	retentionResultsPatterns = []string{"upload_results_*.csv", "failed_uploads_*.csv", "terminal_output.log"}
+)
+
+// RunRetention records what the retention job removed from a run
+type RunRetention struct {
+	PinsPurgedAt     *time.Time `json:"pinsPurgedAt,omitempty"`
+	RawDeletedAt     *time.Time `json:"rawDeletedAt,omitempty"`
+	ResultsDeletedAt *time.Time `json:"resultsDeletedAt,omitempty"`
+}
+
+// filesRemoved reports whether the run lost the files a retry needs
+func (r *RunRetention) filesRemoved() bool {
+	return r != nil && (r.PinsPurgedAt != nil || r.RawDeletedAt != nil)
+}
+
+// RetentionRunAction is what the retention job does, or would do, to a run
+type RetentionRunAction struct {
+	RunID   string   `json:"runId"`
+	Env     string   `json:"env"`
+	AgeDays int      `json:"ageDays"`
+	Actions []string `json:"actions"`
+	Files   []string `json:"files"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// RetentionReport lists the runs a retention pass touched, or would touch on
+// a dry run
+type RetentionReport struct {
+	DryRun                bool                 `json:"dryRun"`
+	CheckedAt             time.Time            `json:"checkedAt"`
+	Runs                  []RetentionRunAction `json:"runs"`
+	ProcurementLogLines   int                  `json:"procurementLogLines"`
+	ProcurementLogRemoved int                  `json:"procurementLogRemoved"`
+}
+
+// StartRetention runs the retention job in the background, right away and
+// then every interval_hours of retention.json
+func (h *StockHandler) StartRetention() {
+	go func() {
+		for {
+			interval := config.DefaultRetentionIntervalHours
+			report, err := h.applyRetention(retentionSystemUser, false)
+			if err != nil {
+				log.Printf("Retention job failed: %v", err)
+			} else if len(report.Runs) > 0 || report.ProcurementLogRemoved > 0 {
+				log.Printf("Retention job purged files of %d runs and %d procurement log lines", len(report.Runs), report.ProcurementLogRemoved)
+			}
+			if retention, err := h.config.LoadRetention(); err == nil {
+				interval = retention.IntervalHours
+			}
+			time.Sleep(time.Duration(interval) * time.Hour)
+		}
+	}()
+}
+
+// applyRetention applies the retention policies to every finished run and
+// caps the procurement log. A dry run only reports what would be removed.
+// Each purge is recorded in the activity log under user.
+func (h *StockHandler) applyRetention(user string, dryRun bool) (*RetentionReport, error) {
+	h.retentionMutex.Lock()
+	defer h.retentionMutex.Unlock()
+
+	retention, err := h.config.LoadRetention()
+	if err != nil {
+		return nil, err
+	}
+	report := &RetentionReport{DryRun: dryRun, CheckedAt: time.Now(), Runs: []RetentionRunAction{}}
+
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, folder := range runFolders {
+		if !folder.IsDir() {
+			continue
+		}
+		action, ok := h.planRetention(folder.Name(), retention, report.CheckedAt)
+		if !ok {
+			continue
+		}
+		if !dryRun {
+			h.purgeRun(&action, user, report.CheckedAt)
+		}
+		report.Runs = append(report.Runs, action)
+	}
+
+	report.ProcurementLogLines, report.ProcurementLogRemoved, err = h.trimProcurementLog(retention.ProcurementLogMaxLines, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun && report.ProcurementLogRemoved > 0 {
+		utils.LogActivity(h.config.ConfigDir, user, "Retention Purge", "",
+			fmt.Sprintf("Procurement log: removed %d oldest lines, kept %d", report.ProcurementLogRemoved, report.ProcurementLogLines), "Success")
+	}
+	return report, nil
+}
+
+// planRetention returns the actions due on a run with the files they remove.
+// Only finished runs are purged; runs that can still start or be resumed are
+// left alone.
+func (h *StockHandler) planRetention(runID string, retention *config.Retention, now time.Time) (RetentionRunAction, bool) {
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if !isFinishedState(readControlState(runFolder)) || h.runs.Get(runID) != nil {
+		return RetentionRunAction{}, false
+	}
+
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return RetentionRunAction{}, false
+	}
+	policy := retention.PolicyFor(meta.Env)
+	if policy.IsZero() {
+		return RetentionRunAction{}, false
+	}
+
+	// Age counts from the end of the run, or its creation for runs that never started
+	finishedAt := meta.FinishedAt
+	if finishedAt == nil {
+		finishedAt = meta.CreatedAt
+	}
+	if finishedAt == nil {
+		finishedAt = runIDTime(runID)
+	}
+	if finishedAt == nil {
+		info, err := os.Stat(filepath.Join(runFolder, "meta.json"))
+		if err != nil {
+			return RetentionRunAction{}, false
+		}
+		modifiedAt := info.ModTime()
+		finishedAt = &modifiedAt
+	}
+	ageDays := int(now.Sub(*finishedAt).Hours() / 24)
+	due := func(days int) bool {
+		return days > 0 && ageDays >= days
+	}
+
+	action := RetentionRunAction{RunID: runID, Env: meta.Env, AgeDays: ageDays, Actions: []string{}, Files: []string{}}
+	removed := make(map[string]bool)
+	addFiles := func(name string, patterns []string) {
+		files := runFiles(runFolder, meta.Archive, patterns)
+		if len(files) == 0 {
+			return
+		}
+		action.Actions = append(action.Actions, name)
+		for _, file := range files {
+			removed[file] = true
+			action.Files = append(action.Files, file)
+		}
+	}
+
+	if due(policy.DeleteResultsAfterDays) {
+		addFiles(RetentionDeleteResults, retentionResultsPatterns)
+	}
+	if due(policy.DeleteRawAfterDays) {
+		addFiles(RetentionDeleteRaw, retentionRawPatterns)
+	}
+	if due(policy.PurgePinsAfterDays) && (meta.Retention == nil || meta.Retention.PinsPurgedAt == nil) {
+		// Files about to be deleted need no purging
+		var files []string
+		for _, file := range runFiles(runFolder, meta.Archive, append(append([]string{}, retentionRawPatterns...), retentionResultsPatterns...)) {
+			if !removed[file] {
+				files = append(files, file)
+			}
+		}
+		if len(files) > 0 {
+			action.Actions = append(action.Actions, RetentionPurgePins)
+			action.Files = append(action.Files, files...)
+		}
+	}
+
+	return action, len(action.Actions) > 0
+}
+
+// runFiles returns the names of the run files matching patterns, in the run
+// folder or only kept in the archive
+func runFiles(runFolder string, archive *RunArchive, patterns []string) []string {
+	files := matchRunFiles(runFolder, patterns)
+	if archive == nil {
+		return files
+	}
+	local := make(map[string]bool, len(files))
+	for _, file := range files {
+		local[file] = true
+	}
+	for _, file := range archive.Files {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, file.Name); matched && !local[file.Name] {
+				local[file.Name] = true
+				files = append(files, file.Name)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// matchRunFiles returns the names of the run files matching patterns
+func matchRunFiles(runFolder string, patterns []string) []string {
+	var files []string
+	for _, pattern := range patterns {
+		paths, _ := filepath.Glob(filepath.Join(runFolder, pattern))
+		for _, path := range paths {
+			files = append(files, filepath.Base(path))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// purgeRun applies the planned actions to a run, records them in its meta.json
+// and in the activity log. Archived copies of the run files are purged too.
+func (h *StockHandler) purgeRun(action *RetentionRunAction, user string, now time.Time) {
+	runFolder := filepath.Join(h.config.UploadsDir, action.RunID)
+	deletes := map[string][]string{
+		RetentionDeleteResults: retentionResultsPatterns,
+		RetentionDeleteRaw:     retentionRawPatterns,
+	}
+
+	var done []string
+	var purgeErr error
+	archiveErr := h.withArchivedFiles(action.RunID, func() error {
+		for _, name := range action.Actions {
+			var err error
+			if name == RetentionPurgePins {
+				err = h.purgeRunPins(runFolder)
+			} else {
+				for _, file := range matchRunFiles(runFolder, deletes[name]) {
+					if removeErr := os.Remove(filepath.Join(runFolder, file)); removeErr != nil && !os.IsNotExist(removeErr) {
+						err = removeErr
+					}
+				}
+			}
+			if err != nil {
+				purgeErr = fmt.Errorf("%s: %v", name, err)
+				return nil
+			}
+			done = append(done, name)
+		}
+		return nil
+	})
+	if archiveErr != nil {
+		// Left for the next pass, purging again is harmless
+		done = nil
+		if purgeErr == nil {
+			purgeErr = fmt.Errorf("archive: %v", archiveErr)
+		}
+	}
+
+	updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		if meta.Retention == nil {
+			meta.Retention = &RunRetention{}
+		}
+		for _, name := range done {
+			switch name {
+			case RetentionPurgePins:
+				meta.Retention.PinsPurgedAt = &now
+			case RetentionDeleteRaw:
+				meta.Retention.RawDeletedAt = &now
+			case RetentionDeleteResults:
+				meta.Retention.ResultsDeletedAt = &now
+			}
+		}
+	})
+
+	status := "Success"
+	details := fmt.Sprintf("Run: %s, Age: %d days, Actions: %s, Files: %s", action.RunID, action.AgeDays, strings.Join(action.Actions, ", "), strings.Join(action.Files, ", "))
+	if purgeErr != nil {
+		action.Error = purgeErr.Error()
+		status = "Failed"
+		details += ", Error: " + action.Error
+	}
+	utils.LogActivity(h.config.ConfigDir, user, "Retention Purge", action.Env, details, status)
+}
+
+// purgeRunPins blanks the PINs of a run's files. The uploaded workbook is
+// deleted, raw.csv holds the same rows. The run log and validation report
+// are deleted too: those of runs from before codes and PINs were masked hold
+// them in full. Retries of the run are refused from then on, the rows could
+// no longer be sent with their PINs.
+func (h *StockHandler) purgeRunPins(runFolder string) error {
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return err
+	}
+	mapping := meta.ColumnMapping
+
+	for _, file := range matchRunFiles(runFolder, []string{"raw.xlsx", "raw.xlsm", "raw.xls", "terminal_output.log", validationReportFile}) {
+		if err := os.Remove(filepath.Join(runFolder, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Results CSVs start with the columns of the uploaded file
+	pinColumn := -1
+	for _, file := range matchRunFiles(runFolder, []string{"upload_results_*.csv", "failed_uploads_*.csv"}) {
+		path := filepath.Join(runFolder, file)
+		err := h.rewriteCSV(path, 0, func(headers []string) func([]string) []string {
+			pinColumn = findSecretColumns(headers, mapping).pin
+			responseColumn := -1
+			for i, header := range headers {
+				if header == "api_response" {
+					responseColumn = i
+				}
+			}
+			return func(record []string) []string {
+				pin := purgeCell(record, pinColumn)
+				if responseColumn >= 0 && responseColumn < len(record) {
+					record[responseColumn] = purgePins(record[responseColumn], pin)
+				}
+				return record
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	skipRows := 0
+	if mapping != nil {
+		skipRows = mapping.SkipRows
+	}
+	rawPath := filepath.Join(runFolder, "raw.csv")
+	err = h.rewriteCSV(rawPath, skipRows, func(headers []string) func([]string) []string {
+		pinColumn = findSecretColumns(headers, mapping).pin
+		if !mapping.HasHeader() {
+			purgeCell(headers, pinColumn) // the first row is data
+		}
+		return func(record []string) []string {
+			purgeCell(record, pinColumn)
+			return record
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return h.purgeJournalPins(runFolder, pinColumn)
+}
+
+// purgeCell blanks a column of a record and returns what it held
+func purgeCell(record []string, column int) string {
+	if column < 0 || column >= len(record) {
+		return ""
+	}
+	value := record[column]
+	record[column] = ""
+	return value
+}
+
+// purgePins blanks the PIN fields of an upstream response and the row's PIN
+// wherever it remains. Codes are kept.
+func purgePins(text, pin string) string {
+	keep := func(value string) string { return value }
+	blank := func(string) string { return "" }
+	text = rewriteJSONSecrets(text, keep, blank)
+	if pin != "" {
+		text = strings.ReplaceAll(text, pin, "")
+	}
+	return text
+}
+
+// rewriteCSV rewrites a run CSV through a temporary file. The first skipLines
+// lines are banners and are copied as they are; rowFunc gets the first row
+// read as CSV and returns the function applied to every later row.
+func (h *StockHandler) rewriteCSV(path string, skipLines int, rowFunc func(first []string) func([]string) []string) error {
+	src, err := h.artifacts.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".retention"
+	dst, err := h.artifacts.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // gone already once renamed
+
+	err = copyCSV(dst, src, skipLines, rowFunc)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// copyCSV copies banner lines, then rewrites the CSV rows that follow
+func copyCSV(dst io.Writer, src io.Reader, skipLines int, rowFunc func(first []string) func([]string) []string) error {
+	buffered := bufio.NewReader(src)
+	for i := 0; i < skipLines; i++ {
+		line, err := buffered.ReadString('\n')
+		if _, writeErr := io.WriteString(dst, line); writeErr != nil {
+			return writeErr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(dst)
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rewrite := rowFunc(first)
+	if err := writer.Write(first); err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(rewrite(record)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// purgeJournalPins rewrites the run journal without PINs. Lines cut short by
+// a crash are dropped.
+func (h *StockHandler) purgeJournalPins(runFolder string, pinColumn int) error {
+	path := filepath.Join(runFolder, runJournalFile)
+	src, err := h.artifacts.OpenRecordReader(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".retention"
+	os.Remove(tmpPath) // left by an earlier pass that failed
+	dst, err := h.artifacts.OpenRecordWriter(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // gone already once renamed
+
+	var buf bytes.Buffer
+	reader := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if record, ok := src.Record(line); ok {
+			var result UploadResult
+			if json.Unmarshal(record, &result) == nil {
+				pin := purgeCell(result.OriginalRow, pinColumn)
+				result.APIResponse = purgePins(result.APIResponse, pin)
+				result.ErrorMessage = purgePins(result.ErrorMessage, pin)
+				data, _ := json.Marshal(result)
+				buf.Write(dst.Seal(data))
+				buf.WriteByte('\n')
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+
+	_, err = dst.Write(buf.Bytes())
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// appendProcurementLog adds a procurement batch ID to the global procurement
+// log, which the retention job caps
+func (h *StockHandler) appendProcurementLog(procID, fileName string) {
+	h.procLogMutex.Lock()
+	defer h.procLogMutex.Unlock()
+
+	f, _ := os.OpenFile(h.config.ProcIDFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if f != nil {
+		f.WriteString(fmt.Sprintf("%s %s\n", procID, fileName))
+		f.Close()
+	}
+}
+
+// trimProcurementLog drops the oldest lines of the procurement log beyond
+// maxLines, 0 keeping every line. It returns the lines kept and removed.
+func (h *StockHandler) trimProcurementLog(maxLines int, dryRun bool) (int, int, error) {
+	h.procLogMutex.Lock()
+	defer h.procLogMutex.Unlock()
+
+	data, err := os.ReadFile(h.config.ProcIDFile)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if maxLines == 0 || len(lines) <= maxLines {
+		return len(lines), 0, nil
+	}
+
+	removed := len(lines) - maxLines
+	if dryRun {
+		return maxLines, removed, nil
+	}
+	tmpPath := h.config.ProcIDFile + ".retention"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines[removed:], "")), 0644); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmpPath, h.config.ProcIDFile); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, err
+	}
+	return maxLines, removed, nil
+}
+
+// GetRetention returns the retention policies and a dry run of the retention
+// job: the runs and files it would purge now (admin only)
+func (h *StockHandler) GetRetention(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+	if !isAdmin(userClaims) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only admins can view the retention policy",
+		})
+		return
+	}
+
+	retention, err := h.config.LoadRetention()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Cannot read retention policy: %v", err),
+		})
+		return
+	}
+	report, err := h.applyRetention(activityUser(userClaims), true)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Retention dry run failed: %v", err),
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"policy":  retention,
+		"report":  report,
+	})
+}
+
+// TriggerRetention runs the retention job now (admin only)
+func (h *StockHandler) TriggerRetention(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+	if !isAdmin(userClaims) {
+		respondJSON(w, http.StatusForbidden, map[string]interface{}{
+			"success": false,
+			"message": "Only admins can run the retention job",
+		})
+		return
+	}
+
+	report, err := h.applyRetention(activityUser(userClaims), false)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Retention job failed: %v", err),
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Purged files of %d runs", len(report.Runs)),
+		"report":  report,
+	})
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gc-distribution-portal/internal/artifact"
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// failedRowNumbers returns, in order, the rows of a run whose last journaled
+// attempt did not succeed. Rows rejected by parsing or the client's rules
+// would only be rejected again, and skipped duplicates and vouchers upstream
+// already had are not failures.
+func (h *StockHandler) failedRowNumbers(runFolder string) ([]int, error) {
+	rows := []int{}
+	err := h.forEachJournalResult(runFolder, func(result UploadResult) error {
+		if !result.Success && !result.Skipped && !result.AlreadyPresent && !result.Rejected {
+			rows = append(rows, result.RowNumber)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// copyFile copies the run artifact src to dst, encrypting the copy with its
+// own data key
+func copyFile(keys *artifact.Keyring, src, dst string) error {
+	in, err := keys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := keys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// RetryFailed starts a child run that reprocesses only the failed rows of a
+// finished run, with the same env, client and commission. Admins can retry
+// any run, other users their own.
+func (h *StockHandler) RetryFailed(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	var req struct {
+		NewProcurementBatchID bool `json:"newProcurementBatchId"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": "Invalid request body",
+			})
+			return
+		}
+	}
+
+	parentID := filepath.Base(mux.Vars(r)["runId"])
+	parentFolder := filepath.Join(h.config.UploadsDir, parentID)
+
+	parentInfo, parentMeta, err := h.loadRunInfo(parentID)
+	if err != nil || !canViewRun(userClaims, parentInfo) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+
+	// Runs from before control states were finalised only have their result CSVs to go by
+	resultFiles, _ := filepath.Glob(filepath.Join(parentFolder, "upload_results_*.csv"))
+	if state := h.runs.State(parentID); state != RunStateCompleted && state != RunStateStopped && len(resultFiles) == 0 {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Only finished runs can be retried, run is %s", state),
+			"state":   state,
+		})
+		return
+	}
+
+	if parentMeta.Retention.filesRemoved() {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": "Run files were purged by the retention policy, it can no longer be retried",
+		})
+		return
+	}
+
+	// The journal and file of a pruned run come back from the archive
+	if err := h.restoreArchivedRun(parentID); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Cannot restore the archived files of the run: %v", err),
+		})
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(parentFolder, runJournalFile)); os.IsNotExist(err) {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": "Run has no results journal, upload its failed_uploads CSV instead",
+		})
+		return
+	}
+
+	failedRows, err := h.failedRowNumbers(parentFolder)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Cannot read run journal",
+		})
+		return
+	}
+	if len(failedRows) == 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": "Run has no failed rows to retry",
+		})
+		return
+	}
+
+	// Create the child run folder next to its parent
+	timestamp := time.Now().Format("2006-01-02T15-04-05")
+	fileName := strings.TrimSuffix(parentMeta.FileName, filepath.Ext(parentMeta.FileName))
+	runID := fmt.Sprintf("%s_retry_%s", fileName, timestamp)
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+
+	// A retry started in the same second would share the folder
+	err = os.Mkdir(runFolder, 0755)
+	if os.IsExist(err) {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": "A retry of this run was just started, try again in a moment",
+		})
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to create run folder",
+		})
+		return
+	}
+
+	// The child parses the parent's file so row numbers line up
+	csvPath := filepath.Join(runFolder, "raw.csv")
+	if err := copyFile(h.artifacts, filepath.Join(parentFolder, "raw.csv"), csvPath); err != nil {
+		os.RemoveAll(runFolder)
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to copy the file of the parent run",
+		})
+		return
+	}
+
+	createdAt := time.Now()
+	user := activityUser(userClaims)
+
+	meta := UploadMetadata{
+		RunID:              runID,
+		FileName:           parentMeta.FileName,
+		User:               user,
+		Env:                parentMeta.Env,
+		Client:             parentMeta.Client,
+		AmountType:         parentMeta.AmountType,
+		RzpCommissionInput: parentMeta.RzpCommissionInput,
+		DuplicatePolicy:    parentMeta.DuplicatePolicy,
+		ParentRunID:        parentID,
+		RowFilter:          failedRows,
+		CreatedAt:          &createdAt,
+		ColumnMapping:      parentMeta.ColumnMapping,
+		DateParsing:        parentMeta.DateParsing,
+		ValidationRules:    parentMeta.ValidationRules,
+		MultiOffer:         parentMeta.MultiOffer,
+		OfferClients:       parentMeta.OfferClients,
+	}
+	metaData, _ := json.MarshalIndent(meta, "", "  ")
+	os.WriteFile(filepath.Join(runFolder, "meta.json"), metaData, 0644)
+
+	// Reuse the parent's procurement batch ID unless a new one was asked for. A
+	// new ID goes to the procurement log once the run is submitted.
+	procIDBytes, _ := os.ReadFile(filepath.Join(parentFolder, "procurement_batch_id.txt"))
+	procID := strings.TrimSpace(string(procIDBytes))
+	newProcID := req.NewProcurementBatchID || procID == ""
+	if newProcID {
+		procID = utils.GenerateRzpID()
+	}
+	os.WriteFile(filepath.Join(runFolder, "procurement_batch_id.txt"), []byte(procID), 0644)
+
+	// Retries of approved runs resend rows that were already approved, others
+	// of an environment that requires approval are reviewed like new uploads
+	needsApproval, err := h.requiresApproval(parentMeta.Env)
+	if err != nil {
+		os.RemoveAll(runFolder)
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to load environments: %v", err),
+		})
+		return
+	}
+	needsApproval = needsApproval && (parentMeta.Approval == nil || parentMeta.Approval.Status != ApprovalApproved)
+
+	var approval *RunApproval
+	if needsApproval {
+		if approval, err = h.submitForApproval(meta); err != nil {
+			os.RemoveAll(runFolder)
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Cannot validate the failed rows: %v", err),
+			})
+			return
+		}
+	}
+
+	// Link the child from its parent
+	updateRunMeta(parentFolder, func(meta *UploadMetadata) {
+		meta.ChildRunIDs = append(meta.ChildRunIDs, runID)
+	})
+
+	if needsApproval {
+		if newProcID {
+			h.appendProcurementLog(procID, parentMeta.FileName)
+		}
+		utils.LogActivity(h.config.ConfigDir, user, "Submit Upload for Approval", strings.ToUpper(parentMeta.Env),
+			fmt.Sprintf("Run: %s, Retry of: %s, Valid rows: %d/%d, Value: ₹%.2f", runID, parentID,
+				approval.ValidRows, approval.TotalRows, float64(approval.TotalValuePaise)/100), "Pending")
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success":            true,
+			"runId":              runID,
+			"runFolder":          runFolder,
+			"parentRunId":        parentID,
+			"rows":               len(failedRows),
+			"procurementBatchId": procID,
+			"state":              RunStateAwaitingApproval,
+			"approval":           approval,
+		})
+		return
+	}
+
+	state, position, err := h.enqueueRun(meta)
+	if err != nil {
+		os.RemoveAll(runFolder)
+		updateRunMeta(parentFolder, func(meta *UploadMetadata) {
+			for i, childID := range meta.ChildRunIDs {
+				if childID == runID {
+					meta.ChildRunIDs = append(meta.ChildRunIDs[:i], meta.ChildRunIDs[i+1:]...)
+					break
+				}
+			}
+		})
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Run could not be queued",
+		})
+		return
+	}
+	if newProcID {
+		h.appendProcurementLog(procID, parentMeta.FileName)
+	}
+
+	utils.LogActivity(h.config.ConfigDir, user, "Retry Failed Rows", strings.ToUpper(parentMeta.Env),
+		fmt.Sprintf("Run: %s, Child run: %s, Rows: %d", parentID, runID, len(failedRows)), "Success")
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":            true,
+		"runId":              runID,
+		"runFolder":          runFolder,
+		"parentRunId":        parentID,
+		"rows":               len(failedRows),
+		"procurementBatchId": procID,
+		"state":              state,
+		"queuePosition":      position,
+	})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"gc-distribution-portal/internal/config"
+)
+
+// rowRules applies a client's validation rules to parsed vouchers
+type rowRules struct {
+	rules         *config.ValidationRules
+	codePattern   *regexp.Regexp
+	denominations map[int]bool
+	minExpiry     int64 // earliest accepted expiry, 0 when validity is not checked
+}
+
+// newRowRules prepares the rules of a client, nil for none. Remaining
+// validity is measured from checkedAt, so every pass over a file agrees.
+func newRowRules(rules *config.ValidationRules, checkedAt time.Time) (*rowRules, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	codePattern, err := rules.CodeRegexp()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rowRules{rules: rules, codePattern: codePattern}
+	if len(rules.Denominations) > 0 {
+		r.denominations = make(map[int]bool, len(rules.Denominations))
+		for _, denomination := range rules.Denominations {
+			r.denominations[denomination] = true
+		}
+	}
+	if rules.MinValidityDays > 0 {
+		r.minExpiry = checkedAt.AddDate(0, 0, rules.MinValidityDays).Unix()
+	}
+	return r, nil
+}
+
+// check returns why a voucher breaks the rules and the offending value, or
+// an empty reason when it passes
+func (r *rowRules) check(v VoucherRecord) (string, string) {
+	if r == nil {
+		return "", ""
+	}
+
+	codeLength := utf8.RuneCountInString(v.VoucherCode)
+	if r.rules.CodeMinLength > 0 && codeLength < r.rules.CodeMinLength {
+		return fmt.Sprintf("Code shorter than %d characters", r.rules.CodeMinLength), v.VoucherCode
+	}
+	if r.rules.CodeMaxLength > 0 && codeLength > r.rules.CodeMaxLength {
+		return fmt.Sprintf("Code longer than %d characters", r.rules.CodeMaxLength), v.VoucherCode
+	}
+	if r.codePattern != nil && !r.codePattern.MatchString(v.VoucherCode) {
+		return "Code does not match the client's pattern", v.VoucherCode
+	}
+
+	if r.rules.PinRequired && v.Pin == "" {
+		return "PIN missing", v.VoucherCode
+	}
+
+	if r.denominations != nil && !r.denominations[v.Amount] {
+		return "Denomination not allowed", v.OriginalAmount
+	}
+	if r.rules.MinAmount > 0 && v.Amount < r.rules.MinAmount {
+		return fmt.Sprintf("Amount below %s", formatPaise(r.rules.MinAmount)), v.OriginalAmount
+	}
+	if r.rules.MaxAmount > 0 && v.Amount > r.rules.MaxAmount {
+		return fmt.Sprintf("Amount above %s", formatPaise(r.rules.MaxAmount)), v.OriginalAmount
+	}
+
+	if r.minExpiry > 0 && v.ExpiryDate < r.minExpiry {
+		return fmt.Sprintf("Valid for less than %d days", r.rules.MinValidityDays), v.OriginalValidity
+	}
+	return "", ""
+}
+
+// formatPaise writes an amount in paise as rupees, e.g. 49950 as "499.50"
+func formatPaise(paise int) string {
+	if paise%100 == 0 {
+		return fmt.Sprintf("%d", paise/100)
+	}
+	return fmt.Sprintf("%d.%02d", paise/100, paise%100)
+}
@@ -0,0 +1,448 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultRunsPageSize = 20
+	maxRunsPageSize     = 100
+	runLogTailLines     = 200
+)
+
+// runMetaMutex serialises read-modify-write updates of run meta.json files
+var runMetaMutex sync.Mutex
+
+// RunProgress counts the rows of a run by outcome
+type RunProgress struct {
+	Total          int `json:"total"`
+	Completed      int `json:"completed"`
+	Success        int `json:"success"`
+	Failed         int `json:"failed"`
+	Skipped        int `json:"skipped"`
+	AlreadyPresent int `json:"alreadyPresent"`
+}
+
+// RunInfo summarises a run for listings
+type RunInfo struct {
+	RunID              string           `json:"runId"`
+	FileName           string           `json:"fileName"`
+	User               string           `json:"user"`
+	Env                string           `json:"env"`
+	ClientName         string           `json:"clientName"`
+	OfferID            string           `json:"offerId"`
+	State              string           `json:"state"`
+	ParentRunID        string           `json:"parentRunId,omitempty"`
+	ProcurementBatchID string           `json:"procurementBatchId"`
+	CreatedAt          *time.Time       `json:"createdAt,omitempty"`
+	ScheduledAt        *time.Time       `json:"scheduledAt,omitempty"`
+	Approval           *RunApproval     `json:"approval,omitempty"`
+	QueuePosition      int              `json:"queuePosition,omitempty"` // 1-based, while queued
+	StartedAt          *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt         *time.Time       `json:"finishedAt,omitempty"`
+	Progress           *RunProgress     `json:"progress,omitempty"`
+	MultiOffer         bool             `json:"multiOffer,omitempty"`
+	Offers             []OfferBreakdown `json:"offers,omitempty"` // final row counts per offer
+	Retention          *RunRetention    `json:"retention,omitempty"`
+	Archive            *RunArchive      `json:"archive,omitempty"`
+
+	// Run settings, only filled in by GetRun
+	AmountType      string   `json:"amountType,omitempty"`
+	DuplicatePolicy string   `json:"duplicatePolicy,omitempty"`
+	ChildRunIDs     []string `json:"childRunIds,omitempty"`
+}
+
+// RunArtifact is a file in a run folder
+type RunArtifact struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Archived   bool      `json:"archived,omitempty"` // only kept in the archive
+}
+
+// readRunMeta reads the meta.json of a run folder
+func readRunMeta(runFolder string) (UploadMetadata, error) {
+	var meta UploadMetadata
+	data, err := os.ReadFile(filepath.Join(runFolder, "meta.json"))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// updateRunMeta applies update to the meta.json of a run folder
+func updateRunMeta(runFolder string, update func(meta *UploadMetadata)) error {
+	runMetaMutex.Lock()
+	defer runMetaMutex.Unlock()
+
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return err
+	}
+	update(&meta)
+
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	return os.WriteFile(filepath.Join(runFolder, "meta.json"), data, 0644)
+}
+
+// clientFields returns the client name and offer ID stored in run metadata
+func clientFields(client interface{}) (string, string) {
+	var name, offerID string
+	if clientMap, ok := client.(map[string]interface{}); ok {
+		name, _ = clientMap["name"].(string)
+		offerID, _ = clientMap["offer_id"].(string)
+	}
+	return name, offerID
+}
+
+// progressFromJournal counts the journaled rows of a run that is not active
+func (h *StockHandler) progressFromJournal(runFolder string) *RunProgress {
+	progress := &RunProgress{}
+	err := h.forEachJournalResult(runFolder, func(result UploadResult) error {
+		progress.add(result)
+		return nil
+	})
+	if err != nil || progress.Completed == 0 {
+		return nil
+	}
+	return progress
+}
+
+// add counts a finished row
+func (p *RunProgress) add(result UploadResult) {
+	p.Completed++
+	switch {
+	case result.Success:
+		p.Success++
+	case result.Skipped:
+		p.Skipped++
+	case result.AlreadyPresent:
+		p.AlreadyPresent++
+	default:
+		p.Failed++
+	}
+}
+
+// loadRunInfo builds the summary of a run from its folder and, when the run
+// is active, from the run manager
+func (h *StockHandler) loadRunInfo(runID string) (RunInfo, UploadMetadata, error) {
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		return RunInfo{}, meta, err
+	}
+
+	clientName, offerID := clientFields(meta.Client)
+	procID, _ := os.ReadFile(filepath.Join(runFolder, "procurement_batch_id.txt"))
+
+	info := RunInfo{
+		RunID:              runID,
+		FileName:           meta.FileName,
+		User:               meta.User,
+		Env:                strings.ToUpper(meta.Env),
+		ClientName:         clientName,
+		OfferID:            offerID,
+		State:              h.runs.State(runID),
+		ParentRunID:        meta.ParentRunID,
+		ProcurementBatchID: strings.TrimSpace(string(procID)),
+		CreatedAt:          meta.CreatedAt,
+		ScheduledAt:        meta.ScheduledAt,
+		Approval:           meta.Approval,
+		StartedAt:          meta.StartedAt,
+		FinishedAt:         meta.FinishedAt,
+		Progress:           meta.Summary,
+		MultiOffer:         meta.MultiOffer,
+		Offers:             meta.Offers,
+		Retention:          meta.Retention,
+		Archive:            meta.Archive,
+	}
+
+	// Runs from before timings were recorded fall back to the timestamp in their ID
+	if info.CreatedAt == nil {
+		info.CreatedAt = runIDTime(runID)
+	}
+
+	if active := h.runs.Get(runID); active != nil {
+		progress := active.Progress()
+		info.Progress = &progress
+	}
+	if info.State == RunStateQueued {
+		info.QueuePosition = h.queuePosition(runID)
+	}
+
+	return info, meta, nil
+}
+
+// runIDTime parses the creation time at the end of a run ID ("<file>_2006-01-02T15-04-05")
+func runIDTime(runID string) *time.Time {
+	const layout = "2006-01-02T15-04-05"
+	if len(runID) < len(layout) {
+		return nil
+	}
+	created, err := time.ParseInLocation(layout, runID[len(runID)-len(layout):], time.Local)
+	if err != nil {
+		return nil
+	}
+	return &created
+}
+
+// matchesClient reports whether a run uploaded vouchers of a client, given
+// by name or offer ID. Multi-offer runs match any of their offers.
+func matchesClient(info RunInfo, client string) bool {
+	if strings.EqualFold(info.ClientName, client) || info.OfferID == client {
+		return true
+	}
+	for _, offer := range info.Offers {
+		if strings.EqualFold(offer.ClientName, client) || offer.OfferID == client {
+			return true
+		}
+	}
+	return false
+}
+
+// canViewRun reports whether the user may see and manage a run. Admins see
+// every run, other users only the runs they started.
+func canViewRun(userClaims *middleware.UserClaims, info RunInfo) bool {
+	if isAdmin(userClaims) {
+		return true
+	}
+	return strings.EqualFold(info.User, userClaims.Email) || strings.EqualFold(info.User, userClaims.Username)
+}
+
+// ListRuns lists runs, newest first, with optional filters and pagination
+func (h *StockHandler) ListRuns(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	userFilter := query.Get("user")
+	envFilter := query.Get("env")
+	clientFilter := query.Get("client")
+	stateFilter := query.Get("state")
+
+	var from, to time.Time
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": "Invalid from date, expected YYYY-MM-DD",
+			})
+			return
+		}
+		from = parsed
+	}
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": "Invalid to date, expected YYYY-MM-DD",
+			})
+			return
+		}
+		to = parsed.AddDate(0, 0, 1) // inclusive
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	if pageSize < 1 {
+		pageSize = defaultRunsPageSize
+	}
+	if pageSize > maxRunsPageSize {
+		pageSize = maxRunsPageSize
+	}
+
+	folders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to read runs",
+		})
+		return
+	}
+
+	runs := []RunInfo{}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+
+		info, _, err := h.loadRunInfo(folder.Name())
+		if err != nil || !canViewRun(userClaims, info) {
+			continue
+		}
+
+		if userFilter != "" && !strings.EqualFold(info.User, userFilter) {
+			continue
+		}
+		if envFilter != "" && !strings.EqualFold(info.Env, envFilter) {
+			continue
+		}
+		if clientFilter != "" && !matchesClient(info, clientFilter) {
+			continue
+		}
+		if stateFilter != "" && info.State != stateFilter {
+			continue
+		}
+		if info.CreatedAt != nil {
+			if !from.IsZero() && info.CreatedAt.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !info.CreatedAt.Before(to) {
+				continue
+			}
+		}
+
+		runs = append(runs, info)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].CreatedAt == nil || runs[j].CreatedAt == nil {
+			return runs[i].RunID > runs[j].RunID
+		}
+		return runs[i].CreatedAt.After(*runs[j].CreatedAt)
+	})
+
+	total := len(runs)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"runs":     runs[start:end],
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// GetRun returns the state, progress, timings and artifacts of a run, plus
+// the tail of its log so a reconnecting client can pick up an ongoing run
+func (h *StockHandler) GetRun(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+
+	info, meta, err := h.loadRunInfo(runID)
+	if err != nil || !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+	info.AmountType = meta.AmountType
+	info.DuplicatePolicy = meta.DuplicatePolicy
+	info.ChildRunIDs = meta.ChildRunIDs
+
+	// Interrupted runs have no summary yet, count what was journaled
+	if info.Progress == nil {
+		info.Progress = h.progressFromJournal(runFolder)
+	}
+
+	artifacts := []RunArtifact{}
+	local := make(map[string]bool)
+	entries, _ := os.ReadDir(runFolder)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if stat, err := entry.Info(); err == nil {
+			local[entry.Name()] = true
+			artifacts = append(artifacts, RunArtifact{
+				Name:       entry.Name(),
+				Size:       stat.Size(),
+				ModifiedAt: stat.ModTime(),
+			})
+		}
+	}
+
+	// Files pruned after archiving are listed from the archive
+	if meta.Archive != nil {
+		for _, file := range meta.Archive.Files {
+			if !local[file.Name] {
+				file.Archived = true
+				artifacts = append(artifacts, file)
+			}
+		}
+	}
+
+	logTail := readLogTail(filepath.Join(runFolder, "terminal_output.log"), runLogTailLines)
+	if len(logTail) == 0 && meta.Archive.has("terminal_output.log") {
+		if file, err := h.openArchivedFile(runID, "terminal_output.log"); err == nil {
+			logTail = scanLogTail(file, runLogTailLines)
+			file.Close()
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"run":       info,
+		"artifacts": artifacts,
+		"logTail":   logTail,
+	})
+}
+
+// readLogTail returns the last lines of a run log
+func readLogTail(logPath string, lines int) []string {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return []string{}
+	}
+	defer file.Close()
+	return scanLogTail(file, lines)
+}
+
+// scanLogTail returns the last lines read from a run log
+func scanLogTail(file io.Reader, lines int) []string {
+	tail := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		tail = append(tail, scanner.Text())
+		if len(tail) > lines {
+			tail = tail[1:]
+		}
+	}
+	return tail
+}
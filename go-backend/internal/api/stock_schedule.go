@@ -0,0 +1,316 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadScheduler starts scheduled runs when they are due. A pending schedule
+// is a run folder in the scheduled state with scheduledAt in its meta.json,
+// so schedules survive restarts without a file of their own.
+type uploadScheduler struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// newUploadScheduler creates a scheduler without pending runs, see StartScheduler
+func newUploadScheduler() *uploadScheduler {
+	return &uploadScheduler{timers: make(map[string]*time.Timer)}
+}
+
+// parseScheduledAt reads the scheduledAt form field, an RFC 3339 time such as
+// 2025-06-01T02:00:00+05:30. It returns nil when the field is empty.
+func parseScheduledAt(value string, now time.Time) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	scheduledAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("scheduledAt must be an RFC 3339 time, e.g. 2025-06-01T02:00:00+05:30")
+	}
+	if !scheduledAt.After(now) {
+		return nil, fmt.Errorf("scheduledAt must be in the future")
+	}
+	return &scheduledAt, nil
+}
+
+// StartScheduler arms the runs left scheduled by an earlier process. Runs
+// that fell due while the server was down are queued right away.
+func (h *StockHandler) StartScheduler() {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+
+	runFolders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil {
+		return
+	}
+	for _, folder := range runFolders {
+		if !folder.IsDir() {
+			continue
+		}
+		runFolder := filepath.Join(h.config.UploadsDir, folder.Name())
+		if readControlState(runFolder) != RunStateScheduled {
+			continue
+		}
+
+		meta, err := readRunMeta(runFolder)
+		if err != nil || meta.ScheduledAt == nil {
+			log.Printf("Scheduled run %s has no readable start time, leaving it scheduled", folder.Name())
+			continue
+		}
+		h.armSchedule(folder.Name(), *meta.ScheduledAt)
+		log.Printf("Run %s is scheduled for %s", folder.Name(), meta.ScheduledAt.Format(time.RFC3339))
+	}
+}
+
+// scheduleRun puts a new run in the scheduled state and arms its timer
+func (h *StockHandler) scheduleRun(runID, runFolder string, scheduledAt time.Time) error {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+
+	if err := writeControlState(runFolder, RunStateScheduled); err != nil {
+		return err
+	}
+	h.armSchedule(runID, scheduledAt)
+	return nil
+}
+
+// armSchedule replaces the timer of a run. The caller holds the scheduler lock.
+func (h *StockHandler) armSchedule(runID string, scheduledAt time.Time) {
+	if timer, ok := h.schedules.timers[runID]; ok {
+		timer.Stop()
+	}
+	h.schedules.timers[runID] = time.AfterFunc(time.Until(scheduledAt), func() {
+		h.startScheduledRun(runID, scheduledAt)
+	})
+}
+
+// startScheduledRun queues a run whose scheduled time has come. Timers of
+// runs that were cancelled or rescheduled in the meantime do nothing.
+func (h *StockHandler) startScheduledRun(runID string, scheduledAt time.Time) {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if readControlState(runFolder) != RunStateScheduled {
+		return
+	}
+	meta, err := readRunMeta(runFolder)
+	if err != nil {
+		log.Printf("Cannot start scheduled run %s: %v", runID, err)
+		return
+	}
+	if meta.ScheduledAt == nil || !meta.ScheduledAt.Equal(scheduledAt) {
+		return // rescheduled, a newer timer starts it
+	}
+	delete(h.schedules.timers, runID)
+
+	env := strings.ToUpper(meta.Env)
+	details := fmt.Sprintf("Run: %s, File: %s, Scheduled At: %s", runID, meta.FileName, scheduledAt.Format(time.RFC3339))
+
+	state, position, err := h.enqueueRun(meta)
+	if err != nil {
+		log.Printf("Cannot start scheduled run %s: %v", runID, err)
+		utils.LogActivity(h.config.ConfigDir, meta.User, "Scheduled Upload Started", env,
+			fmt.Sprintf("%s, Error: %v", details, err), "Failed")
+		return
+	}
+	if state == RunStateQueued {
+		details += fmt.Sprintf(", Queue Position: %d", position)
+	}
+
+	log.Printf("Starting scheduled run %s (%s)", runID, state)
+	utils.LogActivity(h.config.ConfigDir, meta.User, "Scheduled Upload Started", env, details, "Success")
+}
+
+// cancelSchedule moves a scheduled run to the cancelled state
+func (h *StockHandler) cancelSchedule(runID string) error {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if state := readControlState(runFolder); state != RunStateScheduled {
+		return &TransitionError{State: state, Action: "cancel"}
+	}
+	if timer, ok := h.schedules.timers[runID]; ok {
+		timer.Stop()
+		delete(h.schedules.timers, runID)
+	}
+	return writeControlState(runFolder, RunStateCancelled)
+}
+
+// reschedule moves the start of a scheduled run
+func (h *StockHandler) reschedule(runID string, scheduledAt time.Time) error {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+
+	runFolder := filepath.Join(h.config.UploadsDir, runID)
+	if state := readControlState(runFolder); state != RunStateScheduled {
+		return &TransitionError{State: state, Action: "reschedule"}
+	}
+	err := updateRunMeta(runFolder, func(meta *UploadMetadata) {
+		meta.ScheduledAt = &scheduledAt
+	})
+	if err != nil {
+		return err
+	}
+	h.armSchedule(runID, scheduledAt)
+	return nil
+}
+
+// ListSchedules lists the runs waiting for their scheduled start, soonest first
+func (h *StockHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	folders, err := os.ReadDir(h.config.UploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to read runs",
+		})
+		return
+	}
+
+	schedules := []RunInfo{}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		if readControlState(filepath.Join(h.config.UploadsDir, folder.Name())) != RunStateScheduled {
+			continue
+		}
+		info, _, err := h.loadRunInfo(folder.Name())
+		if err != nil || !canViewRun(userClaims, info) {
+			continue
+		}
+		schedules = append(schedules, info)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].ScheduledAt == nil || schedules[j].ScheduledAt == nil {
+			return schedules[j].ScheduledAt == nil && schedules[i].ScheduledAt != nil
+		}
+		return schedules[i].ScheduledAt.Before(*schedules[j].ScheduledAt)
+	})
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"schedules": schedules,
+	})
+}
+
+// CancelSchedule cancels a scheduled run before it starts
+func (h *StockHandler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	h.changeSchedule(w, r, "cancel")
+}
+
+// RescheduleRun moves the start of a scheduled run to the scheduledAt of the
+// request body
+func (h *StockHandler) RescheduleRun(w http.ResponseWriter, r *http.Request) {
+	h.changeSchedule(w, r, "reschedule")
+}
+
+// changeSchedule cancels or reschedules a run for its owner or an admin
+func (h *StockHandler) changeSchedule(w http.ResponseWriter, r *http.Request, action string) {
+	userClaims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"message": "Unauthorized",
+		})
+		return
+	}
+
+	runID := filepath.Base(mux.Vars(r)["runId"])
+	info, meta, err := h.loadRunInfo(runID)
+	if err != nil || !canViewRun(userClaims, info) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"message": "Run not found",
+		})
+		return
+	}
+
+	details := fmt.Sprintf("Run: %s, File: %s", runID, meta.FileName)
+	operation := "Cancel Scheduled Upload"
+	if action == "cancel" {
+		err = h.cancelSchedule(runID)
+	} else {
+		var req struct {
+			ScheduledAt string `json:"scheduledAt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": "Invalid request body",
+			})
+			return
+		}
+		var scheduledAt *time.Time
+		scheduledAt, err = parseScheduledAt(req.ScheduledAt, time.Now())
+		if err == nil && scheduledAt == nil {
+			err = fmt.Errorf("scheduledAt is required")
+		}
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		operation = "Reschedule Upload"
+		details += fmt.Sprintf(", Scheduled At: %s", scheduledAt.Format(time.RFC3339))
+		if meta.ScheduledAt != nil {
+			details += fmt.Sprintf(" (was %s)", meta.ScheduledAt.Format(time.RFC3339))
+		}
+		err = h.reschedule(runID, *scheduledAt)
+	}
+
+	var transitionErr *TransitionError
+	switch {
+	case err == nil:
+	case errors.As(err, &transitionErr):
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Only scheduled runs can be changed, run is %s", transitionErr.State),
+			"state":   transitionErr.State,
+		})
+		return
+	default:
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Cannot update run",
+		})
+		return
+	}
+
+	utils.LogActivity(h.config.ConfigDir, activityUser(userClaims), operation, info.Env, details, "Success")
+
+	info, _, _ = h.loadRunInfo(runID)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"run":     info,
+	})
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// heldJournalBatch is how many rows that are not sent upstream, skipped
+// duplicates and rows of a stopped run, are journaled at once
+const heldJournalBatch = 500
+
+// uploadPlan is what the first pass over a stock file found. Only row numbers
+// are kept, never the rows themselves, so it stays small for large files.
+type uploadPlan struct {
+	profile    fileProfile
+	headers    []string
+	rowFilter  map[int]bool   // rows a child run reprocesses, nil for every row
+	uploaded   map[int]bool   // rows an earlier attempt of the run already uploaded
+	duplicates map[int]string // duplicate rows and why they are duplicates
+
+	total        int // rows of the run, rejected ones included
+	rejected     int // rows that failed parsing or the client's rules
+	done         int // valid rows already uploaded by an earlier attempt
+	pending      int // valid rows left to upload
+	firstPending int // row number of the first row left to upload
+}
+
+// inScope reports whether a row belongs to the run
+func (p *uploadPlan) inScope(rowNumber int) bool {
+	return p.rowFilter == nil || p.rowFilter[rowNumber]
+}
+
+// planUpload reads the whole file once before anything is sent. It logs rows
+// that fail parsing or the client's rules, flags duplicate codes and counts
+// the rows to upload.
+func (h *StockHandler) planUpload(csvPath string, profile fileProfile, rowFilter []int, uploaded map[int]bool, duplicates *duplicateDetector, logWriter *logBroadcaster) (*uploadPlan, error) {
+	// Both passes measure remaining validity from the same time
+	if profile.checkedAt.IsZero() {
+		profile.checkedAt = time.Now()
+	}
+
+	scanner, err := h.openVoucherFile(csvPath, profile)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	plan := &uploadPlan{
+		profile:    profile,
+		headers:    scanner.headers,
+		uploaded:   uploaded,
+		duplicates: make(map[int]string),
+	}
+	if len(rowFilter) > 0 {
+		plan.rowFilter = make(map[int]bool, len(rowFilter))
+		for _, rowNumber := range rowFilter {
+			plan.rowFilter[rowNumber] = true
+		}
+	}
+
+	for {
+		row, voucher, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if voucher == nil {
+			value := row.rejectedValue
+			if value != "" && value == row.VoucherCode {
+				value = h.redact.Code(value)
+			}
+			if value == "" {
+				logWriter.Write(fmt.Sprintf("Warning: %s in row %d\n", row.Reason, row.RowNumber))
+			} else {
+				logWriter.Write(fmt.Sprintf("Warning: %s in row %d: %s\n", row.Reason, row.RowNumber, value))
+			}
+			if plan.inScope(row.RowNumber) {
+				plan.total++
+				plan.rejected++
+			}
+			continue
+		}
+		if !plan.inScope(row.RowNumber) {
+			continue
+		}
+
+		// Rows this run already uploaded are done, even when the index has
+		// caught up with them since
+		plan.total++
+		reason, isDuplicate, err := duplicates.Check(*voucher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for duplicate voucher codes: %v", err)
+		}
+		if uploaded[row.RowNumber] {
+			plan.done++
+			continue
+		}
+		if isDuplicate {
+			logWriter.Write(fmt.Sprintf("Warning: %s in row %d\n", reason, row.RowNumber))
+			plan.duplicates[row.RowNumber] = reason
+			continue
+		}
+		if plan.pending == 0 {
+			plan.firstPending = row.RowNumber
+		}
+		plan.pending++
+	}
+
+	return plan, nil
+}
+
+// feedVouchers reads the file a second time and sends the rows left to upload
+// to batches, BatchSize rows at a time. Rejected rows and skipped duplicates
+// are journaled on the way, and once the run is stopped the remaining rows are journaled as
+// stopped without going through the workers. batches is closed once the file
+// has been read.
+func (h *StockHandler) feedVouchers(run *uploadRun, csvPath string, plan *uploadPlan, batches chan<- []VoucherRecord) error {
+	defer close(batches)
+
+	scanner, err := h.openVoucherFile(csvPath, plan.profile)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	// held collects rows that are not sent upstream
+	held := []UploadResult{}
+	flushHeld := func() {
+		if len(held) == 0 {
+			return
+		}
+		run.journalResults(held)
+		held = held[:0]
+	}
+	defer flushHeld()
+
+	batchSize := run.envConfig.BatchSize
+	batch := make([]VoucherRecord, 0, batchSize)
+	for {
+		row, voucher, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !plan.inScope(row.RowNumber) || plan.uploaded[row.RowNumber] {
+			continue
+		}
+
+		if voucher == nil {
+			held = append(held, run.newRejectedResult(row))
+		} else if reason, isDuplicate := plan.duplicates[row.RowNumber]; isDuplicate {
+			result := run.newResult(*voucher)
+			result.ErrorMessage = reason
+			result.APIResponse = reason
+			result.Skipped = true
+			held = append(held, result)
+		} else if run.active.ctx.Err() != nil {
+			result := run.newResult(*voucher)
+			result.ErrorMessage = stoppedMessage
+			run.active.recordResults([]UploadResult{result})
+			held = append(held, result)
+		} else {
+			batch = append(batch, *voucher)
+			if len(batch) == batchSize {
+				batches <- batch
+				batch = make([]VoucherRecord, 0, batchSize)
+			}
+		}
+
+		if len(held) == heldJournalBatch {
+			flushHeld()
+		}
+	}
+
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	return nil
+}
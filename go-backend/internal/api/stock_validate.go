@@ -0,0 +1,349 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"gc-distribution-portal/internal/config"
+)
+
+// ValidationRow is the per-row outcome of parsing a stock file
+type ValidationRow struct {
+	RowNumber   int    `json:"rowNumber"`
+	VoucherCode string `json:"voucherCode"`
+	Amount      string `json:"amount"`
+	Validity    string `json:"validity"`
+	OfferID     string `json:"offerId,omitempty"`
+	AmountPaise int    `json:"amountPaise,omitempty"`
+	ExpiryEpoch int64  `json:"expiryEpoch,omitempty"`
+	Valid       bool   `json:"valid"`
+	Reason      string `json:"reason,omitempty"`
+	Duplicate   string `json:"duplicate,omitempty"`
+
+	rejectedValue   string   // value that caused the rejection, used for log warnings
+	record          []string // the row as read, for the results CSV
+	clientName      string   // client of the row's offer, for the results CSV
+	commissionInput string   // commission of the row's offer, for the results CSV
+}
+
+// DenominationCount summarises valid vouchers of a single denomination
+type DenominationCount struct {
+	AmountPaise int   `json:"amountPaise"`
+	Count       int   `json:"count"`
+	TotalPaise  int64 `json:"totalPaise"`
+}
+
+// ValidityCount is how a distinct expiry value was read, so operators can
+// confirm the epoch before uploading
+type ValidityCount struct {
+	Validity    string `json:"validity"`
+	ExpiryEpoch int64  `json:"expiryEpoch,omitempty"`
+	Reason      string `json:"reason,omitempty"` // set when the value was rejected
+	Count       int    `json:"count"`
+}
+
+// maxValidityCounts caps the distinct expiry values a report lists
+const maxValidityCounts = 1000
+
+// ValidationReport is the result of a dry run over a stock file
+type ValidationReport struct {
+	Headers         []string            `json:"headers"`
+	ColumnMapping   map[string]string   `json:"columnMapping"`
+	TotalRows       int                 `json:"totalRows"`
+	ValidRows       int                 `json:"validRows"`
+	RejectedRows    int                 `json:"rejectedRows"`
+	DuplicateRows   int                 `json:"duplicateRows"`
+	Denominations   []DenominationCount `json:"denominations"`
+	TotalValuePaise int64               `json:"totalValuePaise"`
+	Validities      []ValidityCount     `json:"validities"`
+
+	validityIndex map[string]int // position of each value in Validities
+	rows          *reportRows    // every row, written out after the totals by WriteJSON
+}
+
+// reportRows collects the rows of a report in a temporary file while the
+// stock file is parsed, so a report lists every row whatever the size of the
+// file and only its totals are held in memory
+type reportRows struct {
+	file  *os.File
+	out   *bufio.Writer
+	count int
+}
+
+// newReportRows creates the temporary rows file of a report in dir
+func newReportRows(dir string) (*reportRows, error) {
+	file, err := os.CreateTemp(dir, ".validation-rows-")
+	if err != nil {
+		return nil, err
+	}
+	return &reportRows{file: file, out: bufio.NewWriter(file)}, nil
+}
+
+// add appends a row as an element of the JSON rows array
+func (r *reportRows) add(row ValidationRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if r.count > 0 {
+		r.out.WriteByte(',')
+	}
+	r.count++
+	_, err = r.out.Write(data)
+	return err
+}
+
+// writeTo copies the rows collected so far to w
+func (r *reportRows) writeTo(w io.Writer) error {
+	if err := r.out.Flush(); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r.file)
+	return err
+}
+
+// close deletes the temporary rows file
+func (r *reportRows) close() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
+
+// newValidationReport creates an empty report for the detected columns. Its
+// rows are collected in dir until the report is closed.
+func newValidationReport(headers []string, columnMap map[string]int, dir string) (*ValidationReport, error) {
+	mapping := make(map[string]string)
+	for field, index := range columnMap {
+		mapping[field] = headers[index]
+	}
+
+	rows, err := newReportRows(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ValidationReport{
+		Headers:       headers,
+		ColumnMapping: mapping,
+		Denominations: []DenominationCount{},
+		Validities:    []ValidityCount{},
+		validityIndex: make(map[string]int),
+		rows:          rows,
+	}, nil
+}
+
+// WriteJSON writes the report as JSON, its rows in file order after the totals
+func (r *ValidationReport) WriteJSON(w io.Writer) error {
+	totals, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(totals[:len(totals)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"rows":[`); err != nil {
+		return err
+	}
+	if err := r.rows.writeTo(w); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+// Close deletes the rows collected for the report
+func (r *ValidationReport) Close() error {
+	return r.rows.close()
+}
+
+// respondWithReport writes a JSON response with the fields and a "report"
+// member written by writeReport, so the rows of a report are streamed to the
+// client rather than built in memory
+func respondWithReport(w http.ResponseWriter, fields map[string]interface{}, writeReport func(io.Writer) error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to encode validation report",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	out.Write(data[:len(data)-1])
+	out.WriteString(`,"report":`)
+	if err := writeReport(out); err != nil {
+		// The status is sent already, the client gets a response cut short
+		log.Printf("Failed to send validation report: %v", err)
+		return
+	}
+	out.WriteString("}\n")
+	out.Flush()
+}
+
+// rejected marks a row as failed parsing because of value
+func (row ValidationRow) rejected(reason, value string) ValidationRow {
+	row.Valid = false
+	row.Reason = reason
+	row.rejectedValue = value
+	return row
+}
+
+// rejection describes why a row was rejected, with the offending value if any
+func (row ValidationRow) rejection() string {
+	if row.rejectedValue == "" {
+		return row.Reason
+	}
+	return fmt.Sprintf("%s: %s", row.Reason, row.rejectedValue)
+}
+
+// add records a parsed row
+func (r *ValidationReport) add(row ValidationRow) error {
+	if err := r.rows.add(row); err != nil {
+		return err
+	}
+	r.TotalRows++
+	if row.Valid || row.Reason == reasonInvalidDate || row.Reason == reasonAmbiguousDate {
+		r.addValidity(row)
+	}
+	if !row.Valid {
+		r.RejectedRows++
+		return nil
+	}
+	r.ValidRows++
+	if row.Duplicate != "" {
+		r.DuplicateRows++
+	}
+	r.TotalValuePaise += int64(row.AmountPaise)
+
+	for i := range r.Denominations {
+		if r.Denominations[i].AmountPaise == row.AmountPaise {
+			r.Denominations[i].Count++
+			r.Denominations[i].TotalPaise += int64(row.AmountPaise)
+			return nil
+		}
+	}
+	r.Denominations = append(r.Denominations, DenominationCount{
+		AmountPaise: row.AmountPaise,
+		Count:       1,
+		TotalPaise:  int64(row.AmountPaise),
+	})
+	sort.Slice(r.Denominations, func(i, j int) bool {
+		return r.Denominations[i].AmountPaise < r.Denominations[j].AmountPaise
+	})
+	return nil
+}
+
+// addValidity counts the expiry value of a row that was valid or rejected
+// for its date
+func (r *ValidationReport) addValidity(row ValidationRow) {
+	if i, ok := r.validityIndex[row.Validity]; ok {
+		r.Validities[i].Count++
+		return
+	}
+	if len(r.Validities) >= maxValidityCounts {
+		return
+	}
+
+	validity := ValidityCount{Validity: row.Validity, Count: 1}
+	if row.Valid {
+		validity.ExpiryEpoch = row.ExpiryEpoch
+	} else {
+		validity.Reason = row.Reason
+	}
+	r.validityIndex[row.Validity] = len(r.Validities)
+	r.Validities = append(r.Validities, validity)
+}
+
+// ValidateUpload runs the same parsing as an upload run without calling the
+// upstream API and returns the validation report
+func (h *StockHandler) ValidateUpload(w http.ResponseWriter, r *http.Request) {
+	// Work in a scratch folder, nothing from a dry run is kept
+	tmpFolder, err := os.MkdirTemp("", "stock-validate-")
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": "Failed to create temp folder",
+		})
+		return
+	}
+	defer os.RemoveAll(tmpFolder)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	form, err := readUploadForm(h.artifacts, r, tmpFolder)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Flag duplicates within the file, and against past runs when env and client are given
+	env := strings.ToUpper(form.Value("env"))
+	var clientData interface{}
+	json.Unmarshal([]byte(form.Value("client")), &clientData)
+	_, offerID := clientFields(clientData)
+
+	duplicates := h.newDuplicateDetector(env)
+
+	// Read the file with the client's profile, as the upload would
+	configured, err := h.config.FindClient(offerID)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to load clients: %v", err),
+		})
+		return
+	}
+	amountType, err := normalizeAmountType(form.Value("amountType"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	profile := clientProfile(configured)
+	profile.amountType = amountType
+
+	// Multi-offer rows are checked against the configured offers
+	multiOffer := parseMultiOffer(form.Value("multiOffer"))
+	var offerClients []config.Client
+	if multiOffer {
+		if offerClients, err = h.config.LoadClients(); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Failed to load clients: %v", err),
+			})
+			return
+		}
+	}
+	profile.offers = newOfferSettings(multiOffer, clientData, form.Value("rzpCommission"), offerClients)
+
+	report, err := h.parseVoucherFile(form.csvPath, profile, duplicates, nil)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	defer report.Close()
+
+	respondWithReport(w, map[string]interface{}{
+		"success":         true,
+		"fileName":        form.fileName,
+		"duplicatePolicy": normalizeDuplicatePolicy(form.Value("duplicatePolicy")),
+	}, report.WriteJSON)
+}
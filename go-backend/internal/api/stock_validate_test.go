@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestValidationReportWriteJSON(t *testing.T) {
+	dir := t.TempDir()
+	report, err := newValidationReport([]string{"Code", "Amount", "Validity"}, map[string]int{"voucher_code": 0}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []ValidationRow{
+		{RowNumber: 2, VoucherCode: "****1111", Amount: "500", Validity: "2026-12-31", AmountPaise: 50000, ExpiryEpoch: 1798655400, Valid: true},
+		{RowNumber: 3, VoucherCode: "****2222", Amount: "abc", Validity: "2026-12-31", Reason: "Invalid amount"},
+		{RowNumber: 4, VoucherCode: "****3333", Amount: "500", Validity: "2026-12-31", AmountPaise: 50000, ExpiryEpoch: 1798655400, Valid: true, Duplicate: "Duplicate of row 2"},
+	}
+	for _, row := range rows {
+		if err := report.add(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		TotalRows       int               `json:"totalRows"`
+		ValidRows       int               `json:"validRows"`
+		RejectedRows    int               `json:"rejectedRows"`
+		DuplicateRows   int               `json:"duplicateRows"`
+		TotalValuePaise int64             `json:"totalValuePaise"`
+		ColumnMapping   map[string]string `json:"columnMapping"`
+		Rows            []ValidationRow   `json:"rows"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("WriteJSON wrote invalid JSON %s: %v", buf.String(), err)
+	}
+
+	if got.TotalRows != 3 || got.ValidRows != 2 || got.RejectedRows != 1 || got.DuplicateRows != 1 || got.TotalValuePaise != 100000 {
+		t.Errorf("totals = %+v, want 3 rows, 2 valid, 1 rejected, 1 duplicate, 100000 paise", got)
+	}
+	if got.ColumnMapping["voucher_code"] != "Code" {
+		t.Errorf("column mapping = %v", got.ColumnMapping)
+	}
+	if len(got.Rows) != len(rows) {
+		t.Fatalf("report lists %d rows, want every row (%d)", len(got.Rows), len(rows))
+	}
+	for i, row := range got.Rows {
+		if row.RowNumber != rows[i].RowNumber || row.Valid != rows[i].Valid || row.Reason != rows[i].Reason || row.Duplicate != rows[i].Duplicate {
+			t.Errorf("row %d = %+v, want %+v", i, row, rows[i])
+		}
+	}
+
+	if err := report.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Close left %d files behind", len(entries))
+	}
+}
+
+func TestValidationReportWithoutRows(t *testing.T) {
+	report, err := newValidationReport(nil, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer report.Close()
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("WriteJSON wrote invalid JSON %s: %v", buf.String(), err)
+	}
+	if string(got["rows"]) != "[]" {
+		t.Errorf("rows of an empty report = %s, want []", got["rows"])
+	}
+}
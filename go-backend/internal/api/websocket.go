@@ -99,6 +99,16 @@ func (h *WebSocketHub) BroadcastFinished(runID string, code int) {
 	h.broadcast <- data
 }
 
+// BroadcastQueue sends the state of the upload queue to all connected clients
+func (h *WebSocketHub) BroadcastQueue(queue QueueState) {
+	msg := map[string]interface{}{
+		"type":  "queue",
+		"queue": queue,
+	}
+	data, _ := json.Marshal(msg)
+	h.broadcast <- data
+}
+
 // ServeWebSocket handles WebSocket connections
 func ServeWebSocket(hub *WebSocketHub, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -0,0 +1,159 @@
+// Package artifact encrypts run artifacts at rest with envelope encryption.
+//
+// Every file gets its own random data key (DEK). The file is encrypted with
+// the DEK using AES-256-GCM, and the DEK is stored in the file header wrapped
+// (encrypted) with a master key of the keyring. Rotating the master key only
+// rewrites headers: the DEK is unwrapped with the retired key and wrapped
+// again with the active one, the file body is left as it is.
+package artifact
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	keySize   = 32 // AES-256, for master keys and data keys
+	nonceSize = 12
+)
+
+// ErrUnknownKey is returned for files wrapped with a key the keyring does not have
+var ErrUnknownKey = errors.New("artifact key not in keyring")
+
+// Keyring holds the master keys. New files are wrapped with the active key,
+// the others are kept to read files written before a rotation. A nil
+// *Keyring is valid and writes plaintext files.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// keyringFile is the JSON layout of a keyring file:
+//
+//	{"active": "2025-06", "keys": {"2025-06": "<base64 of 32 bytes>", "2024-01": "..."}}
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads a keyring file. An empty path means no keyring, and
+// artifacts are written in plaintext.
+func LoadKeyring(path string) (*Keyring, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact keyring: %w", err)
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid artifact keyring: %w", err)
+	}
+	return NewKeyring(file.Active, file.Keys)
+}
+
+// NewKeyring builds a keyring from base64 encoded keys by ID
+func NewKeyring(active string, encoded map[string]string) (*Keyring, error) {
+	k := &Keyring{active: active, keys: make(map[string][]byte, len(encoded))}
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("artifact key %q must be %d bytes, base64 encoded", id, keySize)
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("active artifact key %q is not in the keyring", active)
+	}
+	return k, nil
+}
+
+// ActiveKey returns the ID of the key new files are wrapped with, "" without a keyring
+func (k *Keyring) ActiveKey() string {
+	if k == nil {
+		return ""
+	}
+	return k.active
+}
+
+// header is stored in front of every encrypted file
+type header struct {
+	Version    int    `json:"v"`
+	KeyID      string `json:"kid"`
+	WrappedDEK []byte `json:"dek"`             // nonce followed by the sealed data key
+	Nonce      []byte `json:"nonce,omitempty"` // prefix of the chunk nonces of stream files
+}
+
+// newHeader creates a data key for a new file and wraps it with the active key
+func (k *Keyring) newHeader(noncePrefix bool) (*header, []byte, error) {
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, nil, err
+	}
+	h := &header{Version: 1, KeyID: k.active}
+	if err := k.wrap(h, dek); err != nil {
+		return nil, nil, err
+	}
+	if noncePrefix {
+		h.Nonce = make([]byte, nonceSize-4)
+		if _, err := rand.Read(h.Nonce); err != nil {
+			return nil, nil, err
+		}
+	}
+	return h, dek, nil
+}
+
+// wrap seals a data key with the active key into h
+func (k *Keyring) wrap(h *header, dek []byte) error {
+	aead, err := newAEAD(k.keys[k.active])
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	h.KeyID = k.active
+	h.WrappedDEK = aead.Seal(nonce, nonce, dek, []byte(k.active))
+	return nil
+}
+
+// unwrap returns the data key of a header
+func (k *Keyring) unwrap(h *header) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("file is encrypted but no artifact keyring is configured")
+	}
+	key, ok := k.keys[h.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, h.KeyID)
+	}
+	if len(h.WrappedDEK) < nonceSize {
+		return nil, fmt.Errorf("invalid artifact header")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := aead.Open(nil, h.WrappedDEK[:nonceSize], h.WrappedDEK[nonceSize:], []byte(h.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key with key %s: %w", h.KeyID, err)
+	}
+	return dek, nil
+}
+
+// newAEAD returns AES-GCM for a 32 byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,311 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKey returns a random base64 encoded master key
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// newTestKeyring builds a keyring of base64 encoded keys by ID
+func newTestKeyring(t *testing.T, keys map[string]string, active string) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// writeFile writes data to a stream file with Create
+func writeFile(t *testing.T, k *Keyring, path string, data []byte) {
+	t.Helper()
+	w, err := k.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFile reads a stream file back with Open
+func readFile(k *Keyring, path string) ([]byte, error) {
+	r, err := k.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestNewKeyring(t *testing.T) {
+	valid := newTestKey(t)
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+
+	tests := []struct {
+		name    string
+		active  string
+		keys    map[string]string
+		wantErr bool
+	}{
+		{name: "single key", active: "2025-06", keys: map[string]string{"2025-06": valid}},
+		{name: "retired keys kept", active: "2025-06", keys: map[string]string{"2025-06": valid, "2024-01": newTestKey(t)}},
+		{name: "active key missing", active: "2025-07", keys: map[string]string{"2025-06": valid}, wantErr: true},
+		{name: "no keys", active: "2025-06", keys: nil, wantErr: true},
+		{name: "short key", active: "2025-06", keys: map[string]string{"2025-06": short}, wantErr: true},
+		{name: "not base64", active: "2025-06", keys: map[string]string{"2025-06": "not a key"}, wantErr: true},
+		{name: "bad retired key", active: "2025-06", keys: map[string]string{"2025-06": valid, "2024-01": short}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		k, err := NewKeyring(tt.active, tt.keys)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: NewKeyring succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil || k.ActiveKey() != tt.active {
+			t.Errorf("%s: NewKeyring = %v, active %q, want %q", tt.name, err, k.ActiveKey(), tt.active)
+		}
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	k := newTestKeyring(t, map[string]string{"k1": newTestKey(t)}, "k1")
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "one byte", size: 1},
+		{name: "one chunk", size: chunkSize},
+		{name: "chunk and a byte", size: chunkSize + 1},
+		{name: "several chunks", size: 3*chunkSize + 17},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			rand.Read(data)
+
+			for _, keyring := range []*Keyring{k, nil} {
+				path := filepath.Join(t.TempDir(), "results.csv")
+				writeFile(t, keyring, path, data)
+
+				stored, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if encrypted := bytes.HasPrefix(stored, streamMagic); encrypted != (keyring != nil) {
+					t.Errorf("keyring %q: file encrypted = %t", keyring.ActiveKey(), encrypted)
+				}
+
+				got, err := readFile(keyring, path)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("keyring %q: read %d bytes, %v, want %d bytes", keyring.ActiveKey(), len(got), err, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTamperedFiles(t *testing.T) {
+	k := newTestKeyring(t, map[string]string{"k1": newTestKey(t)}, "k1")
+	data := bytes.Repeat([]byte("code,pin\n"), chunkSize/4)
+
+	path := filepath.Join(t.TempDir(), "raw.csv")
+	writeFile(t, k, path, data)
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerEnd := len(streamMagic) + 4 + int(binary.BigEndian.Uint32(stored[len(streamMagic):]))
+	firstChunkEnd := headerEnd + 4 + int(binary.BigEndian.Uint32(stored[headerEnd:]))
+
+	flipped := append([]byte{}, stored...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr error
+	}{
+		{name: "cut at a chunk boundary", content: stored[:firstChunkEnd], wantErr: ErrTruncated},
+		{name: "cut mid-chunk", content: stored[:len(stored)-10], wantErr: ErrTruncated},
+		{name: "cut in the header", content: stored[:headerEnd-5], wantErr: ErrTruncated},
+		{name: "flipped bit", content: flipped, wantErr: ErrTruncated},
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(path, tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFile(k, path); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: read error %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProtectFileRotation(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	old := newTestKeyring(t, map[string]string{"2024-01": oldKey}, "2024-01")
+	rotated := newTestKeyring(t, map[string]string{"2024-01": oldKey, "2025-06": newKey}, "2025-06")
+	current := newTestKeyring(t, map[string]string{"2025-06": newKey}, "2025-06")
+	data := bytes.Repeat([]byte("VOUCHER1234,9876\n"), chunkSize/8)
+
+	tests := []struct {
+		name   string
+		writer *Keyring // nil writes a plaintext file
+	}{
+		{name: "rewraps files of a retired key", writer: old},
+		{name: "encrypts plaintext files", writer: nil},
+		{name: "leaves files of the active key", writer: current},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upload_results.csv")
+			writeFile(t, tt.writer, path, data)
+			before, _ := os.ReadFile(path)
+
+			changed, err := rotated.ProtectFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantChanged := tt.writer != current; changed != wantChanged {
+				t.Errorf("ProtectFile changed = %t, want %t", changed, wantChanged)
+			}
+			after, _ := os.ReadFile(path)
+			if !changed && !bytes.Equal(before, after) {
+				t.Errorf("ProtectFile rewrote a file it reported unchanged")
+			}
+
+			// Once rotated the retired key is no longer needed
+			if got, err := readFile(current, path); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("read with the active key only: %d bytes, %v", len(got), err)
+			}
+			if _, err := readFile(old, path); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("read with the retired key only: %v, want %v", err, ErrUnknownKey)
+			}
+			if changed, err := rotated.ProtectFile(path); changed || err != nil {
+				t.Errorf("second ProtectFile = %t, %v, want no change", changed, err)
+			}
+		})
+	}
+}
+
+func TestProtectFileWithoutKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raw.csv")
+	if err := os.WriteFile(path, []byte("code,pin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := (*Keyring)(nil).ProtectFile(path); changed || err != nil {
+		t.Errorf("ProtectFile without a keyring = %t, %v, want no change", changed, err)
+	}
+	if _, err := (*Keyring)(nil).Open(path); err != nil {
+		t.Errorf("Open of a plaintext file without a keyring: %v", err)
+	}
+}
+
+func TestReadEncryptedFileWithoutKeyring(t *testing.T) {
+	k := newTestKeyring(t, map[string]string{"k1": newTestKey(t)}, "k1")
+	path := filepath.Join(t.TempDir(), "raw.csv")
+	writeFile(t, k, path, []byte("code,pin\n"))
+
+	if _, err := readFile(nil, path); err == nil {
+		t.Errorf("read of an encrypted file without a keyring succeeded")
+	}
+}
+
+func TestRecordsRoundTripAndRotation(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	old := newTestKeyring(t, map[string]string{"2024-01": oldKey}, "2024-01")
+	rotated := newTestKeyring(t, map[string]string{"2024-01": oldKey, "2025-06": newKey}, "2025-06")
+	current := newTestKeyring(t, map[string]string{"2025-06": newKey}, "2025-06")
+
+	tests := []struct {
+		name   string
+		writer *Keyring
+	}{
+		{name: "plaintext", writer: nil},
+		{name: "retired key", writer: old},
+		{name: "active key", writer: rotated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "results.journal")
+			appendRecords(t, tt.writer, path, `{"RowNumber":1}`, `{"RowNumber":2}`)
+
+			// Appending with the rotated keyring brings the file under its key first
+			appendRecords(t, rotated, path, `{"RowNumber":3}`)
+
+			want := []string{`{"RowNumber":1}`, `{"RowNumber":2}`, `{"RowNumber":3}`}
+			if got := readRecords(t, current, path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("read records %q, want %q", got, want)
+			}
+			if _, err := old.OpenRecordReader(path); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("read with the retired key only: %v, want %v", err, ErrUnknownKey)
+			}
+		})
+	}
+}
+
+// appendRecords appends records to a record file
+func appendRecords(t *testing.T, k *Keyring, path string, records ...string) {
+	t.Helper()
+	w, err := k.OpenRecordWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, record := range records {
+		if _, err := w.Write(append(w.Seal([]byte(record)), '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readRecords returns the records of a record file
+func readRecords(t *testing.T, k *Keyring, path string) []string {
+	t.Helper()
+	r, err := k.OpenRecordReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if record, ok := r.Record(line); ok && len(record) > 0 {
+			records = append(records, string(record))
+		}
+	}
+	return records
+}
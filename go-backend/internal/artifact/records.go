@@ -0,0 +1,285 @@
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// Record files hold one record per line and are appended to, so each record
+// is sealed on its own: the first line is the header, every other line the
+// base64 of a nonce and a sealed record. A line cut short by a crash fails
+// to open and reads as no record, like a torn plaintext line.
+var recordMagic = []byte("#GCENC1 ")
+
+// RecordWriter appends records to a record file
+type RecordWriter struct {
+	file *os.File
+	aead cipher.AEAD // nil for plaintext files
+}
+
+// OpenRecordWriter opens or creates a record file, readable by its owner
+// only, for appending. Plaintext files are encrypted first when there is a
+// keyring.
+func (k *Keyring) OpenRecordWriter(path string) (*RecordWriter, error) {
+	if _, err := k.ProtectRecords(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Chmod(0600)
+
+	h, err := readRecordHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &RecordWriter{file: file}
+
+	switch {
+	case h != nil:
+		dek, err := k.unwrap(h)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.aead, err = newAEAD(dek)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	case k != nil:
+		// A new file, ProtectRecords encrypted any earlier one
+		h, dek, err := k.newHeader(false)
+		if err == nil {
+			w.aead, err = newAEAD(dek)
+		}
+		if err == nil {
+			_, err = file.Write(recordHeaderLine(h))
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Seal returns the line to append for a record, without the newline
+func (w *RecordWriter) Seal(record []byte) []byte {
+	if w.aead == nil {
+		return record
+	}
+	return sealRecord(w.aead, record)
+}
+
+// Write appends sealed lines to the file
+func (w *RecordWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Sync commits the file to disk
+func (w *RecordWriter) Sync() error {
+	return w.file.Sync()
+}
+
+// Close closes the file
+func (w *RecordWriter) Close() error {
+	return w.file.Close()
+}
+
+// RecordReader reads the lines of a record file at known offsets
+type RecordReader struct {
+	file *os.File
+	aead cipher.AEAD // nil for plaintext files
+}
+
+// OpenRecordReader opens a record file for reading
+func (k *Keyring) OpenRecordReader(path string) (*RecordReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := readRecordHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := &RecordReader{file: file}
+	if h != nil {
+		dek, err := k.unwrap(h)
+		if err == nil {
+			r.aead, err = newAEAD(dek)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Read reads the file from the start, line by line
+func (r *RecordReader) Read(p []byte) (int, error) {
+	return r.file.Read(p)
+}
+
+// ReadAt reads the line at a known offset
+func (r *RecordReader) ReadAt(p []byte, offset int64) (int, error) {
+	return r.file.ReadAt(p, offset)
+}
+
+// Record returns the record of a line, false for the header and for lines
+// that do not hold a whole record
+func (r *RecordReader) Record(line []byte) ([]byte, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if bytes.HasPrefix(line, recordMagic) {
+		return nil, false
+	}
+	if r.aead == nil {
+		return line, true
+	}
+	return openRecord(r.aead, line)
+}
+
+// Close closes the file
+func (r *RecordReader) Close() error {
+	return r.file.Close()
+}
+
+// ProtectRecords brings a record file under the active key: plaintext files
+// are encrypted line by line and files wrapped with another key get a
+// rewrapped header. It reports whether the file was rewritten. Without a
+// keyring it does nothing.
+func (k *Keyring) ProtectRecords(path string) (bool, error) {
+	if k == nil {
+		return false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	h, err := readRecordHeader(file)
+	if err != nil {
+		return false, err
+	}
+	if h != nil && h.KeyID == k.active {
+		return false, nil
+	}
+
+	return true, replaceFile(path, func(tmp *os.File) error {
+		src := bufio.NewReaderSize(file, 64*1024)
+
+		if h != nil {
+			// Only the header changes, the records stay sealed with the same data key
+			dek, err := k.unwrap(h)
+			if err != nil {
+				return err
+			}
+			if err := k.wrap(h, dek); err != nil {
+				return err
+			}
+			if _, err := src.ReadBytes('\n'); err != nil {
+				return err
+			}
+			if _, err := tmp.Write(recordHeaderLine(h)); err != nil {
+				return err
+			}
+			_, err = io.Copy(tmp, src)
+			return err
+		}
+
+		h, dek, err := k.newHeader(false)
+		if err != nil {
+			return err
+		}
+		aead, err := newAEAD(dek)
+		if err != nil {
+			return err
+		}
+		out := bufio.NewWriter(tmp)
+		out.Write(recordHeaderLine(h))
+		for {
+			line, err := src.ReadBytes('\n')
+			if record := bytes.TrimRight(line, "\r\n"); len(record) > 0 {
+				out.Write(sealRecord(aead, record))
+				out.WriteByte('\n')
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return out.Flush()
+	})
+}
+
+// readRecordHeader reads the header line of a record file, nil for empty and
+// plaintext files. The file is read from the start.
+func readRecordHeader(file *os.File) (*header, error) {
+	buf := make([]byte, maxHeaderBytes)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line := buf[:n]
+	if !bytes.HasPrefix(line, recordMagic) {
+		return nil, nil
+	}
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return nil, ErrCorrupt
+	}
+
+	data, err := base64.StdEncoding.DecodeString(string(line[len(recordMagic):end]))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	var h header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, ErrCorrupt
+	}
+	return &h, nil
+}
+
+// recordHeaderLine encodes the header line of a record file
+func recordHeaderLine(h *header) []byte {
+	data, _ := json.Marshal(h)
+	line := append([]byte{}, recordMagic...)
+	line = append(line, base64.StdEncoding.EncodeToString(data)...)
+	return append(line, '\n')
+}
+
+// sealRecord seals a record into a line with a random nonce
+func sealRecord(aead cipher.AEAD, record []byte) []byte {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, record, nil)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+	return line
+}
+
+// openRecord opens a sealed line
+func openRecord(aead cipher.AEAD, line []byte) ([]byte, bool) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil || n < nonceSize {
+		return nil, false
+	}
+	record, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:n], nil)
+	return record, err == nil
+}
@@ -0,0 +1,376 @@
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Stream files are the magic bytes, the length of the JSON header, the
+// header, then the file body in chunks of up to chunkSize bytes. Each chunk
+// is its sealed length followed by the sealed bytes; the nonce is the nonce
+// prefix of the header and the chunk counter. The last chunk is sealed as
+// such, so a file cut short at a chunk boundary does not read as complete.
+var streamMagic = []byte("GCENC1\x00")
+
+const (
+	chunkSize      = 64 * 1024
+	maxHeaderBytes = 4096
+)
+
+var (
+	// ErrTruncated is returned when an encrypted file ends before its last chunk
+	ErrTruncated = errors.New("encrypted artifact is truncated")
+	// ErrCorrupt is returned when an encrypted file fails authentication
+	ErrCorrupt = errors.New("encrypted artifact is corrupt")
+)
+
+// Create creates or truncates a file, readable by its owner only, and returns
+// a writer that encrypts what is written to it. Close seals the last chunk.
+func (k *Keyring) Create(path string) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Chmod(0600) // files that existed keep their mode otherwise
+	if k == nil {
+		return file, nil
+	}
+
+	w, err := k.newStreamWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// streamWriter encrypts a stream file chunk by chunk
+type streamWriter struct {
+	file    *os.File
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newStreamWriter writes the header of a new stream file
+func (k *Keyring) newStreamWriter(file *os.File) (*streamWriter, error) {
+	h, dek, err := k.newHeader(true)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStreamHeader(file, h); err != nil {
+		return nil, err
+	}
+	return &streamWriter{file: file, aead: aead, prefix: h.Nonce, buf: make([]byte, 0, 2*chunkSize)}, nil
+}
+
+// writeStreamHeader writes the magic bytes and the header of a stream file
+func writeStreamHeader(w io.Writer, h *header) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	for _, part := range [][]byte{streamMagic, length[:], data} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write buffers p and seals every full chunk but the last, which is only
+// known to be the last on Close
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > chunkSize {
+		if err := w.seal(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close seals the last chunk and closes the file
+func (w *streamWriter) Close() error {
+	if err := w.seal(w.buf, true); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// seal writes a chunk
+func (w *streamWriter) seal(plain []byte, last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter), plain, chunkAAD(last))
+	w.counter++
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := w.file.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.file.Write(sealed)
+	return err
+}
+
+// Open opens a file written by Create and returns a reader of its plaintext.
+// Files written before encryption was configured are read as they are.
+func (k *Keyring) Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.NewReader(file)
+}
+
+// NewReader returns a reader of the plaintext of a file written by Create that
+// is read from src, such as an archived copy. Closing it closes src.
+func (k *Keyring) NewReader(file io.ReadCloser) (io.ReadCloser, error) {
+	src := bufio.NewReaderSize(file, chunkSize)
+
+	h, err := readStreamHeader(src)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if h == nil {
+		return &plainReader{Reader: src, file: file}, nil
+	}
+
+	dek, err := k.unwrap(h)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &streamReader{file: file, src: src, aead: aead, prefix: h.Nonce}, nil
+}
+
+// readStreamHeader reads the header of a stream file, nil for plaintext files
+func readStreamHeader(src *bufio.Reader) (*header, error) {
+	magic, err := src.Peek(len(streamMagic))
+	if err != nil || !bytes.Equal(magic, streamMagic) {
+		return nil, nil
+	}
+	src.Discard(len(streamMagic))
+
+	var length [4]byte
+	if _, err := io.ReadFull(src, length[:]); err != nil {
+		return nil, ErrTruncated
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxHeaderBytes {
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(src, data); err != nil {
+		return nil, ErrTruncated
+	}
+
+	var h header
+	if err := json.Unmarshal(data, &h); err != nil || len(h.Nonce) != nonceSize-4 {
+		return nil, ErrCorrupt
+	}
+	return &h, nil
+}
+
+// plainReader reads a plaintext file through the buffer its header was peeked with
+type plainReader struct {
+	*bufio.Reader
+	file io.Closer
+}
+
+// Close closes the file
+func (r *plainReader) Close() error {
+	return r.file.Close()
+}
+
+// streamReader decrypts a stream file chunk by chunk
+type streamReader struct {
+	file    io.Closer
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	opened  []byte
+	plain   []byte // rest of the current chunk
+	done    bool   // the last chunk was read
+}
+
+// Read returns the plaintext of the file
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (r *streamReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.src, length[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(length[:]))
+	if size > chunkSize+r.aead.Overhead() {
+		return ErrCorrupt
+	}
+	if cap(r.sealed) < size {
+		r.sealed = make([]byte, size)
+	}
+	r.sealed = r.sealed[:size]
+	if _, err := io.ReadFull(r.src, r.sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	// The last chunk is the one the file ends with
+	_, err := r.src.Peek(1)
+	last := err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+
+	opened, err := r.aead.Open(r.opened[:0], chunkNonce(r.prefix, r.counter), r.sealed, chunkAAD(last))
+	if err != nil {
+		if last {
+			return ErrTruncated // or corrupt, a chunk sealed as not last cannot end the file
+		}
+		return ErrCorrupt
+	}
+	r.counter++
+	r.opened = opened
+	r.plain = opened
+	r.done = last
+	return nil
+}
+
+// Close closes the file
+func (r *streamReader) Close() error {
+	return r.file.Close()
+}
+
+// chunkNonce is the nonce of a chunk: the file's prefix and the chunk counter
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[nonceSize-4:], counter)
+	return nonce
+}
+
+// chunkAAD marks the last chunk of a file
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// ProtectFile brings a stream file under the active key: plaintext files are
+// encrypted and files wrapped with another key are rewrapped. It reports
+// whether the file was rewritten. Without a keyring it does nothing.
+func (k *Keyring) ProtectFile(path string) (bool, error) {
+	if k == nil {
+		return false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	src := bufio.NewReaderSize(file, chunkSize)
+
+	h, err := readStreamHeader(src)
+	if err != nil {
+		return false, err
+	}
+	if h != nil && h.KeyID == k.active {
+		return false, nil
+	}
+
+	return true, replaceFile(path, func(tmp *os.File) error {
+		if h == nil {
+			w, err := k.newStreamWriter(tmp)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, src); err != nil {
+				return err
+			}
+			return w.seal(w.buf, true)
+		}
+
+		// Only the header changes, the chunks stay sealed with the same data key
+		dek, err := k.unwrap(h)
+		if err != nil {
+			return err
+		}
+		if err := k.wrap(h, dek); err != nil {
+			return err
+		}
+		if err := writeStreamHeader(tmp, h); err != nil {
+			return err
+		}
+		_, err = io.Copy(tmp, src)
+		return err
+	})
+}
+
+// replaceFile writes a file through a temporary file in the same folder that
+// is renamed over it once complete
+func replaceFile(path string, write func(tmp *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // gone already once renamed
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
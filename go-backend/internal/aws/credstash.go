@@ -101,6 +101,11 @@ func (c *CredstashClient) GetJWTSecret() (string, error) {
 	return c.Get("jwt.secret")
 }
 
+// GetVoucherIndexKey retrieves the voucher index key from credstash
+func (c *CredstashClient) GetVoucherIndexKey() (string, error) {
+	return c.Get("voucher_index.key")
+}
+
 // MustGet retrieves a secret or panics if it fails
 func (c *CredstashClient) MustGet(key string) string {
 	value, err := c.Get(key)
@@ -3,14 +3,17 @@ package aws
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // S3Client wraps AWS S3 operations
@@ -19,8 +22,18 @@ type S3Client struct {
 	bucketName string
 }
 
+// ErrObjectNotFound is returned by Open for keys that do not exist
+var ErrObjectNotFound = errors.New("S3 object not found")
+
 // NewS3Client creates a new S3 client
 func NewS3Client(bucketName, region string) (*S3Client, error) {
+	return NewS3ClientWithEndpoint(bucketName, region, "")
+}
+
+// NewS3ClientWithEndpoint creates a new S3 client for an S3-compatible
+// service, such as MinIO, at endpoint. Buckets are then addressed by path.
+// An empty endpoint is AWS S3.
+func NewS3ClientWithEndpoint(bucketName, region, endpoint string) (*S3Client, error) {
 	if region == "" {
 		region = "ap-south-1"
 	}
@@ -32,8 +45,15 @@ func NewS3Client(bucketName, region string) (*S3Client, error) {
 		return nil, fmt.Errorf("unable to load SDK config: %w", err)
 	}
 
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
 	return &S3Client{
-		client:     s3.NewFromConfig(cfg),
+		client:     client,
 		bucketName: bucketName,
 	}, nil
 }
@@ -76,6 +96,36 @@ func (s *S3Client) UploadFile(key, filePath string) error {
 	return nil
 }
 
+// UploadStream uploads size bytes read from body to S3
+func (s *S3Client) UploadStream(key string, body io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucketName),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to S3: %w", err)
+	}
+	return nil
+}
+
+// Open returns a reader of an S3 object, ErrObjectNotFound when it does not exist
+func (s *S3Client) Open(key string) (io.ReadCloser, error) {
+	result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to download from S3: %w", err)
+	}
+	return result.Body, nil
+}
+
 // Download downloads data from S3
 func (s *S3Client) Download(key string) ([]byte, error) {
 	result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
@@ -124,17 +174,20 @@ func (s *S3Client) Delete(key string) error {
 
 // List lists objects with a given prefix
 func (s *S3Client) List(prefix string) ([]string, error) {
-	result, err := s.client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucketName),
 		Prefix: aws.String(prefix),
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
-	}
 
 	var keys []string
-	for _, obj := range result.Contents {
-		keys = append(keys, *obj.Key)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, *obj.Key)
+		}
 	}
 
 	return keys, nil
@@ -157,12 +210,18 @@ func (s *S3Client) Exists(key string) (bool, error) {
 
 // GetPresignedURL generates a presigned URL for downloading
 func (s *S3Client) GetPresignedURL(key string) (string, error) {
+	return s.GetPresignedURLWithExpiry(key, 15*time.Minute)
+}
+
+// GetPresignedURLWithExpiry generates a presigned URL for downloading that is
+// valid for expires
+func (s *S3Client) GetPresignedURLWithExpiry(key string, expires time.Duration) (string, error) {
 	presignClient := s3.NewPresignClient(s.client)
 	
 	request, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
-	})
+	}, s3.WithPresignExpires(expires))
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
 	}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Archive backends
+const (
+	ArchiveS3         = "s3"
+	ArchiveFilesystem = "filesystem"
+)
+
+// DefaultArchivePrefix is the key prefix of archived run folders
+const DefaultArchivePrefix = "stock_uploads"
+
+// Archive is where finished run folders are copied to, from the ARCHIVE_*
+// environment variables. An empty Backend turns archiving off.
+type Archive struct {
+	Backend  string // s3 or filesystem
+	Bucket   string // s3: bucket name
+	Region   string // s3: bucket region
+	Endpoint string // s3: URL of an S3-compatible service, empty for AWS
+	Dir      string // filesystem: root folder of the archive
+	Prefix   string // key prefix, run files are archived as <prefix>/<runId>/<file>
+
+	// PruneLocal deletes the archived files from the run folder, leaving the
+	// run summary (meta.json, control.json, procurement_batch_id.txt)
+	PruneLocal bool
+
+	// PresignedDownloads redirects full downloads of files only kept in an S3
+	// archive to a presigned URL, when artifacts are not encrypted
+	PresignedDownloads bool
+}
+
+// Enabled reports whether finished runs are archived
+func (a Archive) Enabled() bool {
+	return a.Backend != ""
+}
+
+// loadArchive reads the ARCHIVE_* environment variables
+func loadArchive() (Archive, error) {
+	archive := Archive{
+		Backend:            strings.ToLower(os.Getenv("ARCHIVE_BACKEND")),
+		Bucket:             os.Getenv("ARCHIVE_BUCKET"),
+		Region:             os.Getenv("ARCHIVE_REGION"),
+		Endpoint:           os.Getenv("ARCHIVE_ENDPOINT"),
+		Dir:                os.Getenv("ARCHIVE_DIR"),
+		Prefix:             strings.Trim(os.Getenv("ARCHIVE_PREFIX"), "/"),
+		PruneLocal:         os.Getenv("ARCHIVE_PRUNE_LOCAL") == "true",
+		PresignedDownloads: os.Getenv("ARCHIVE_PRESIGNED_DOWNLOADS") == "true",
+	}
+	if archive.Prefix == "" {
+		archive.Prefix = DefaultArchivePrefix
+	}
+
+	switch archive.Backend {
+	case "":
+	case ArchiveS3:
+		if archive.Bucket == "" {
+			return Archive{}, fmt.Errorf("ARCHIVE_BUCKET is required with ARCHIVE_BACKEND=s3")
+		}
+	case ArchiveFilesystem:
+		if archive.Dir == "" {
+			return Archive{}, fmt.Errorf("ARCHIVE_DIR is required with ARCHIVE_BACKEND=filesystem")
+		}
+	default:
+		return Archive{}, fmt.Errorf("ARCHIVE_BACKEND must be %s or %s", ArchiveS3, ArchiveFilesystem)
+	}
+	return archive, nil
+}
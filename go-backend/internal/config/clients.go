@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Validate checks a client and its upload profile
+func (c Client) Validate() error {
+	if strings.TrimSpace(c.Name) == "" || strings.TrimSpace(c.OfferID) == "" {
+		return fmt.Errorf("name and offer_id are required")
+	}
+	if err := c.ColumnMapping.Validate(); err != nil {
+		return fmt.Errorf("column_mapping: %w", err)
+	}
+	if err := c.DateParsing.Validate(); err != nil {
+		return fmt.Errorf("date_parsing: %w", err)
+	}
+	if err := c.ValidationRules.Validate(); err != nil {
+		return fmt.Errorf("validation_rules: %w", err)
+	}
+	return nil
+}
+
+// FindClient returns the configured client with the given offer ID, or nil
+// when there is none
+func (c *Config) FindClient(offerID string) (*Client, error) {
+	if offerID == "" {
+		return nil, nil
+	}
+
+	clients, err := c.LoadClients()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for i := range clients {
+		if clients[i].OfferID == offerID {
+			return &clients[i], nil
+		}
+	}
+	return nil, nil
+}
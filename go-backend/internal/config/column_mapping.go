@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stock file fields that a column mapping can locate
+const (
+	FieldVoucherCode  = "voucher_code"
+	FieldPin          = "pin"
+	FieldVoucherValue = "voucher_value"
+	FieldExpiryDate   = "expiry_date"
+	FieldOfferID      = "offer_id"       // read by multi-offer uploads only
+	FieldCommission   = "rzp_commission" // read by multi-offer uploads only
+)
+
+// MappedFields lists the stock file fields in a fixed order
+var MappedFields = []string{FieldVoucherCode, FieldPin, FieldVoucherValue, FieldExpiryDate, FieldOfferID, FieldCommission}
+
+// requiredFields must be mapped when a profile gives column positions
+var requiredFields = []string{FieldVoucherCode, FieldVoucherValue, FieldExpiryDate}
+
+// maxSkipRows caps the banner lines a profile may skip
+const maxSkipRows = 100
+
+// ColumnMapping describes the layout of a client's stock files
+type ColumnMapping struct {
+	// Aliases adds header names per field to the built-in ones, matched case-insensitively
+	Aliases map[string][]string `json:"aliases,omitempty"`
+	// Positions gives the 1-based column of each field for files without a
+	// header row. When set, every row after SkipRows is data.
+	Positions map[string]int `json:"positions,omitempty"`
+	// SkipRows is the number of banner lines before the header (or first data) row
+	SkipRows int `json:"skip_rows,omitempty"`
+}
+
+// HasHeader reports whether files of the profile start with a header row
+func (m *ColumnMapping) HasHeader() bool {
+	return m == nil || len(m.Positions) == 0
+}
+
+// Validate checks the field names, positions and skip_rows of a profile
+func (m *ColumnMapping) Validate() error {
+	if m == nil {
+		return nil
+	}
+
+	for field, aliases := range m.Aliases {
+		if !isMappedField(field) {
+			return fmt.Errorf("unknown field %q in aliases", field)
+		}
+		for _, alias := range aliases {
+			if strings.TrimSpace(alias) == "" {
+				return fmt.Errorf("empty alias for %s", field)
+			}
+		}
+	}
+
+	for field := range m.Positions {
+		if !isMappedField(field) {
+			return fmt.Errorf("unknown field %q in positions", field)
+		}
+	}
+	columns := make(map[int]string)
+	for _, field := range MappedFields {
+		position, ok := m.Positions[field]
+		if !ok {
+			continue
+		}
+		if position < 1 {
+			return fmt.Errorf("position of %s must be 1 or more", field)
+		}
+		if other, ok := columns[position]; ok {
+			return fmt.Errorf("%s and %s are both mapped to column %d", other, field, position)
+		}
+		columns[position] = field
+	}
+	if len(m.Positions) > 0 {
+		for _, field := range requiredFields {
+			if _, ok := m.Positions[field]; !ok {
+				return fmt.Errorf("positions must include %s", field)
+			}
+		}
+	}
+
+	if m.SkipRows < 0 || m.SkipRows > maxSkipRows {
+		return fmt.Errorf("skip_rows must be between 0 and %d", maxSkipRows)
+	}
+	return nil
+}
+
+// isMappedField reports whether field is a stock file field
+func isMappedField(field string) bool {
+	for _, known := range MappedFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
@@ -2,17 +2,40 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 )
 
 // Config holds the application configuration
 type Config struct {
-	JWTSecret    string
-	ConfigDir    string
-	StorageDir   string
-	UploadsDir   string
-	ProcIDFile   string
+	ConfigDir       string
+	StorageDir      string
+	UploadsDir      string
+	ProcIDFile      string
+	VoucherIndexDir string
+
+	// MaxConcurrentRuns caps the upload runs of all environments together
+	MaxConcurrentRuns int
+
+	// ArtifactKeyring is the path of the master key file run artifacts are
+	// encrypted with, empty to store them in plaintext
+	ArtifactKeyring string
+
+	// Redaction is how voucher codes and PINs are masked where they are shown
+	Redaction Redaction
+
+	// Archive is where finished run folders are archived to
+	Archive Archive
+
+	// Production is set by ENVIRONMENT=production; the default JWT secret is
+	// refused there
+	Production bool
+
+	// Secrets supplies upstream credentials, the JWT secret and the voucher
+	// index key
+	Secrets SecretProvider
 }
 
 // User represents a user in the system
@@ -30,17 +53,41 @@ type UsersData struct {
 	Users []User `json:"users"`
 }
 
-// Client represents a client configuration
+// Client represents a client configuration. The optional profile fields
+// tell the stock upload how to read the client's files.
 type Client struct {
-	Name    string `json:"name"`
-	OfferID string `json:"offer_id"`
+	Name            string           `json:"name"`
+	OfferID         string           `json:"offer_id"`
+	ColumnMapping   *ColumnMapping   `json:"column_mapping,omitempty"`
+	DateParsing     *DateParsing     `json:"date_parsing,omitempty"`
+	ValidationRules *ValidationRules `json:"validation_rules,omitempty"`
 }
 
-// Credentials holds environment-specific credentials
+// Credentials holds environment-specific credentials and upload tuning.
+// Tuning fields are optional, see applyDefaults for the defaults and limits.
 type Credentials struct {
-	BaseURL  string `json:"base_url"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	BaseURL   string `json:"base_url"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	BatchSize int    `json:"batch_size,omitempty"` // vouchers per voucher-benefits request
+
+	MaxWorkers         int     `json:"max_workers,omitempty"`           // concurrent requests
+	RateLimit          float64 `json:"rate_limit,omitempty"`            // requests per second
+	MaxRetries         int     `json:"max_retries,omitempty"`           // attempts per request
+	RetryBackoffMs     int     `json:"retry_backoff_ms,omitempty"`      // wait after an error
+	RateLimitBackoffMs int     `json:"rate_limit_backoff_ms,omitempty"` // wait after a 429
+	TimeoutSeconds     int     `json:"timeout_seconds,omitempty"`       // per request
+	MaxConcurrentRuns  int     `json:"max_concurrent_runs,omitempty"`   // upload runs at once, more wait in the queue
+
+	// VerifyPath is an optional upstream lookup used before retrying a voucher
+	// whose earlier attempt may have reached upstream. Placeholders {offer_id},
+	// {voucher_code}, {procurement_batch_id} and {idempotency_key} are filled in;
+	// 200 means the voucher exists, 404 that it does not.
+	VerifyPath string `json:"verify_path,omitempty"`
+
+	// RequireApproval holds uploads until a second user with the
+	// stock_approval permission approves them
+	RequireApproval bool `json:"require_approval,omitempty"`
 }
 
 // Environments holds all environment configurations
@@ -52,24 +99,65 @@ func LoadConfig() (*Config, error) {
 	storageDir := "./storage"
 	uploadsDir := filepath.Join(storageDir, "stock_uploads")
 	procIDFile := filepath.Join(storageDir, "procurement_batch_id.txt")
+	voucherIndexDir := filepath.Join(storageDir, "voucher_index")
 
 	// Create directories if they don't exist
 	os.MkdirAll(configDir, 0755)
 	os.MkdirAll(uploadsDir, 0755)
 
-	// JWT secret from env or default
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "your-secret-key-change-in-production"
+	secrets, err := loadSecretProvider(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	maxConcurrentRuns, err := parseMaxConcurrentRuns(os.Getenv("MAX_CONCURRENT_RUNS"))
+	if err != nil {
+		return nil, err
+	}
+
+	redaction, err := loadRedaction(os.Getenv("REDACT_CODE_VISIBLE_CHARS"), os.Getenv("REDACT_PIN_VISIBLE_CHARS"))
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := loadArchive()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		ConfigDir:         configDir,
+		StorageDir:        storageDir,
+		UploadsDir:        uploadsDir,
+		ProcIDFile:        procIDFile,
+		VoucherIndexDir:   voucherIndexDir,
+		MaxConcurrentRuns: maxConcurrentRuns,
+		ArtifactKeyring:   os.Getenv("ARTIFACT_KEYRING"),
+		Redaction:         redaction,
+		Archive:           archive,
+		Production:        os.Getenv("ENVIRONMENT") == "production",
+		Secrets:           secrets,
 	}
 
-	return &Config{
-		JWTSecret:  jwtSecret,
-		ConfigDir:  configDir,
-		StorageDir: storageDir,
-		UploadsDir: uploadsDir,
-		ProcIDFile: procIDFile,
-	}, nil
+	// Tokens signed with a known secret could be forged, production refuses to start
+	jwtSecret, err := cfg.JWTSecret()
+	if err != nil {
+		return nil, fmt.Errorf("JWT secret: %w", err)
+	}
+	if jwtSecret == DefaultJWTSecret {
+		log.Printf("No JWT secret is configured, using the default one (refused with ENVIRONMENT=production)")
+	}
+
+	// Codes hashed with a known key could be brute-forced back from the index
+	voucherIndexKey, err := cfg.VoucherIndexKey()
+	if err != nil {
+		return nil, fmt.Errorf("voucher index key: %w", err)
+	}
+	if string(voucherIndexKey) == DefaultVoucherIndexKey {
+		log.Printf("No voucher index key is configured, using the default one (refused with ENVIRONMENT=production)")
+	}
+
+	return cfg, nil
 }
 
 // LoadUsers reads users from config file
@@ -111,20 +199,46 @@ func (c *Config) LoadClients() ([]Client, error) {
 		return nil, err
 	}
 
+	for _, client := range clients {
+		if err := client.Validate(); err != nil {
+			return nil, fmt.Errorf("client %s: %w", client.Name, err)
+		}
+	}
+
 	return clients, nil
 }
 
-// LoadEnvironments reads environment configurations
+// LoadEnvironments reads environment configurations: the upload tuning of
+// environments.json, with the upstream credentials of the secret provider.
+// environments.json is optional unless it holds the credentials too.
 func (c *Config) LoadEnvironments() (Environments, error) {
 	envPath := filepath.Join(c.ConfigDir, "environments.json")
+	envs := Environments{}
 	data, err := os.ReadFile(envPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	if err == nil {
+		if err := json.Unmarshal(data, &envs); err != nil {
+			return nil, err
+		}
+	}
 
-	var envs Environments
-	if err := json.Unmarshal(data, &envs); err != nil {
-		return nil, err
+	secrets, err := c.secrets().Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load upstream credentials: %w", err)
+	}
+	for name, secret := range secrets {
+		creds := envs[name]
+		creds.BaseURL, creds.Username, creds.Password = secret.BaseURL, secret.Username, secret.Password
+		envs[name] = creds
+	}
+
+	for name, creds := range envs {
+		if err := creds.applyDefaults(); err != nil {
+			return nil, fmt.Errorf("environment %s: %w", name, err)
+		}
+		envs[name] = creds
 	}
 
 	return envs, nil
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embedded zone database, so timezones load on hosts without one
+	_ "time/tzdata"
+)
+
+// DefaultTimezone is the timezone of expiry dates without an explicit offset
+const DefaultTimezone = "Asia/Kolkata"
+
+// DefaultDateFormats are the expiry date layouts (Go reference time) tried
+// when a client has none. Day-first and month-first layouts are both listed,
+// so a value such as 05-12-2025 matches two dates and is rejected.
+var DefaultDateFormats = []string{
+	"2006-01-02 15:04:05 UTC",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02-01-2006", // DD-MM-YYYY
+	"01-02-2006", // MM-DD-YYYY
+	"2-Jan-2006, 15:04",
+	"2-January-2006, 15:04",
+	"1/2/06", // M/D/YY
+	"2/1/06", // D/M/YY
+}
+
+// DateParsing describes how a client's expiry dates are read
+type DateParsing struct {
+	// Formats replaces the default layouts, written with Go's reference time
+	// 2006-01-02 15:04:05
+	Formats []string `json:"formats,omitempty"`
+	// Timezone is an IANA name such as Asia/Kolkata, the default
+	Timezone string `json:"timezone,omitempty"`
+	// EndOfDay moves dates without a time of day to 23:59:59 local time
+	EndOfDay bool `json:"end_of_day,omitempty"`
+}
+
+// DateFormats returns the layouts to try, the defaults when none are set
+func (d *DateParsing) DateFormats() []string {
+	if d == nil || len(d.Formats) == 0 {
+		return DefaultDateFormats
+	}
+	return d.Formats
+}
+
+// Location loads the timezone of the profile, the default when none is set
+func (d *DateParsing) Location() (*time.Location, error) {
+	name := DefaultTimezone
+	if d != nil && d.Timezone != "" {
+		name = d.Timezone
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return location, nil
+}
+
+// Validate checks the layouts and the timezone of a profile
+func (d *DateParsing) Validate() error {
+	if d == nil {
+		return nil
+	}
+
+	for _, layout := range d.Formats {
+		if strings.TrimSpace(layout) == "" {
+			return fmt.Errorf("empty date format")
+		}
+		if _, err := DateOnlyLayout(layout); err != nil {
+			return err
+		}
+	}
+	_, err := d.Location()
+	return err
+}
+
+// DateOnlyLayout reports whether a layout has no time of day. Layouts that
+// cannot give back the day, month and year of a date are an error.
+func DateOnlyLayout(layout string) (bool, error) {
+	reference := time.Date(2001, time.February, 3, 16, 5, 6, 0, time.UTC)
+	parsed, err := time.Parse(layout, reference.Format(layout))
+	if err != nil || parsed.Year() != 2001 || parsed.Month() != time.February || parsed.Day() != 3 {
+		return false, fmt.Errorf("date format %q must include the day, month and year", layout)
+	}
+	return parsed.Hour() == 0 && parsed.Minute() == 0 && parsed.Second() == 0, nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Redaction defaults: codes show their last 4 characters, PINs are never shown
+const (
+	DefaultCodeVisibleChars = 4
+	DefaultPinVisibleChars  = 0
+)
+
+// maxVisibleChars caps how much of a code or PIN redaction may leave readable
+const maxVisibleChars = 16
+
+// Redaction is how voucher codes and PINs are masked in run logs, live
+// broadcasts, run summaries and result downloads
+type Redaction struct {
+	CodeVisibleChars int // trailing characters of codes left readable, 0 masks codes fully
+	PinVisibleChars  int // trailing characters of PINs left readable, 0 masks PINs fully
+}
+
+// loadRedaction reads REDACT_CODE_VISIBLE_CHARS and REDACT_PIN_VISIBLE_CHARS,
+// the defaults when they are empty
+func loadRedaction(codeValue, pinValue string) (Redaction, error) {
+	codeChars, err := parseVisibleChars("REDACT_CODE_VISIBLE_CHARS", codeValue, DefaultCodeVisibleChars)
+	if err != nil {
+		return Redaction{}, err
+	}
+	pinChars, err := parseVisibleChars("REDACT_PIN_VISIBLE_CHARS", pinValue, DefaultPinVisibleChars)
+	if err != nil {
+		return Redaction{}, err
+	}
+	return Redaction{CodeVisibleChars: codeChars, PinVisibleChars: pinChars}, nil
+}
+
+// parseVisibleChars reads one visible characters setting
+func parseVisibleChars(name, value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	chars, err := strconv.Atoi(value)
+	if err != nil || chars < 0 || chars > maxVisibleChars {
+		return 0, fmt.Errorf("%s must be between 0 and %d", name, maxVisibleChars)
+	}
+	return chars, nil
+}
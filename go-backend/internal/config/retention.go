@@ -0,0 +1,97 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultRetentionIntervalHours is how often the retention job runs, unless
+// retention.json says otherwise
+const DefaultRetentionIntervalHours = 24
+
+// RetentionPolicy says how long the files of finished runs are kept. A zero
+// (or missing) number of days keeps them indefinitely. meta.json, control.json
+// and procurement_batch_id.txt, the run summary, are always kept.
+type RetentionPolicy struct {
+	PurgePinsAfterDays     int `json:"purge_pins_after_days,omitempty"`     // blank the PIN column of every run file
+	DeleteRawAfterDays     int `json:"delete_raw_after_days,omitempty"`     // uploaded file, journal and validation report
+	DeleteResultsAfterDays int `json:"delete_results_after_days,omitempty"` // results CSVs and the run log
+}
+
+// IsZero reports whether the policy keeps everything
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// Retention holds the retention policies, from retention.json:
+//
+//	{
+//	  "default": {"purge_pins_after_days": 30, "delete_raw_after_days": 90},
+//	  "environments": {"PROD": {"purge_pins_after_days": 7, "delete_raw_after_days": 30}},
+//	  "procurement_log_max_lines": 10000
+//	}
+type Retention struct {
+	Default      RetentionPolicy            `json:"default"`
+	Environments map[string]RetentionPolicy `json:"environments,omitempty"` // replace the default for an environment
+	// ProcurementLogMaxLines caps the global procurement_batch_id.txt, oldest
+	// lines are dropped first; 0 keeps every line
+	ProcurementLogMaxLines int `json:"procurement_log_max_lines,omitempty"`
+	IntervalHours          int `json:"interval_hours,omitempty"` // time between runs of the retention job
+}
+
+// PolicyFor returns the policy of an environment
+func (r *Retention) PolicyFor(env string) RetentionPolicy {
+	if policy, ok := r.Environments[strings.ToUpper(env)]; ok {
+		return policy
+	}
+	return r.Default
+}
+
+// LoadRetention reads retention.json. Without the file every run file is kept.
+func (c *Config) LoadRetention() (*Retention, error) {
+	retention := &Retention{}
+	data, err := os.ReadFile(filepath.Join(c.ConfigDir, "retention.json"))
+	if os.IsNotExist(err) {
+		retention.IntervalHours = DefaultRetentionIntervalHours
+		return retention, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, retention); err != nil {
+		return nil, fmt.Errorf("invalid retention.json: %w", err)
+	}
+
+	environments := make(map[string]RetentionPolicy, len(retention.Environments))
+	for env, policy := range retention.Environments {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("retention policy of %s: %w", env, err)
+		}
+		environments[strings.ToUpper(env)] = policy
+	}
+	retention.Environments = environments
+	if err := retention.Default.validate(); err != nil {
+		return nil, fmt.Errorf("default retention policy: %w", err)
+	}
+	if retention.ProcurementLogMaxLines < 0 {
+		return nil, fmt.Errorf("procurement_log_max_lines cannot be negative")
+	}
+	if retention.IntervalHours < 0 {
+		return nil, fmt.Errorf("interval_hours cannot be negative")
+	}
+	if retention.IntervalHours == 0 {
+		retention.IntervalHours = DefaultRetentionIntervalHours
+	}
+	return retention, nil
+}
+
+// validate rejects negative ages
+func (p RetentionPolicy) validate() error {
+	if p.PurgePinsAfterDays < 0 || p.DeleteRawAfterDays < 0 || p.DeleteResultsAfterDays < 0 {
+		return fmt.Errorf("days cannot be negative")
+	}
+	return nil
+}
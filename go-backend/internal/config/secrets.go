@@ -0,0 +1,312 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gc-distribution-portal/internal/aws"
+)
+
+// Secret providers, selected with SECRET_PROVIDER
+const (
+	SecretsFile      = "file"
+	SecretsEnv       = "env"
+	SecretsCredstash = "credstash"
+)
+
+// DefaultJWTSecret signs tokens when no JWT secret is configured, outside of
+// production only
+const DefaultJWTSecret = "your-secret-key-change-in-production"
+
+// DefaultVoucherIndexKey keys the voucher index when no key is configured,
+// outside of production only
+const DefaultVoucherIndexKey = "voucher-index-key-change-in-production"
+
+// DefaultSecretCacheTTL is how long secrets are cached before they are fetched again
+const DefaultSecretCacheTTL = 5 * time.Minute
+
+// UpstreamCredentials are the secret part of an environment's settings
+type UpstreamCredentials struct {
+	BaseURL  string
+	Username string
+	Password string
+}
+
+// SecretProvider supplies the upstream credentials of each environment, the
+// JWT signing secret and the key of the voucher index
+type SecretProvider interface {
+	// Credentials returns the upstream credentials by environment name
+	Credentials() (map[string]UpstreamCredentials, error)
+
+	// JWTSecret returns the JWT signing secret, "" when none is configured
+	JWTSecret() (string, error)
+
+	// VoucherIndexKey returns the key voucher codes are hashed with in the
+	// voucher index, "" when none is configured
+	VoucherIndexKey() (string, error)
+}
+
+// fileSecrets reads upstream credentials from environments.json, the JWT
+// secret from JWT_SECRET_FILE and the voucher index key from
+// VOUCHER_INDEX_KEY_FILE, or the JWT_SECRET and VOUCHER_INDEX_KEY variables
+// without them
+type fileSecrets struct {
+	configDir           string
+	jwtSecretFile       string
+	voucherIndexKeyFile string
+}
+
+// Credentials reads the credentials of environments.json
+func (s *fileSecrets) Credentials() (map[string]UpstreamCredentials, error) {
+	data, err := os.ReadFile(filepath.Join(s.configDir, "environments.json"))
+	if err != nil {
+		return nil, err
+	}
+	var envs Environments
+	if err := json.Unmarshal(data, &envs); err != nil {
+		return nil, err
+	}
+
+	credentials := make(map[string]UpstreamCredentials, len(envs))
+	for name, env := range envs {
+		credentials[name] = UpstreamCredentials{BaseURL: env.BaseURL, Username: env.Username, Password: env.Password}
+	}
+	return credentials, nil
+}
+
+// JWTSecret reads the secret file
+func (s *fileSecrets) JWTSecret() (string, error) {
+	if s.jwtSecretFile == "" {
+		return os.Getenv("JWT_SECRET"), nil
+	}
+	data, err := os.ReadFile(s.jwtSecretFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read JWT secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// VoucherIndexKey reads the key file
+func (s *fileSecrets) VoucherIndexKey() (string, error) {
+	if s.voucherIndexKeyFile == "" {
+		return os.Getenv("VOUCHER_INDEX_KEY"), nil
+	}
+	data, err := os.ReadFile(s.voucherIndexKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read voucher index key file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// envSecrets reads secrets from environment variables: UPSTREAM_<ENV>_URL,
+// UPSTREAM_<ENV>_USERNAME and UPSTREAM_<ENV>_PASSWORD for each environment,
+// JWT_SECRET and VOUCHER_INDEX_KEY
+type envSecrets struct{}
+
+// Credentials collects the environments that have an UPSTREAM_<ENV>_URL
+func (envSecrets) Credentials() (map[string]UpstreamCredentials, error) {
+	credentials := make(map[string]UpstreamCredentials)
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, "UPSTREAM_") || !strings.HasSuffix(name, "_URL") {
+			continue
+		}
+		env := strings.TrimSuffix(strings.TrimPrefix(name, "UPSTREAM_"), "_URL")
+		if env == "" {
+			continue
+		}
+		credentials[env] = UpstreamCredentials{
+			BaseURL:  value,
+			Username: os.Getenv("UPSTREAM_" + env + "_USERNAME"),
+			Password: os.Getenv("UPSTREAM_" + env + "_PASSWORD"),
+		}
+	}
+	return credentials, nil
+}
+
+// JWTSecret reads JWT_SECRET
+func (envSecrets) JWTSecret() (string, error) {
+	return os.Getenv("JWT_SECRET"), nil
+}
+
+// VoucherIndexKey reads VOUCHER_INDEX_KEY
+func (envSecrets) VoucherIndexKey() (string, error) {
+	return os.Getenv("VOUCHER_INDEX_KEY"), nil
+}
+
+// credstashSecrets reads secrets from credstash: razorpay.<env>.url,
+// .username and .password for TEST and PROD, jwt.secret and voucher_index.key
+type credstashSecrets struct {
+	client *aws.CredstashClient
+}
+
+// Credentials fetches the TEST and PROD credentials
+func (s *credstashSecrets) Credentials() (map[string]UpstreamCredentials, error) {
+	envs, err := s.client.GetEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]UpstreamCredentials, len(envs))
+	for name, env := range envs {
+		credentials[name] = UpstreamCredentials{BaseURL: env.BaseURL, Username: env.Username, Password: env.Password}
+	}
+	return credentials, nil
+}
+
+// JWTSecret fetches jwt.secret
+func (s *credstashSecrets) JWTSecret() (string, error) {
+	return s.client.GetJWTSecret()
+}
+
+// VoucherIndexKey fetches voucher_index.key
+func (s *credstashSecrets) VoucherIndexKey() (string, error) {
+	return s.client.GetVoucherIndexKey()
+}
+
+// cachedSecrets caches the secrets of a provider for ttl. When a refresh
+// fails the last secrets fetched keep being served, so an outage of the
+// secret store does not take the portal down.
+type cachedSecrets struct {
+	provider SecretProvider
+	ttl      time.Duration
+
+	mu              sync.Mutex
+	credentials     map[string]UpstreamCredentials
+	credentialsAt   time.Time
+	jwtSecret       cachedSecret
+	voucherIndexKey cachedSecret
+}
+
+// cachedSecret is a secret of a cachedSecrets and when it was fetched
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// Credentials returns the cached credentials, fetching them once expired
+func (s *cachedSecrets) Credentials() (map[string]UpstreamCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.credentials != nil && time.Since(s.credentialsAt) < s.ttl {
+		return s.credentials, nil
+	}
+	credentials, err := s.provider.Credentials()
+	if err != nil {
+		if s.credentials == nil {
+			return nil, err
+		}
+		log.Printf("Cannot refresh upstream credentials, using the cached ones: %v", err)
+		return s.credentials, nil
+	}
+	s.credentials, s.credentialsAt = credentials, time.Now()
+	return credentials, nil
+}
+
+// JWTSecret returns the cached JWT secret, fetching it once expired
+func (s *cachedSecrets) JWTSecret() (string, error) {
+	return s.get(&s.jwtSecret, s.provider.JWTSecret, "JWT secret")
+}
+
+// VoucherIndexKey returns the cached voucher index key, fetching it once expired
+func (s *cachedSecrets) VoucherIndexKey() (string, error) {
+	return s.get(&s.voucherIndexKey, s.provider.VoucherIndexKey, "voucher index key")
+}
+
+// get returns a cached secret, fetching it with fetch once expired
+func (s *cachedSecrets) get(secret *cachedSecret, fetch func() (string, error), name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !secret.fetchedAt.IsZero() && time.Since(secret.fetchedAt) < s.ttl {
+		return secret.value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		if secret.fetchedAt.IsZero() {
+			return "", err
+		}
+		log.Printf("Cannot refresh %s, using the cached one: %v", name, err)
+		return secret.value, nil
+	}
+	secret.value, secret.fetchedAt = value, time.Now()
+	return value, nil
+}
+
+// loadSecretProvider creates the provider named by SECRET_PROVIDER, file when
+// empty. Providers other than file are cached for SECRET_CACHE_TTL seconds.
+func loadSecretProvider(configDir string) (SecretProvider, error) {
+	ttl := DefaultSecretCacheTTL
+	if value := os.Getenv("SECRET_CACHE_TTL"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("SECRET_CACHE_TTL must be a number of seconds")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	switch strings.ToLower(os.Getenv("SECRET_PROVIDER")) {
+	case "", SecretsFile:
+		return &fileSecrets{
+			configDir:           configDir,
+			jwtSecretFile:       os.Getenv("JWT_SECRET_FILE"),
+			voucherIndexKeyFile: os.Getenv("VOUCHER_INDEX_KEY_FILE"),
+		}, nil
+	case SecretsEnv:
+		return &cachedSecrets{provider: envSecrets{}, ttl: ttl}, nil
+	case SecretsCredstash:
+		client := aws.NewCredstashClient(os.Getenv("CREDSTASH_REGION"))
+		return &cachedSecrets{provider: &credstashSecrets{client: client}, ttl: ttl}, nil
+	}
+	return nil, fmt.Errorf("SECRET_PROVIDER must be %s, %s or %s", SecretsFile, SecretsEnv, SecretsCredstash)
+}
+
+// JWTSecret returns the JWT signing secret from the secret provider. Outside
+// of production DefaultJWTSecret stands in for a missing secret.
+func (c *Config) JWTSecret() (string, error) {
+	secret, err := c.secrets().JWTSecret()
+	if err != nil {
+		return "", err
+	}
+	if secret == "" && !c.Production {
+		return DefaultJWTSecret, nil
+	}
+	if secret == "" || secret == DefaultJWTSecret {
+		return "", fmt.Errorf("a JWT secret other than the default is required with ENVIRONMENT=production")
+	}
+	return secret, nil
+}
+
+// VoucherIndexKey returns the key of the voucher index from the secret
+// provider. Outside of production DefaultVoucherIndexKey stands in for a
+// missing key. The key must not change: codes indexed under another key are
+// no longer recognised as duplicates.
+func (c *Config) VoucherIndexKey() ([]byte, error) {
+	key, err := c.secrets().VoucherIndexKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && !c.Production {
+		return []byte(DefaultVoucherIndexKey), nil
+	}
+	if key == "" || key == DefaultVoucherIndexKey {
+		return nil, fmt.Errorf("a voucher index key other than the default is required with ENVIRONMENT=production")
+	}
+	return []byte(key), nil
+}
+
+// secrets returns the secret provider, the file provider for configs not
+// built by LoadConfig
+func (c *Config) secrets() SecretProvider {
+	if c.Secrets == nil {
+		return &fileSecrets{configDir: c.ConfigDir}
+	}
+	return c.Secrets
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Upload tuning defaults, used when an environment does not set a value
+const (
+	DefaultBatchSize          = 1
+	DefaultMaxWorkers         = 3
+	DefaultRateLimit          = 3.0
+	DefaultMaxRetries         = 3
+	DefaultRetryBackoffMs     = 2000
+	DefaultRateLimitBackoffMs = 5000
+	DefaultTimeoutSeconds     = 30
+	DefaultMaxConcurrentRuns  = 1 // runs of one environment
+)
+
+// DefaultMaxConcurrentRunsTotal caps the runs of all environments together,
+// unless MAX_CONCURRENT_RUNS says otherwise
+const DefaultMaxConcurrentRunsTotal = 4
+
+// Upload tuning limits, values outside them are rejected
+const (
+	maxBatchSize   = 500
+	maxWorkers     = 50
+	maxRateLimit   = 100.0
+	maxRetries     = 10
+	maxBackoffMs   = 5 * 60 * 1000
+	maxTimeoutSecs = 300
+	maxRuns        = 50
+)
+
+// applyDefaults fills unset tuning fields and validates the rest. A field set
+// to 0 counts as unset and gets its default.
+func (c *Credentials) applyDefaults() error {
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	if c.MaxWorkers == 0 {
+		c.MaxWorkers = DefaultMaxWorkers
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = DefaultRateLimit
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = DefaultMaxRetries
+	}
+	if c.RetryBackoffMs == 0 {
+		c.RetryBackoffMs = DefaultRetryBackoffMs
+	}
+	if c.RateLimitBackoffMs == 0 {
+		c.RateLimitBackoffMs = DefaultRateLimitBackoffMs
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = DefaultTimeoutSeconds
+	}
+	if c.MaxConcurrentRuns == 0 {
+		c.MaxConcurrentRuns = DefaultMaxConcurrentRuns
+	}
+
+	switch {
+	case c.BatchSize < 1 || c.BatchSize > maxBatchSize:
+		return fmt.Errorf("batch_size must be between 1 and %d", maxBatchSize)
+	case c.MaxWorkers < 1 || c.MaxWorkers > maxWorkers:
+		return fmt.Errorf("max_workers must be between 1 and %d", maxWorkers)
+	case c.RateLimit < 0 || c.RateLimit > maxRateLimit:
+		return fmt.Errorf("rate_limit must be at most %g requests per second, 0 uses the default of %g", maxRateLimit, DefaultRateLimit)
+	case c.MaxRetries < 1 || c.MaxRetries > maxRetries:
+		return fmt.Errorf("max_retries must be between 1 and %d", maxRetries)
+	case c.RetryBackoffMs < 0 || c.RetryBackoffMs > maxBackoffMs:
+		return fmt.Errorf("retry_backoff_ms must be at most %d, 0 uses the default of %d", maxBackoffMs, DefaultRetryBackoffMs)
+	case c.RateLimitBackoffMs < 0 || c.RateLimitBackoffMs > maxBackoffMs:
+		return fmt.Errorf("rate_limit_backoff_ms must be at most %d, 0 uses the default of %d", maxBackoffMs, DefaultRateLimitBackoffMs)
+	case c.TimeoutSeconds < 1 || c.TimeoutSeconds > maxTimeoutSecs:
+		return fmt.Errorf("timeout_seconds must be between 1 and %d", maxTimeoutSecs)
+	case c.MaxConcurrentRuns < 1 || c.MaxConcurrentRuns > maxRuns:
+		return fmt.Errorf("max_concurrent_runs must be between 1 and %d", maxRuns)
+	}
+
+	return nil
+}
+
+// RetryBackoff returns the wait before retrying after an error
+func (c Credentials) RetryBackoff() time.Duration {
+	return time.Duration(c.RetryBackoffMs) * time.Millisecond
+}
+
+// RateLimitBackoff returns the wait before retrying after a 429
+func (c Credentials) RateLimitBackoff() time.Duration {
+	return time.Duration(c.RateLimitBackoffMs) * time.Millisecond
+}
+
+// Timeout returns the HTTP timeout of a single request
+func (c Credentials) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// parseMaxConcurrentRuns reads the MAX_CONCURRENT_RUNS setting, the default
+// when it is empty
+func parseMaxConcurrentRuns(value string) (int, error) {
+	if value == "" {
+		return DefaultMaxConcurrentRunsTotal, nil
+	}
+	runs, err := strconv.Atoi(value)
+	if err != nil || runs < 1 || runs > maxRuns {
+		return 0, fmt.Errorf("MAX_CONCURRENT_RUNS must be between 1 and %d", maxRuns)
+	}
+	return runs, nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ValidationRules are the checks a client's voucher rows must pass before
+// they are sent upstream. Zero values switch a check off.
+type ValidationRules struct {
+	// CodePattern is a regular expression the whole voucher code must match
+	CodePattern   string `json:"code_pattern,omitempty"`
+	CodeMinLength int    `json:"code_min_length,omitempty"`
+	CodeMaxLength int    `json:"code_max_length,omitempty"`
+	PinRequired   bool   `json:"pin_required,omitempty"`
+	// Denominations lists the allowed voucher values in paise
+	Denominations []int `json:"denominations_paise,omitempty"`
+	MinAmount     int   `json:"min_amount_paise,omitempty"`
+	MaxAmount     int   `json:"max_amount_paise,omitempty"`
+	// MinValidityDays is how many days a voucher must still be valid for at upload time
+	MinValidityDays int `json:"min_validity_days,omitempty"`
+}
+
+// CodeRegexp compiles the code pattern anchored to the whole code, nil when
+// there is none
+func (r *ValidationRules) CodeRegexp() (*regexp.Regexp, error) {
+	if r == nil || r.CodePattern == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(`^(?:` + r.CodePattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid code_pattern: %v", err)
+	}
+	return pattern, nil
+}
+
+// Validate checks that the rules can be applied and do not contradict each other
+func (r *ValidationRules) Validate() error {
+	if r == nil {
+		return nil
+	}
+
+	if _, err := r.CodeRegexp(); err != nil {
+		return err
+	}
+	if r.CodeMinLength < 0 || r.CodeMaxLength < 0 {
+		return fmt.Errorf("code lengths cannot be negative")
+	}
+	if r.CodeMaxLength > 0 && r.CodeMinLength > r.CodeMaxLength {
+		return fmt.Errorf("code_min_length is more than code_max_length")
+	}
+
+	for _, denomination := range r.Denominations {
+		if denomination <= 0 {
+			return fmt.Errorf("denominations_paise must be more than zero")
+		}
+	}
+	if r.MinAmount < 0 || r.MaxAmount < 0 {
+		return fmt.Errorf("amount limits cannot be negative")
+	}
+	if r.MaxAmount > 0 && r.MinAmount > r.MaxAmount {
+		return fmt.Errorf("min_amount_paise is more than max_amount_paise")
+	}
+
+	if r.MinValidityDays < 0 {
+		return fmt.Errorf("min_validity_days cannot be negative")
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,6 +13,15 @@ type contextKey string
 
 const UserContextKey contextKey = "user"
 
+// jwtSecret returns the secret tokens are signed with, see SetJWTSecret
+var jwtSecret func() (string, error)
+
+// SetJWTSecret sets where the JWT secret comes from. It is asked on every
+// request, so a secret refreshed by the secret provider is picked up.
+func SetJWTSecret(secret func() (string, error)) {
+	jwtSecret = secret
+}
+
 // UserClaims represents the JWT claims
 type UserClaims struct {
 	Username    string   `json:"username"`
@@ -35,13 +43,18 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
 
 		// Parse and validate token
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			jwtSecret = "your-secret-key-change-in-production"
+		if jwtSecret == nil {
+			http.Error(w, `{"success":false,"message":"Authentication is not configured"}`, http.StatusInternalServerError)
+			return
+		}
+		secret, err := jwtSecret()
+		if err != nil {
+			http.Error(w, `{"success":false,"message":"Authentication is not available"}`, http.StatusInternalServerError)
+			return
 		}
 
 		token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
+			return []byte(secret), nil
 		})
 
 		if err != nil || !token.Valid {
@@ -67,6 +80,16 @@ func GetUserFromContext(ctx context.Context) (*UserClaims, bool) {
 	return user, ok
 }
 
+// HasPermission reports whether a user was granted a permission
+func HasPermission(user *UserClaims, permission string) bool {
+	for _, p := range user.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // RequirePermission checks if user has required permission
 func RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
@@ -77,15 +100,7 @@ func RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFun
 				return
 			}
 
-			hasPermission := false
-			for _, p := range user.Permissions {
-				if p == permission {
-					hasPermission = true
-					break
-				}
-			}
-
-			if !hasPermission {
+			if !HasPermission(user, permission) {
 				http.Error(w, `{"success":false,"message":"Forbidden - insufficient permissions"}`, http.StatusForbidden)
 				return
 			}
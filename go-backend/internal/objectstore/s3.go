@@ -0,0 +1,53 @@
+package objectstore
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"gc-distribution-portal/internal/aws"
+)
+
+// S3Store keeps objects in an S3 bucket, through aws.S3Client
+type S3Store struct {
+	client *aws.S3Client
+}
+
+// NewS3Store creates a store on a bucket. endpoint is the URL of an
+// S3-compatible service, empty for AWS S3.
+func NewS3Store(bucket, region, endpoint string) (*S3Store, error) {
+	client, err := aws.NewS3ClientWithEndpoint(bucket, region, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{client: client}, nil
+}
+
+// Put uploads the object
+func (s *S3Store) Put(key string, body io.Reader, size int64) error {
+	return s.client.UploadStream(key, body, size)
+}
+
+// Get streams the object
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	body, err := s.client.Open(key)
+	if errors.Is(err, aws.ErrObjectNotFound) {
+		return nil, ErrNotFound
+	}
+	return body, err
+}
+
+// Delete deletes the object
+func (s *S3Store) Delete(key string) error {
+	return s.client.Delete(key)
+}
+
+// List lists the keys of the bucket starting with prefix
+func (s *S3Store) List(prefix string) ([]string, error) {
+	return s.client.List(prefix)
+}
+
+// PresignedURL presigns a GET of the object
+func (s *S3Store) PresignedURL(key string, expires time.Duration) (string, error) {
+	return s.client.GetPresignedURLWithExpiry(key, expires)
+}
@@ -0,0 +1,51 @@
+// Package objectstore archives finished run folders to an object store: an S3
+// bucket (or an S3-compatible service) in production, a local folder for
+// development and tests.
+package objectstore
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"gc-distribution-portal/internal/config"
+)
+
+var (
+	// ErrNotFound is returned for keys the store does not have
+	ErrNotFound = errors.New("object not found")
+
+	// ErrPresignUnsupported is returned by stores that cannot hand out URLs
+	ErrPresignUnsupported = errors.New("store does not support presigned URLs")
+)
+
+// ObjectStore keeps objects under slash-separated keys
+type ObjectStore interface {
+	// Put stores size bytes read from body under key, replacing any object there
+	Put(key string, body io.Reader, size int64) error
+
+	// Get returns a reader of the object under key, ErrNotFound when there is none
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the object under key, if any
+	Delete(key string) error
+
+	// List returns the keys starting with prefix
+	List(prefix string) ([]string, error)
+
+	// PresignedURL returns a URL the object can be downloaded from without
+	// credentials until expires has passed
+	PresignedURL(key string, expires time.Duration) (string, error)
+}
+
+// Open returns the object store of the archive settings, nil when archiving
+// is off
+func Open(settings config.Archive) (ObjectStore, error) {
+	switch settings.Backend {
+	case config.ArchiveS3:
+		return NewS3Store(settings.Bucket, settings.Region, settings.Endpoint)
+	case config.ArchiveFilesystem:
+		return NewFileStore(settings.Dir)
+	}
+	return nil, nil
+}
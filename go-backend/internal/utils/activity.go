@@ -29,9 +29,26 @@ type UploadHistory struct {
 	TotalRows          int       `json:"totalRows"`
 	SuccessRows        int       `json:"successRows"`
 	FailedRows         int       `json:"failedRows"`
+	SkippedRows        int       `json:"skippedRows"`
+	AlreadyPresentRows int       `json:"alreadyPresentRows"`
+	ParentRunID        string    `json:"parentRunId,omitempty"`
 	ProcurementBatchID string    `json:"procurementBatchID"`
 	Status             string    `json:"status"`
 	Timestamp          time.Time `json:"timestamp"`
+
+	// Offers breaks the rows of multi-offer uploads down by offer
+	Offers []UploadHistoryOffer `json:"offers,omitempty"`
+}
+
+// UploadHistoryOffer is the outcome of the rows of one offer of an upload
+type UploadHistoryOffer struct {
+	OfferID            string `json:"offerID"`
+	ClientName         string `json:"clientName"`
+	TotalRows          int    `json:"totalRows"`
+	SuccessRows        int    `json:"successRows"`
+	FailedRows         int    `json:"failedRows"`
+	SkippedRows        int    `json:"skippedRows"`
+	AlreadyPresentRows int    `json:"alreadyPresentRows"`
 }
 
 var activityMutex sync.Mutex
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VoucherIndexEntry records a voucher code that was uploaded successfully.
+// Only a keyed hash of the code is kept, codes and PINs are never written here.
+type VoucherIndexEntry struct {
+	Hash      string    `json:"hash"`
+	RunID     string    `json:"runId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var voucherIndexMutex sync.Mutex
+
+// HashVoucherCode hashes a voucher code together with its environment and
+// offer. The hash is keyed, so codes cannot be brute-forced back from the
+// index without the key.
+func HashVoucherCode(key []byte, environment, offerID, code string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToUpper(environment) + "|" + offerID + "|" + strings.TrimSpace(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VoucherIdempotencyKey derives the idempotency key of a voucher upload. The
+// same voucher in the same procurement batch always gets the same key, so
+// retries and resumed runs can be recognised upstream.
+func VoucherIdempotencyKey(procurementBatchID, offerID, code string) string {
+	sum := sha256.Sum256([]byte(procurementBatchID + "|" + offerID + "|" + strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// voucherIndexPath returns the index file for an environment and offer
+func voucherIndexPath(indexDir, environment, offerID string) string {
+	return filepath.Join(indexDir, strings.ToUpper(environment), filepath.Base(offerID)+".jsonl")
+}
+
+// LoadVoucherIndex reads all indexed code hashes for an environment and offer
+func LoadVoucherIndex(indexDir, environment, offerID string) (map[string]VoucherIndexEntry, error) {
+	voucherIndexMutex.Lock()
+	defer voucherIndexMutex.Unlock()
+
+	index := make(map[string]VoucherIndexEntry)
+
+	file, err := os.Open(voucherIndexPath(indexDir, environment, offerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil // Nothing uploaded for this offer yet
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry VoucherIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if _, exists := index[entry.Hash]; !exists {
+			index[entry.Hash] = entry
+		}
+	}
+
+	return index, scanner.Err()
+}
+
+// AppendVoucherIndex adds uploaded code hashes to the index of an environment and offer
+func AppendVoucherIndex(indexDir, environment, offerID string, entries []VoucherIndexEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	voucherIndexMutex.Lock()
+	defer voucherIndexMutex.Unlock()
+
+	path := voucherIndexPath(indexDir, environment, offerID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		data, _ := json.Marshal(entry)
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
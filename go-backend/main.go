@@ -7,8 +7,10 @@ import (
 	"os"
 
 	"gc-distribution-portal/internal/api"
+	"gc-distribution-portal/internal/artifact"
 	"gc-distribution-portal/internal/config"
 	"gc-distribution-portal/internal/middleware"
+	"gc-distribution-portal/internal/objectstore"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -21,16 +23,41 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Run artifacts are encrypted at rest when a keyring is configured
+	keyring, err := artifact.LoadKeyring(cfg.ArtifactKeyring)
+	if err != nil {
+		log.Fatalf("Failed to load artifact keyring: %v", err)
+	}
+	if keyring == nil {
+		log.Printf("ARTIFACT_KEYRING is not set, run artifacts are stored in plaintext")
+	}
+
+	// Finished runs are archived when an archive is configured
+	archive, err := objectstore.Open(cfg.Archive)
+	if err != nil {
+		log.Fatalf("Failed to open run archive: %v", err)
+	}
+	if archive != nil {
+		log.Printf("Archiving finished runs to %s storage under %s", cfg.Archive.Backend, cfg.Archive.Prefix)
+	}
+
+	// Tokens are signed and verified with the secret of the secret provider
+	middleware.SetJWTSecret(cfg.JWTSecret)
+
 	// Initialize router
 	r := mux.NewRouter()
 
 	// Initialize API handlers
 	authHandler := api.NewAuthHandler(cfg)
-	stockHandler := api.NewStockHandler(cfg)
+	stockHandler := api.NewStockHandler(cfg, keyring, archive)
 	profileHandler := api.NewProfileHandler(cfg)
 	passwordRequestHandler := api.NewPasswordRequestHandler(cfg)
 	wsHub := api.NewWebSocketHub()
 	go wsHub.Run()
+	stockHandler.StartQueue(wsHub)
+	stockHandler.StartScheduler()
+	stockHandler.StartRetention()
+	stockHandler.StartArchiver()
 
 	// Health check endpoint
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -50,7 +77,23 @@ func main() {
 	r.HandleFunc("/auth/users/status", middleware.AuthMiddleware(authHandler.UpdateUserStatus)).Methods("PUT")
 
 	// Stock routes (protected)
-	r.HandleFunc("/stock/upload", middleware.AuthMiddleware(stockHandler.StartUpload(wsHub))).Methods("POST")
+	r.HandleFunc("/stock/upload", middleware.AuthMiddleware(stockHandler.StartUpload)).Methods("POST")
+	r.HandleFunc("/stock/validate", middleware.AuthMiddleware(stockHandler.ValidateUpload)).Methods("POST")
+	r.HandleFunc("/stock/runs", middleware.AuthMiddleware(stockHandler.ListRuns)).Methods("GET")
+	r.HandleFunc("/stock/runs/{runId}", middleware.AuthMiddleware(stockHandler.GetRun)).Methods("GET")
+	r.HandleFunc("/stock/runs/{runId}/resume", middleware.AuthMiddleware(stockHandler.ResumeRun)).Methods("POST")
+	r.HandleFunc("/stock/runs/{runId}/retry-failed", middleware.AuthMiddleware(stockHandler.RetryFailed)).Methods("POST")
+	r.HandleFunc("/stock/schedules", middleware.AuthMiddleware(stockHandler.ListSchedules)).Methods("GET")
+	r.HandleFunc("/stock/schedules/{runId}", middleware.AuthMiddleware(stockHandler.RescheduleRun)).Methods("PUT")
+	r.HandleFunc("/stock/schedules/{runId}/cancel", middleware.AuthMiddleware(stockHandler.CancelSchedule)).Methods("POST")
+	r.HandleFunc("/stock/queue", middleware.AuthMiddleware(stockHandler.GetQueue)).Methods("GET")
+	r.HandleFunc("/stock/queue/{runId}", middleware.AuthMiddleware(stockHandler.ReprioritiseQueued)).Methods("PUT")
+	r.HandleFunc("/stock/queue/{runId}/cancel", middleware.AuthMiddleware(stockHandler.CancelQueued)).Methods("POST")
+	r.HandleFunc("/stock/approvals", middleware.AuthMiddleware(stockHandler.ListApprovals)).Methods("GET")
+	r.HandleFunc("/stock/approvals/{runId}", middleware.AuthMiddleware(stockHandler.GetApproval)).Methods("GET")
+	r.HandleFunc("/stock/approvals/{runId}", middleware.AuthMiddleware(stockHandler.ReviewUpload)).Methods("POST")
+	r.HandleFunc("/stock/retention", middleware.AuthMiddleware(stockHandler.GetRetention)).Methods("GET")
+	r.HandleFunc("/stock/retention/run", middleware.AuthMiddleware(stockHandler.TriggerRetention)).Methods("POST")
 	r.HandleFunc("/stock/control/{runId}", middleware.AuthMiddleware(stockHandler.ControlRun)).Methods("POST")
 	r.HandleFunc("/stock/download/{runId}/{filename}", middleware.AuthMiddleware(stockHandler.DownloadFile)).Methods("GET")
 
@@ -81,8 +124,8 @@ func main() {
 		api.ServeWebSocket(wsHub, w, r)
 	})
 
-	// Serve static files
-	r.PathPrefix("/storage").Handler(http.StripPrefix("/storage", http.FileServer(http.Dir("./storage"))))
+	// Serve static files. Run artifacts are not served here, they are only
+	// decrypted by the download endpoint.
 	r.PathPrefix("/config").Handler(http.StripPrefix("/config", http.FileServer(http.Dir("./config"))))
 
 	// CORS configuration